@@ -0,0 +1,748 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/client"
+	"github.com/the-rileyj/uyghurs"
+	"gopkg.in/yaml.v2"
+)
+
+// buildLogWriter sends everything written to it to the server as BuildLog
+// chunks, output is buffered until a chunk fills up or close is called. Chunks
+// that can't be sent stay buffered, so losing the connection never fails the
+// build that is writing.
+type buildLogWriter struct {
+	serverConn *serverConnection
+	repository string
+	commit     string
+	sequence   int
+	sendFailed bool
+	buffer     *bytes.Buffer
+	lock       *sync.Mutex
+}
+
+func newBuildLogWriter(serverConn *serverConnection, repository, commit string) *buildLogWriter {
+	return &buildLogWriter{
+		serverConn: serverConn,
+		repository: repository,
+		commit:     commit,
+		buffer:     &bytes.Buffer{},
+		lock:       &sync.Mutex{},
+	}
+}
+
+func (bLW *buildLogWriter) Write(p []byte) (int, error) {
+	bLW.lock.Lock()
+
+	defer bLW.lock.Unlock()
+
+	os.Stdout.Write(p)
+
+	bLW.buffer.Write(p)
+
+	for bLW.buffer.Len() >= uyghurs.MaxBuildLogChunkSize {
+		if !bLW.sendChunk(uyghurs.MaxBuildLogChunkSize, false) {
+			break
+		}
+	}
+
+	return len(p), nil
+}
+
+// sendChunk sends the first size bytes of the buffer and drops them from it
+// once they're sent, a failed send is logged once until a send succeeds again.
+func (bLW *buildLogWriter) sendChunk(size int, final bool) bool {
+	err := bLW.serverConn.send(uyghurs.BuildLog{
+		Repository: bLW.repository,
+		Commit:     bLW.commit,
+		Sequence:   bLW.sequence,
+		Data:       bLW.buffer.Bytes()[:size],
+		Final:      final,
+	})
+
+	if err != nil {
+		if !bLW.sendFailed {
+			fmt.Printf("error sending build output for %s@%s, buffering it: %s\n", bLW.repository, bLW.commit, err)
+		}
+
+		bLW.sendFailed = true
+
+		return false
+	}
+
+	bLW.sendFailed = false
+
+	bLW.buffer.Next(size)
+
+	bLW.sequence++
+
+	return true
+}
+
+// close sends whatever is left in the buffer as the final chunk.
+func (bLW *buildLogWriter) close() error {
+	bLW.lock.Lock()
+
+	defer bLW.lock.Unlock()
+
+	for bLW.buffer.Len() > uyghurs.MaxBuildLogChunkSize {
+		if !bLW.sendChunk(uyghurs.MaxBuildLogChunkSize, false) {
+			return errors.New("build output couldn't be sent")
+		}
+	}
+
+	if !bLW.sendChunk(bLW.buffer.Len(), true) {
+		return errors.New("build output couldn't be sent")
+	}
+
+	return nil
+}
+
+func (bLW *buildLogWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(bLW, format, args...)
+}
+
+// dockerMessage is the subset of the JSON messages docker streams back from
+// builds and pushes that the worker cares about.
+type dockerMessage struct {
+	Stream      string `json:"stream"`
+	Status      string `json:"status"`
+	Progress    string `json:"progress"`
+	ID          string `json:"id"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+	Aux *dockerAux `json:"aux"`
+}
+
+// dockerAux is the result docker reports at the end of a stream, the image
+// ID for builds and the pushed tag's digest for pushes.
+type dockerAux struct {
+	ID     string `json:"ID"`
+	Tag    string `json:"Tag"`
+	Digest string `json:"Digest"`
+}
+
+// copyDockerMessages writes the human readable parts of a docker message
+// stream to w and returns the stream's last result or the first error docker
+// reported in the stream.
+func copyDockerMessages(w io.Writer, messageStream io.Reader) (*dockerAux, error) {
+	decoder := json.NewDecoder(messageStream)
+
+	aux := &dockerAux{}
+
+	for {
+		var message dockerMessage
+
+		err := decoder.Decode(&message)
+
+		if err == io.EOF {
+			return aux, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if message.ErrorDetail != nil && message.ErrorDetail.Message != "" {
+			return nil, errors.New(message.ErrorDetail.Message)
+		}
+
+		if message.Error != "" {
+			return nil, errors.New(message.Error)
+		}
+
+		if message.Aux != nil {
+			aux = message.Aux
+		}
+
+		if message.Stream != "" {
+			io.WriteString(w, message.Stream)
+		}
+
+		if message.Status != "" && message.Progress == "" {
+			if message.ID != "" {
+				fmt.Fprintf(w, "%s: %s\n", message.ID, message.Status)
+			} else {
+				fmt.Fprintln(w, message.Status)
+			}
+		}
+	}
+}
+
+func registryAuthFromEnv() string {
+	authConfig := types.AuthConfig{
+		Username: os.Getenv("DOCKER_USERNAME"),
+		Password: strings.Trim(os.Getenv("DOCKER_PASSWORD"), "\r\n"),
+	}
+
+	authConfigBytes, err := json.Marshal(authConfig)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return base64.URLEncoding.EncodeToString(authConfigBytes)
+}
+
+var appNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+type projectBuilder struct {
+	cli          *client.Client
+	workDir      string
+	namespace    string
+	registryAuth string
+}
+
+// build clones the pushed commit, builds and pushes every image declared in
+// the project's x-hong-kong settings and returns the response for the server.
+func (pB *projectBuilder) build(workRequest uyghurs.WorkRequest, serverConn *serverConnection) uyghurs.WorkResponse {
+	githubPush := workRequest.GithubData
+
+	workResponse := uyghurs.WorkResponse{
+		JobID:      workRequest.JobID,
+		GithubData: githubPush,
+	}
+
+	if githubPush.After == "" {
+		commit, err := resolveRef(githubPush)
+
+		if err != nil {
+			workResponse.Err = fmt.Sprintf("error resolving %s: %s", githubPush.Ref, err)
+
+			return workResponse
+		}
+
+		githubPush.After = commit
+
+		workResponse.GithubData.After = commit
+	}
+
+	workRequest.GithubData = githubPush
+
+	if workRequest.App == "" {
+		workRequest.App = githubPush.Repository.Name
+	}
+
+	if workRequest.Registry == "" {
+		workRequest.Registry = pB.namespace
+	}
+
+	if workRequest.ComposeFile == "" {
+		workRequest.ComposeFile = "docker-compose.yml"
+	}
+
+	if !appNameRegex.MatchString(workRequest.App) || strings.Trim(workRequest.App, ".") == "" {
+		workResponse.Err = fmt.Sprintf("invalid app name %q", workRequest.App)
+
+		return workResponse
+	}
+
+	buildLog := newBuildLogWriter(serverConn, workRequest.App, githubPush.After)
+
+	defer func() {
+		if workResponse.Err != "" {
+			buildLog.printf("build failed: %s\n", workResponse.Err)
+		} else {
+			buildLog.printf("build succeeded\n")
+		}
+
+		err := buildLog.close()
+
+		if err != nil {
+			fmt.Println("error sending build log:", err)
+		}
+	}()
+
+	err := pB.buildProject(workRequest, &workResponse, buildLog)
+
+	if err != nil {
+		workResponse.Err = err.Error()
+	}
+
+	return workResponse
+}
+
+func repositoryCloneURL(repository uyghurs.Repository) string {
+	if repository.CloneURL != "" {
+		return repository.CloneURL
+	}
+
+	return repository.URL
+}
+
+// resolveRef looks up the commit the push's ref points to, tags are peeled so
+// annotated tags resolve to their commit rather than the tag object.
+func resolveRef(githubPush uyghurs.GithubPush) (string, error) {
+	lsRemoteOutput, err := exec.Command("git", "ls-remote", repositoryCloneURL(githubPush.Repository), githubPush.Ref, githubPush.Ref+"^{}").Output()
+
+	if err != nil {
+		return "", err
+	}
+
+	commit := ""
+
+	for _, line := range strings.Split(string(lsRemoteOutput), "\n") {
+		lineParts := strings.Fields(line)
+
+		if len(lineParts) != 2 {
+			continue
+		}
+
+		if lineParts[1] == githubPush.Ref+"^{}" || commit == "" {
+			commit = lineParts[0]
+		}
+	}
+
+	if commit == "" {
+		return "", errors.New("ref not found")
+	}
+
+	return commit, nil
+}
+
+// buildProject builds and pushes the pushed commit's images, filling in the
+// response with the project's settings, the full commit that was built and
+// the pinned reference of every image.
+func (pB *projectBuilder) buildProject(workRequest uyghurs.WorkRequest, workResponse *uyghurs.WorkResponse, buildLog *buildLogWriter) error {
+	githubPush := workRequest.GithubData
+
+	cloneURL := repositoryCloneURL(githubPush.Repository)
+
+	if cloneURL == "" {
+		return errors.New("push has no repository URL to clone")
+	}
+
+	if githubPush.After == "" {
+		return errors.New("push has no commit to build")
+	}
+
+	cloneDir, err := filepath.Abs(filepath.Join(pB.workDir, fmt.Sprintf("%s-%s", workRequest.App, githubPush.After)))
+
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(cloneDir)
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(cloneDir)
+
+	buildLog.printf("cloning %s at %s\n", cloneURL, githubPush.After)
+
+	for _, gitArgs := range [][]string{
+		{"clone", "--quiet", "--no-checkout", cloneURL, cloneDir},
+		{"-C", cloneDir, "checkout", "--quiet", "--detach", githubPush.After},
+	} {
+		gitCommand := exec.Command("git", gitArgs...)
+
+		gitCommand.Stdout = buildLog
+		gitCommand.Stderr = buildLog
+
+		err = gitCommand.Run()
+
+		if err != nil {
+			return fmt.Errorf("error running git %s: %s", gitArgs[0], err)
+		}
+	}
+
+	// Commits given by deploy requests can be abbreviated, images are tagged
+	// with and the server checks out the full commit
+	commitOutput, err := exec.Command("git", "-C", cloneDir, "rev-parse", "HEAD").Output()
+
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %s", githubPush.After, err)
+	}
+
+	githubPush.After = strings.TrimSpace(string(commitOutput))
+
+	workResponse.GithubData.After = githubPush.After
+
+	dockerComposePath := filepath.Join(cloneDir, filepath.FromSlash(workRequest.ComposeFile))
+
+	if !strings.HasPrefix(dockerComposePath, cloneDir+string(filepath.Separator)) {
+		return fmt.Errorf("compose file %q is outside of the repository", workRequest.ComposeFile)
+	}
+
+	dockerComposeBytes, err := ioutil.ReadFile(dockerComposePath)
+
+	if err != nil {
+		return err
+	}
+
+	var hongKongSettings uyghurs.HongKongSettings
+
+	err = yaml.Unmarshal(dockerComposeBytes, &hongKongSettings)
+
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %s", workRequest.ComposeFile, err)
+	}
+
+	projectMetadata := hongKongSettings.HongKongProjectSettings
+
+	projectMetadata.ProjectName = workRequest.App
+
+	images := make(map[string]string)
+
+	for _, buildInfo := range projectMetadata.BuildsInfo {
+		imageName := uyghurs.ImageName(workRequest.ImageTemplate, workRequest.Registry, workRequest.App, buildInfo.Name)
+
+		// The commit tag is pushed first, it is the one the server deploys,
+		// latest is only kept up to date for running the project by hand
+		imageTags := []string{imageName + ":" + githubPush.After, imageName + ":latest"}
+
+		buildLog.printf("building %s\n", imageName)
+
+		err = pB.buildImage(cloneDir, buildInfo, imageTags, buildLog)
+
+		if err != nil {
+			return fmt.Errorf("error building %s: %s", buildInfo.Name, err)
+		}
+
+		images[buildInfo.Name] = imageTags[0]
+
+		for _, imageTag := range imageTags {
+			buildLog.printf("pushing %s\n", imageTag)
+
+			digest, err := pB.pushImage(imageTag, buildLog)
+
+			if err != nil {
+				return fmt.Errorf("error pushing %s: %s", imageTag, err)
+			}
+
+			if imageTag == imageTags[0] && digest != "" {
+				images[buildInfo.Name] = imageName + "@" + digest
+			}
+		}
+	}
+
+	workResponse.ProjectMetadata = projectMetadata
+
+	workResponse.Images = images
+
+	return nil
+}
+
+func (pB *projectBuilder) buildImage(cloneDir string, buildInfo *uyghurs.BuildInfo, imageTags []string, buildLog io.Writer) error {
+	contextDir := filepath.Join(cloneDir, filepath.FromSlash(buildInfo.Context))
+
+	if contextDir != cloneDir && !strings.HasPrefix(contextDir, cloneDir+string(filepath.Separator)) {
+		return fmt.Errorf("build context %q is outside of the repository", buildInfo.Context)
+	}
+
+	dockerfile := buildInfo.Dockerfile
+
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	buildContext, err := tarDirectory(contextDir, dockerfile)
+
+	if err != nil {
+		return err
+	}
+
+	timeoutContext, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+
+	defer cancel()
+
+	buildResponse, err := pB.cli.ImageBuild(timeoutContext, buildContext, types.ImageBuildOptions{
+		Tags:        imageTags,
+		Dockerfile:  filepath.ToSlash(dockerfile),
+		Remove:      true,
+		ForceRemove: true,
+		PullParent:  true,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer buildResponse.Body.Close()
+
+	_, err = copyDockerMessages(buildLog, buildResponse.Body)
+
+	return err
+}
+
+// pushImage pushes a tag and returns the digest the registry stored it as.
+func (pB *projectBuilder) pushImage(imageTag string, buildLog io.Writer) (string, error) {
+	timeoutContext, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+
+	defer cancel()
+
+	pushResponse, err := pB.cli.ImagePush(timeoutContext, imageTag, types.ImagePushOptions{
+		RegistryAuth: pB.registryAuth,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	defer pushResponse.Close()
+
+	aux, err := copyDockerMessages(buildLog, pushResponse)
+
+	if err != nil {
+		return "", err
+	}
+
+	return aux.Digest, nil
+}
+
+// dockerignorePattern is one line of a .dockerignore file, a negated
+// pattern brings back paths an earlier pattern left out.
+type dockerignorePattern struct {
+	expression *regexp.Regexp
+	depth      int
+	negated    bool
+}
+
+// readDockerignore reads the .dockerignore file in dir, a missing file
+// ignores nothing.
+func readDockerignore(dir string) ([]*dockerignorePattern, error) {
+	dockerignoreFile, err := os.Open(filepath.Join(dir, ".dockerignore"))
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer dockerignoreFile.Close()
+
+	lines, err := dockerignore.ReadAll(dockerignoreFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make([]*dockerignorePattern, 0, len(lines))
+
+	for _, line := range lines {
+		pattern := &dockerignorePattern{negated: strings.HasPrefix(line, "!")}
+
+		line = strings.TrimPrefix(path.Clean(strings.TrimPrefix(line, "!")), "/")
+
+		pattern.depth = strings.Count(line, "/") + 1
+
+		pattern.expression, err = dockerignoreExpression(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("bad .dockerignore pattern %q: %w", line, err)
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// dockerignoreExpression turns a .dockerignore pattern into a regular
+// expression, * and ? don't match slashes and ** matches any number of
+// directories.
+func dockerignoreExpression(pattern string) (*regexp.Regexp, error) {
+	var expression strings.Builder
+
+	expression.WriteString("^")
+
+	for index := 0; index < len(pattern); index++ {
+		switch character := pattern[index]; {
+		case strings.HasPrefix(pattern[index:], "**/"):
+			expression.WriteString("(.*/)?")
+
+			index += 2
+		case strings.HasPrefix(pattern[index:], "**"):
+			expression.WriteString(".*")
+
+			index++
+		case character == '*':
+			expression.WriteString("[^/]*")
+		case character == '?':
+			expression.WriteString("[^/]")
+		case character == '[':
+			classEnd := strings.Index(pattern[index:], "]")
+
+			if classEnd == -1 {
+				return nil, errors.New("unterminated character class")
+			}
+
+			class := pattern[index+1 : index+classEnd]
+
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expression.WriteString("[" + class + "]")
+
+			index += classEnd
+		case character == '\\' && index+1 < len(pattern):
+			index++
+
+			expression.WriteString(regexp.QuoteMeta(pattern[index : index+1]))
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(character)))
+		}
+	}
+
+	expression.WriteString("$")
+
+	return regexp.Compile(expression.String())
+}
+
+// dockerignored checks whether a slash separated path relative to the build
+// context is left out by patterns. Like the docker CLI, a pattern matching a
+// directory leaves out everything in it and the last matching pattern wins.
+func dockerignored(relativePath string, patterns []*dockerignorePattern) bool {
+	ignored := false
+
+	pathParts := strings.Split(relativePath, "/")
+
+	for _, pattern := range patterns {
+		matched := pattern.expression.MatchString(relativePath)
+
+		if !matched && pattern.depth < len(pathParts) {
+			matched = pattern.expression.MatchString(strings.Join(pathParts[:pattern.depth], "/"))
+		}
+
+		if matched {
+			ignored = !pattern.negated
+		}
+	}
+
+	return ignored
+}
+
+// tarDirectory returns dir as an in-memory tar archive to send to docker as a
+// build context. The .git directory and whatever .dockerignore lists are left
+// out, the Engine API leaves applying .dockerignore to its clients. The
+// Dockerfile and .dockerignore are always sent, as the docker CLI does.
+func tarDirectory(dir, dockerfile string) (io.Reader, error) {
+	patterns, err := readDockerignore(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories that are left out still have to be walked if a negated
+	// pattern could bring back something inside them
+	hasNegatedPatterns := false
+
+	for _, pattern := range patterns {
+		hasNegatedPatterns = hasNegatedPatterns || pattern.negated
+	}
+
+	alwaysSent := map[string]bool{
+		".dockerignore":                          true,
+		path.Clean(filepath.ToSlash(dockerfile)): true,
+	}
+
+	tarBuffer := &bytes.Buffer{}
+
+	tarWriter := tar.NewWriter(tarBuffer)
+
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(dir, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		if relativePath == "." {
+			return nil
+		}
+
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if !alwaysSent[filepath.ToSlash(relativePath)] && dockerignored(filepath.ToSlash(relativePath), patterns) {
+			if info.IsDir() && !hasNegatedPatterns {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		linkTarget := ""
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(filePath)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, linkTarget)
+
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(relativePath)
+
+		err = tarWriter.WriteHeader(header)
+
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(filePath)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		_, err = io.Copy(tarWriter, file)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tarWriter.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tarBuffer, nil
+}
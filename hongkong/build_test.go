@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDockerignored(t *testing.T) {
+	tests := []struct {
+		name         string
+		dockerignore string
+		path         string
+		want         bool
+	}{
+		{"no patterns", "", "main.go", false},
+		{"exact file", "secrets.env", "secrets.env", true},
+		{"exact file elsewhere", "secrets.env", "config/secrets.env", false},
+		{"leading slash", "/secrets.env", "secrets.env", true},
+		{"directory", "node_modules", "node_modules", true},
+		{"inside a directory", "node_modules", "node_modules/left-pad/index.js", true},
+		{"star", "*.log", "build.log", true},
+		{"star doesn't cross slashes", "*.log", "logs/build.log", false},
+		{"star in a directory", "*/*.log", "logs/build.log", true},
+		{"double star", "**/*.log", "logs/2020/build.log", true},
+		{"double star at the root", "**/*.log", "build.log", true},
+		{"question mark", "build?.log", "build1.log", true},
+		{"question mark is one character", "build?.log", "build10.log", false},
+		{"character class", "build[0-9].log", "build7.log", true},
+		{"negated character class", "build[!0-9].log", "build7.log", false},
+		{"escaped star", "\\*.log", "*.log", true},
+		{"escaped star is literal", "\\*.log", "build.log", false},
+		{"exception", "*.md\n!README.md", "README.md", false},
+		{"exception leaves the rest out", "*.md\n!README.md", "CHANGELOG.md", true},
+		{"last pattern wins", "!README.md\n*.md", "README.md", true},
+		{"exception inside a directory", "docs\n!docs/index.md", "docs/index.md", false},
+		{"comments", "# *.go", "main.go", false},
+		{"dots are literal", "a.b", "axb", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dockerignore")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer os.RemoveAll(dir)
+
+			err = ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte(test.dockerignore), 0644)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patterns, err := readDockerignore(dir)
+
+			if err != nil {
+				t.Fatalf("readDockerignore(%q): %s", test.dockerignore, err)
+			}
+
+			if got := dockerignored(test.path, patterns); got != test.want {
+				t.Errorf("%q ignored by %q = %v, want %v", test.path, test.dockerignore, got, test.want)
+			}
+		})
+	}
+}
+
+func TestTarDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build-context")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		".dockerignore":         "*\n!app\n!docker/web.Dockerfile",
+		".git/HEAD":             "ref: refs/heads/master",
+		"app/main.go":           "package main",
+		"docker/web.Dockerfile": "FROM scratch",
+		"secrets.env":           "TOKEN=1",
+		"notes/todo.md":         "- nothing",
+	}
+
+	for name, contents := range files {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buildContext, err := tarDirectory(dir, "docker/web.Dockerfile")
+
+	if err != nil {
+		t.Fatalf("tarDirectory: %s", err)
+	}
+
+	var got []string
+
+	tarReader := tar.NewReader(buildContext)
+
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			got = append(got, strings.TrimPrefix(header.Name, "./"))
+		}
+	}
+
+	sort.Strings(got)
+
+	want := []string{".dockerignore", "app/main.go", "docker/web.Dockerfile"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tarDirectory sent %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,13 @@
+module github.com/the-rileyj/uyghurs/hongkong
+
+go 1.13
+
+require (
+	github.com/docker/docker v1.13.1
+	github.com/gorilla/websocket v1.4.2
+	github.com/joho/godotenv v1.3.0
+	github.com/the-rileyj/uyghurs v0.1.10
+	gopkg.in/yaml.v2 v2.2.8
+)
+
+replace github.com/the-rileyj/uyghurs => ../
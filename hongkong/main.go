@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/gorilla/websocket"
+	"github.com/joho/godotenv"
+	"github.com/the-rileyj/uyghurs"
+)
+
+// serverConnection serializes writes to the websocket, since builds, log
+// streaming and heartbeats all write from different goroutines. It outlives
+// the websocket, reconnecting replaces conn so a build that is still running
+// sends the rest of its output on the new one.
+type serverConnection struct {
+	conn      *websocket.Conn
+	writeLock *sync.Mutex
+}
+
+func (sC *serverConnection) send(messageData interface{}) error {
+	messageBytes, err := uyghurs.MarshalWorkerMessage(messageData)
+
+	if err != nil {
+		return err
+	}
+
+	sC.writeLock.Lock()
+
+	defer sC.writeLock.Unlock()
+
+	if sC.conn == nil {
+		return errors.New("not connected to the server")
+	}
+
+	return sC.conn.WriteMessage(websocket.TextMessage, messageBytes)
+}
+
+// setConn replaces the websocket, closing the one it replaces.
+func (sC *serverConnection) setConn(conn *websocket.Conn) {
+	sC.writeLock.Lock()
+
+	defer sC.writeLock.Unlock()
+
+	if sC.conn != nil {
+		sC.conn.Close()
+	}
+
+	sC.conn = conn
+}
+
+func (sC *serverConnection) receive() (interface{}, error) {
+	var workerMessage uyghurs.WorkerMessage
+
+	err := sC.conn.ReadJSON(&workerMessage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !uyghurs.ProtocolVersionSupported(workerMessage.Version) {
+		return nil, fmt.Errorf("server speaks unsupported protocol version %d", workerMessage.Version)
+	}
+
+	return workerMessage.DecodeMessageData()
+}
+
+type workerState struct {
+	state uyghurs.WorkerStateType
+	lock  *sync.Mutex
+}
+
+func (wS *workerState) get() uyghurs.WorkerStateType {
+	wS.lock.Lock()
+
+	defer wS.lock.Unlock()
+
+	return wS.state
+}
+
+// start moves the worker to building, it reports false if it already was.
+func (wS *workerState) start() bool {
+	wS.lock.Lock()
+
+	defer wS.lock.Unlock()
+
+	if wS.state == uyghurs.Building {
+		return false
+	}
+
+	wS.state = uyghurs.Building
+
+	return true
+}
+
+func (wS *workerState) finish() {
+	wS.lock.Lock()
+
+	wS.state = uyghurs.Idle
+
+	wS.lock.Unlock()
+}
+
+// connect dials the server and completes the handshake, only then is the
+// new websocket handed to serverConn so builds never write to it before.
+func connect(serverConn *serverConnection, serverURL, hongKongSecret, workerName string) error {
+	workerURL, err := url.Parse(serverURL)
+
+	if err != nil {
+		return err
+	}
+
+	workerURL.Path = strings.TrimSuffix(workerURL.Path, "/") + "/worker/" + url.PathEscape(hongKongSecret)
+	workerURL.RawQuery = url.Values{"name": []string{workerName}}.Encode()
+
+	conn, _, err := websocket.DefaultDialer.Dial(workerURL.String(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	handshakeConn := &serverConnection{
+		conn:      conn,
+		writeLock: &sync.Mutex{},
+	}
+
+	err = handshakeConn.send(uyghurs.HandshakeRequest{
+		ProtocolVersion: uyghurs.ProtocolVersion,
+		WorkerName:      workerName,
+	})
+
+	if err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	messageData, err := handshakeConn.receive()
+
+	if err != nil {
+		conn.Close()
+
+		return err
+	}
+
+	handshakeResponse, isHandshakeResponse := messageData.(*uyghurs.HandshakeResponse)
+
+	if !isHandshakeResponse {
+		conn.Close()
+
+		return fmt.Errorf("expected handshake response, got %T", messageData)
+	}
+
+	if !handshakeResponse.Accepted {
+		conn.Close()
+
+		return fmt.Errorf("server rejected handshake: %s", handshakeResponse.Err)
+	}
+
+	serverConn.setConn(conn)
+
+	return nil
+}
+
+func main() {
+	envFile := flag.Bool("env", true, "use env file for config")
+
+	serverURL := flag.String("server", "wss://localhost:8443", "websocket URL of the uyghurs server")
+
+	workerName := flag.String("name", "", "name to register with the server, defaults to the hostname")
+
+	workDir := flag.String("workdir", "builds/", "directory repositories are cloned into")
+
+	namespace := flag.String("namespace", "docker.io/therileyjohnson", "registry namespace built images are pushed to when the server doesn't name one")
+
+	flag.Parse()
+
+	if *envFile {
+		err := godotenv.Load()
+
+		if err != nil {
+			log.Fatal("Error loading .env file")
+		}
+	}
+
+	hongKongSecret := strings.Trim(os.Getenv("HONG_KONG_SECRET"), "\r\n")
+
+	if hongKongSecret == "" {
+		log.Fatal(`environmental variable "HONG_KONG_SECRET" is not set`)
+	}
+
+	if *workerName == "" {
+		hostname, err := os.Hostname()
+
+		if err != nil {
+			log.Fatal("error getting hostname:", err)
+		}
+
+		*workerName = hostname
+	}
+
+	cli, err := client.NewEnvClient()
+
+	if err != nil {
+		panic(err)
+	}
+
+	builder := &projectBuilder{
+		cli:          cli,
+		workDir:      *workDir,
+		namespace:    *namespace,
+		registryAuth: registryAuthFromEnv(),
+	}
+
+	state := &workerState{
+		state: uyghurs.Idle,
+		lock:  &sync.Mutex{},
+	}
+
+	serverConn := &serverConnection{
+		writeLock: &sync.Mutex{},
+	}
+
+	for {
+		err := connect(serverConn, *serverURL, hongKongSecret, *workerName)
+
+		if err != nil {
+			fmt.Println("error connecting to server:", err)
+
+			time.Sleep(5 * time.Second)
+
+			continue
+		}
+
+		fmt.Println("Connected to server!")
+
+		for {
+			messageData, err := serverConn.receive()
+
+			if err != nil {
+				fmt.Println("error receiving message from server:", err)
+
+				break
+			}
+
+			switch messageData := messageData.(type) {
+			case *uyghurs.PingRequest:
+				err = serverConn.send(uyghurs.PingResponse{
+					SentAt: messageData.SentAt,
+					State:  state.get(),
+				})
+
+				if err != nil {
+					fmt.Println("error answering ping:", err)
+				}
+			case *uyghurs.WorkRequest:
+				if !state.start() {
+					fmt.Printf("received job %s while building, answering that the worker is busy\n", messageData.JobID)
+
+					err = serverConn.send(uyghurs.WorkResponse{
+						JobID:      messageData.JobID,
+						Err:        "worker is busy building another job",
+						GithubData: messageData.GithubData,
+						Busy:       true,
+					})
+
+					if err != nil {
+						fmt.Println("error answering work request:", err)
+					}
+
+					continue
+				}
+
+				go func(workRequest uyghurs.WorkRequest) {
+					defer state.finish()
+
+					workResponse := builder.build(workRequest, serverConn)
+
+					// The server requeues a job when its worker disconnects, so a
+					// response that can't be sent now is never wanted later
+					err := serverConn.send(workResponse)
+
+					if err != nil {
+						fmt.Printf("error sending the response to job %s, the server will build it again: %s\n", workResponse.JobID, err)
+					}
+				}(*messageData)
+			default:
+				messageBytes, _ := json.Marshal(messageData)
+
+				fmt.Printf("unexpected message from server: %T %s\n", messageData, messageBytes)
+			}
+		}
+
+		serverConn.setConn(nil)
+
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	repositoryFullNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)+$`)
+	registryRegex           = regexp.MustCompile(`^[a-z0-9.:-]+(/[a-z0-9._-]+)*$`)
+)
+
+var errUnknownRepository = errors.New("repository isn't registered")
+
+// productionEnvironment is the environment apps are deployed to unless they
+// name another one.
+const productionEnvironment = "production"
+
+// appConfig maps a repository to the app it is deployed as. App names the
+// directory under the apps directory the app is run from as well as its
+// images, which are pushed to Registry and named after ImageTemplate.
+// PullTimeout bounds pulling the images of a deploy and KeepImages is how
+// many released images of every build are kept around. Environment picks
+// which of the app's secrets its deploys get. Apps with RequireApproval only
+// deploy builds that are approved within ApprovalTimeout.
+type appConfig struct {
+	Repository      string `json:"repository" yaml:"repository"`
+	App             string `json:"app" yaml:"app"`
+	Environment     string `json:"environment" yaml:"environment"`
+	ComposeFile     string `json:"composeFile" yaml:"composeFile"`
+	Registry        string `json:"registry" yaml:"registry"`
+	ImageTemplate   string `json:"imageTemplate" yaml:"imageTemplate"`
+	PullTimeout     string `json:"pullTimeout" yaml:"pullTimeout"`
+	KeepImages      int    `json:"keepImages" yaml:"keepImages"`
+	RequireApproval bool   `json:"requireApproval" yaml:"requireApproval"`
+	ApprovalTimeout string `json:"approvalTimeout" yaml:"approvalTimeout"`
+}
+
+// appRegistry is the allowlist of repositories the server deploys, pushes
+// from any other repository are rejected however well they are signed.
+type appRegistry struct {
+	appsDir string
+	apps    map[string]*appConfig
+}
+
+// loadAppRegistry reads the app registry at configPath, a missing file is an
+// empty registry. Whatever an app leaves out is taken from defaults.
+func loadAppRegistry(configPath, appsDir string, defaults appConfig) (*appRegistry, error) {
+	var config struct {
+		Apps []*appConfig `yaml:"apps"`
+	}
+
+	configBytes, err := ioutil.ReadFile(configPath)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = yaml.UnmarshalStrict(configBytes, &config)
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", configPath, err)
+	}
+
+	aR := &appRegistry{
+		appsDir: appsDir,
+		apps:    make(map[string]*appConfig),
+	}
+
+	appNames := make(map[string]string)
+
+	for _, app := range config.Apps {
+		if !repositoryFullNameRegex.MatchString(app.Repository) || strings.Contains(app.Repository, "..") {
+			return nil, fmt.Errorf("invalid repository %q, expected owner/name", app.Repository)
+		}
+
+		if app.App == "" {
+			app.App = path.Base(app.Repository)
+		}
+
+		if !projectNameRegex.MatchString(app.App) || strings.Trim(app.App, ".") == "" {
+			return nil, fmt.Errorf("invalid app name %q for %s", app.App, app.Repository)
+		}
+
+		if app.Environment == "" {
+			app.Environment = productionEnvironment
+		}
+
+		if !environmentRegex.MatchString(app.Environment) {
+			return nil, fmt.Errorf("invalid environment %q for %s", app.Environment, app.Repository)
+		}
+
+		if app.ComposeFile == "" {
+			app.ComposeFile = defaults.ComposeFile
+		}
+
+		app.ComposeFile = filepath.ToSlash(filepath.Clean(app.ComposeFile))
+
+		if filepath.IsAbs(app.ComposeFile) || app.ComposeFile == ".." || strings.HasPrefix(app.ComposeFile, "../") {
+			return nil, fmt.Errorf("compose file %q of %s is outside of the app", app.ComposeFile, app.Repository)
+		}
+
+		if app.Registry == "" {
+			app.Registry = defaults.Registry
+		}
+
+		if !registryRegex.MatchString(app.Registry) {
+			return nil, fmt.Errorf("invalid registry %q for %s", app.Registry, app.Repository)
+		}
+
+		if app.ImageTemplate == "" {
+			app.ImageTemplate = defaults.ImageTemplate
+		}
+
+		err = validateImageTemplate(app.ImageTemplate, app.Registry, app.App)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid image template for %s: %w", app.Repository, err)
+		}
+
+		if app.PullTimeout == "" {
+			app.PullTimeout = defaults.PullTimeout
+		}
+
+		if pullTimeout, err := time.ParseDuration(app.PullTimeout); err != nil || pullTimeout <= 0 {
+			return nil, fmt.Errorf("invalid pull timeout %q for %s", app.PullTimeout, app.Repository)
+		}
+
+		if app.KeepImages == 0 {
+			app.KeepImages = defaults.KeepImages
+		}
+
+		if app.KeepImages < 0 {
+			return nil, fmt.Errorf("invalid keepImages %d for %s", app.KeepImages, app.Repository)
+		}
+
+		if app.ApprovalTimeout == "" {
+			app.ApprovalTimeout = defaults.ApprovalTimeout
+		}
+
+		if approvalTimeout, err := time.ParseDuration(app.ApprovalTimeout); err != nil || approvalTimeout <= 0 {
+			return nil, fmt.Errorf("invalid approval timeout %q for %s", app.ApprovalTimeout, app.Repository)
+		}
+
+		repositoryKey := strings.ToLower(app.Repository)
+
+		if _, exists := aR.apps[repositoryKey]; exists {
+			return nil, fmt.Errorf("repository %s is registered twice", app.Repository)
+		}
+
+		if otherRepository, exists := appNames[app.App]; exists {
+			return nil, fmt.Errorf("app %s is used by both %s and %s", app.App, otherRepository, app.Repository)
+		}
+
+		appNames[app.App] = app.Repository
+
+		aR.apps[repositoryKey] = app
+	}
+
+	return aR, nil
+}
+
+// validateImageTemplate checks that a template names every build of an app
+// differently and that the names are valid image names.
+func validateImageTemplate(imageTemplate, registry, app string) error {
+	if !strings.Contains(imageTemplate, "{build}") {
+		return fmt.Errorf("%q doesn't contain {build}", imageTemplate)
+	}
+
+	// Image names are held to the same rules as registries, which are image
+	// names without the last part
+	imageName := uyghurs.ImageName(imageTemplate, registry, app, "build")
+
+	if !registryRegex.MatchString(imageName) || !strings.Contains(imageName, "/") {
+		return fmt.Errorf("%q names images like %q, which isn't a valid image name", imageTemplate, imageName)
+	}
+
+	return nil
+}
+
+// lookup finds the app a repository, given by its full owner/name, deploys to.
+func (aR *appRegistry) lookup(repositoryFullName string) (*appConfig, error) {
+	app, exists := aR.apps[strings.ToLower(repositoryFullName)]
+
+	if !exists {
+		return nil, fmt.Errorf("%w: %q", errUnknownRepository, repositoryFullName)
+	}
+
+	return app, nil
+}
+
+func (aR *appRegistry) byApp(appName string) (*appConfig, bool) {
+	for _, app := range aR.apps {
+		if app.App == appName {
+			return app, true
+		}
+	}
+
+	return nil, false
+}
+
+func (aR *appRegistry) list() []*appConfig {
+	apps := make([]*appConfig, 0, len(aR.apps))
+
+	for _, app := range aR.apps {
+		apps = append(apps, app)
+	}
+
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].App < apps[j].App
+	})
+
+	return apps
+}
+
+// appDir is the directory the app is checked out and run from.
+func (aR *appRegistry) appDir(app *appConfig) string {
+	return filepath.Join(aR.appsDir, app.App)
+}
+
+// workRequest asks a worker to build the push as this app.
+func (aC *appConfig) workRequest(githubPush uyghurs.GithubPush) uyghurs.WorkRequest {
+	return uyghurs.WorkRequest{
+		App:           aC.App,
+		Registry:      aC.Registry,
+		ImageTemplate: aC.ImageTemplate,
+		ComposeFile:   aC.ComposeFile,
+		GithubData:    githubPush,
+	}
+}
+
+// pullTimeout is how long pulling all of a deploy's images may take.
+func (aC *appConfig) pullTimeout() time.Duration {
+	pullTimeout, _ := time.ParseDuration(aC.PullTimeout)
+
+	return pullTimeout
+}
+
+// approvalTimeout is how long a build waits for approval before it expires.
+func (aC *appConfig) approvalTimeout() time.Duration {
+	approvalTimeout, _ := time.ParseDuration(aC.ApprovalTimeout)
+
+	return approvalTimeout
+}
+
+// imageName is the name, without a tag, of the image the worker builds for
+// one of the app's BuildInfo entries.
+func (aC *appConfig) imageName(buildName string) string {
+	return uyghurs.ImageName(aC.ImageTemplate, aC.Registry, aC.App, buildName)
+}
+
+// buildImage is the pinned reference of the image built for a BuildInfo entry
+// at commit, references reported by the worker are only taken if they name
+// the app's image.
+func (aC *appConfig) buildImage(buildName, commit string, images map[string]string) (string, error) {
+	imageName := aC.imageName(buildName)
+
+	image, reported := images[buildName]
+
+	if !reported {
+		return imageName + ":" + commit, nil
+	}
+
+	if !strings.HasPrefix(image, imageName+"@sha256:") && image != imageName+":"+commit {
+		return "", fmt.Errorf("worker reported image %q for %s, expected %s", image, buildName, imageName)
+	}
+
+	return image, nil
+}
+
+// pinnedImages maps the services of the project that run one of the built
+// images, whatever tag the compose file gives them, to the pinned reference.
+func pinnedImages(project *composeProject, builtImages map[string]string) map[string]string {
+	pinned := make(map[string]string)
+
+	for serviceName, service := range project.Services {
+		if pinnedImage, exists := builtImages[imageRepository(service.Image)]; exists {
+			pinned[serviceName] = pinnedImage
+		}
+	}
+
+	return pinned
+}
+
+// imageRepository strips the tag or digest off an image reference, along
+// with the parts docker fills in for Docker Hub images.
+func imageRepository(image string) string {
+	image = strings.ToLower(image)
+
+	if digestIndex := strings.Index(image, "@"); digestIndex != -1 {
+		image = image[:digestIndex]
+	}
+
+	if tagIndex := strings.LastIndex(image, ":"); tagIndex > strings.LastIndex(image, "/") {
+		image = image[:tagIndex]
+	}
+
+	image = strings.TrimPrefix(image, "docker.io/")
+
+	image = strings.TrimPrefix(image, "index.docker.io/")
+
+	return strings.TrimPrefix(image, "library/")
+}
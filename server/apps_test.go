@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestImageRepository(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"web", "web"},
+		{"web:1.2.3", "web"},
+		{"Web:Latest", "web"},
+		{"rileyj/web:1.2.3", "rileyj/web"},
+		{"library/nginx:alpine", "nginx"},
+		{"docker.io/library/nginx", "nginx"},
+		{"index.docker.io/rileyj/web:abc", "rileyj/web"},
+		{"rileyj/web@sha256:0123abcd", "rileyj/web"},
+		{"rileyj/web:1.2.3@sha256:0123abcd", "rileyj/web"},
+		{"localhost:5000/web", "localhost:5000/web"},
+		{"localhost:5000/web:1.2.3", "localhost:5000/web"},
+		{"ghcr.io/rileyj/web:main", "ghcr.io/rileyj/web"},
+	}
+
+	for _, test := range tests {
+		if got := imageRepository(test.image); got != test.want {
+			t.Errorf("imageRepository(%q) = %q, want %q", test.image, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	buildLogRepositoryRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	buildLogCommitRegex     = regexp.MustCompile(`^[0-9a-fA-F]{4,64}$`)
+)
+
+type activeBuildLog struct {
+	// updated is closed and replaced every time the log is written to, so
+	// followers can wait for new output without polling.
+	updated      chan struct{}
+	nextSequence int
+	// writer is the worker sending the log, its logs are ended if it goes
+	// away before sending the final chunk
+	writer *worker
+}
+
+type buildLogInfo struct {
+	Commit    string    `json:"commit"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Active    bool      `json:"active"`
+}
+
+// buildLogStore keeps the output of every build on disk, one file per commit
+// under a directory per repository.
+type buildLogStore struct {
+	logsDir    string
+	activeLogs map[string]*activeBuildLog
+	lock       *sync.Mutex
+}
+
+func newBuildLogStore(logsDir string) (*buildLogStore, error) {
+	err := os.MkdirAll(logsDir, 0700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &buildLogStore{
+		logsDir:    logsDir,
+		activeLogs: make(map[string]*activeBuildLog),
+		lock:       &sync.Mutex{},
+	}, nil
+}
+
+func (bLS *buildLogStore) buildLogPath(repository, commit string) (string, error) {
+	if !buildLogRepositoryRegex.MatchString(repository) || strings.Trim(repository, ".") == "" {
+		return "", fmt.Errorf("invalid repository name %q", repository)
+	}
+
+	if !buildLogCommitRegex.MatchString(commit) {
+		return "", fmt.Errorf("invalid commit %q", commit)
+	}
+
+	return filepath.Join(bLS.logsDir, repository, commit+".log"), nil
+}
+
+// append writes a chunk of output writer sent to the build's log, a chunk with
+// sequence zero starts the log over so retried builds don't mix their output.
+func (bLS *buildLogStore) append(writer *worker, repository, commit string, sequence int, data []byte, final bool) error {
+	buildLogPath, err := bLS.buildLogPath(repository, commit)
+
+	if err != nil {
+		return err
+	}
+
+	bLS.lock.Lock()
+
+	defer bLS.lock.Unlock()
+
+	activeLog, exists := bLS.activeLogs[buildLogPath]
+
+	if !exists {
+		activeLog = &activeBuildLog{
+			updated: make(chan struct{}),
+		}
+
+		bLS.activeLogs[buildLogPath] = activeLog
+	}
+
+	activeLog.writer = writer
+
+	defer func() {
+		close(activeLog.updated)
+
+		activeLog.updated = make(chan struct{})
+
+		if final {
+			delete(bLS.activeLogs, buildLogPath)
+		}
+	}()
+
+	fileFlags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+
+	if sequence == 0 {
+		fileFlags |= os.O_TRUNC
+	} else if sequence != activeLog.nextSequence {
+		fmt.Printf("build log for %s@%s skipped from chunk %d to %d\n", repository, commit, activeLog.nextSequence, sequence)
+	}
+
+	activeLog.nextSequence = sequence + 1
+
+	err = os.MkdirAll(filepath.Dir(buildLogPath), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	buildLogFile, err := os.OpenFile(buildLogPath, fileFlags, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = buildLogFile.Write(data)
+
+	if closeErr := buildLogFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// abandon ends every log writer is still sending with a note saying why, so
+// they don't stay active and followers stop waiting for them.
+func (bLS *buildLogStore) abandon(writer *worker, reason string) {
+	bLS.lock.Lock()
+
+	defer bLS.lock.Unlock()
+
+	for buildLogPath, activeLog := range bLS.activeLogs {
+		if activeLog.writer != writer {
+			continue
+		}
+
+		buildLogFile, err := os.OpenFile(buildLogPath, os.O_WRONLY|os.O_APPEND, 0600)
+
+		if err == nil {
+			fmt.Fprintf(buildLogFile, "\n--- build log ended early: %s ---\n", reason)
+
+			buildLogFile.Close()
+		}
+
+		close(activeLog.updated)
+
+		delete(bLS.activeLogs, buildLogPath)
+	}
+}
+
+// list returns every stored build log for the repository, newest first.
+func (bLS *buildLogStore) list(repository string) ([]buildLogInfo, error) {
+	if !buildLogRepositoryRegex.MatchString(repository) || strings.Trim(repository, ".") == "" {
+		return nil, fmt.Errorf("invalid repository name %q", repository)
+	}
+
+	fileInfos, err := ioutil.ReadDir(filepath.Join(bLS.logsDir, repository))
+
+	if os.IsNotExist(err) {
+		return []buildLogInfo{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	bLS.lock.Lock()
+
+	defer bLS.lock.Unlock()
+
+	buildLogInfos := make([]buildLogInfo, 0, len(fileInfos))
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".log" {
+			continue
+		}
+
+		_, active := bLS.activeLogs[filepath.Join(bLS.logsDir, repository, fileInfo.Name())]
+
+		buildLogInfos = append(buildLogInfos, buildLogInfo{
+			Commit:    strings.TrimSuffix(fileInfo.Name(), ".log"),
+			Size:      fileInfo.Size(),
+			UpdatedAt: fileInfo.ModTime(),
+			Active:    active,
+		})
+	}
+
+	sort.Slice(buildLogInfos, func(i, j int) bool {
+		return buildLogInfos[i].UpdatedAt.After(buildLogInfos[j].UpdatedAt)
+	})
+
+	return buildLogInfos, nil
+}
+
+// copyTo writes the build's log to w, if follow is set and the build is still
+// running it keeps writing new output until the build finishes or ctx is done.
+func (bLS *buildLogStore) copyTo(ctx context.Context, w io.Writer, flush func(), repository, commit string, follow bool) error {
+	buildLogPath, err := bLS.buildLogPath(repository, commit)
+
+	if err != nil {
+		return err
+	}
+
+	buildLogFile, err := os.Open(buildLogPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer buildLogFile.Close()
+
+	for {
+		// Grab the update channel before copying, so output written while
+		// copying still wakes us up below.
+		bLS.lock.Lock()
+
+		activeLog, active := bLS.activeLogs[buildLogPath]
+
+		var updated chan struct{}
+
+		if active {
+			updated = activeLog.updated
+		}
+
+		bLS.lock.Unlock()
+
+		_, err = io.Copy(w, buildLogFile)
+
+		if err != nil {
+			return err
+		}
+
+		flush()
+
+		if !follow || !active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-updated:
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const cliUsage = `usage: server [flags] <command>
+
+commands:
+  secrets list [-environment env] <app>
+  secrets set [-environment env] <app> <NAME>      reads the value from stdin
+  secrets delete [-environment env] <app> <NAME>
+  plan [-ref ref] [-commit commit] [-json] <app>   shows what deploying would change
+  teardown [-remove-volumes] <app>                 takes the app down and removes its routes`
+
+// adminClient talks to a running server's admin API for the commands the
+// server binary runs instead of serving.
+type adminClient struct {
+	serverURL   string
+	adminSecret string
+	httpClient  *http.Client
+}
+
+func newAdminClient(serverURL, adminSecret string) *adminClient {
+	return &adminClient{
+		serverURL:   strings.TrimRight(serverURL, "/"),
+		adminSecret: adminSecret,
+		httpClient:  &http.Client{Timeout: time.Minute},
+	}
+}
+
+// do sends a request to the admin API and decodes the answer into response
+// unless it is nil, error answers are turned into errors.
+func (aC *adminClient) do(method, requestPath string, query url.Values, body, response interface{}) error {
+	var bodyReader io.Reader
+
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+
+		if err != nil {
+			return err
+		}
+
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+
+	requestURL := aC.serverURL + requestPath
+
+	if len(query) != 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequest(method, requestURL, bodyReader)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+aC.adminSecret)
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResponse, err := aC.httpClient.Do(request)
+
+	if err != nil {
+		return err
+	}
+
+	defer httpResponse.Body.Close()
+
+	responseBytes, err := ioutil.ReadAll(httpResponse.Body)
+
+	if err != nil {
+		return err
+	}
+
+	if httpResponse.StatusCode >= 300 {
+		var errResponse struct {
+			Err string `json:"err"`
+		}
+
+		if json.Unmarshal(responseBytes, &errResponse) == nil && errResponse.Err != "" {
+			return errors.New(errResponse.Err)
+		}
+
+		return fmt.Errorf("server answered %s", httpResponse.Status)
+	}
+
+	if response == nil || len(responseBytes) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(responseBytes, response)
+}
+
+// defaultServerURL is the URL of the server on this machine's port, named
+// by the host its TLS certificate is for since the certificate isn't valid
+// for localhost. In development the server is plain HTTP on localhost.
+func defaultServerURL(port int, development bool) (string, error) {
+	if development {
+		return fmt.Sprintf("http://localhost:%d", port), nil
+	}
+
+	certBytes, err := ioutil.ReadFile(tlsCertPath)
+
+	if err != nil {
+		return "", fmt.Errorf("error reading the server's certificate, pass -server: %w", err)
+	}
+
+	certBlock, _ := pem.Decode(certBytes)
+
+	if certBlock == nil {
+		return "", fmt.Errorf("%s has no certificate, pass -server", tlsCertPath)
+	}
+
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+
+	if err != nil {
+		return "", fmt.Errorf("error parsing the server's certificate, pass -server: %w", err)
+	}
+
+	for _, certHost := range append(cert.DNSNames, cert.Subject.CommonName) {
+		if certHost != "" && !strings.Contains(certHost, "*") {
+			return fmt.Sprintf("https://%s:%d", certHost, port), nil
+		}
+	}
+
+	return "", fmt.Errorf("%s doesn't name a single host, pass -server", tlsCertPath)
+}
+
+// runCLI runs a command given on the command line against the server at
+// serverURL.
+func runCLI(args []string, serverURL, adminSecret string) error {
+	if adminSecret == "" {
+		return errors.New(`environmental variable "ADMIN_SECRET" is not set`)
+	}
+
+	aC := newAdminClient(serverURL, adminSecret)
+
+	switch args[0] {
+	case "secrets":
+		return aC.runSecretsCommand(args[1:])
+	case "plan":
+		return aC.runPlanCommand(args[1:])
+	case "teardown":
+		return aC.runTeardownCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], cliUsage)
+	}
+}
+
+func (aC *adminClient) runSecretsCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(cliUsage)
+	}
+
+	subcommand := args[0]
+
+	flags := flag.NewFlagSet("secrets "+subcommand, flag.ContinueOnError)
+
+	environment := flags.String("environment", "", "environment of the secrets, the app's own by default")
+
+	err := flags.Parse(args[1:])
+
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+
+	if *environment != "" {
+		query.Set("environment", *environment)
+	}
+
+	wantArgs := 2
+
+	if subcommand == "list" {
+		wantArgs = 1
+	}
+
+	if flags.NArg() != wantArgs {
+		return errors.New(cliUsage)
+	}
+
+	secretsPath := "/projects/" + url.PathEscape(flags.Arg(0)) + "/secrets"
+
+	switch subcommand {
+	case "list":
+		var secretList struct {
+			Environment string       `json:"environment"`
+			Secrets     []secretInfo `json:"secrets"`
+		}
+
+		err = aC.do(http.MethodGet, secretsPath, query, nil, &secretList)
+
+		if err != nil {
+			return err
+		}
+
+		tableWriter := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+		fmt.Fprintf(tableWriter, "NAME\tUPDATED (%s)\n", secretList.Environment)
+
+		for _, secret := range secretList.Secrets {
+			fmt.Fprintf(tableWriter, "%s\t%s\n", secret.Name, secret.UpdatedAt.Format(time.RFC3339))
+		}
+
+		return tableWriter.Flush()
+	case "set":
+		// The value is read from stdin so it doesn't end up in shell history
+		// or the process list
+		valueBytes, err := ioutil.ReadAll(os.Stdin)
+
+		if err != nil {
+			return err
+		}
+
+		value := strings.TrimSuffix(strings.TrimSuffix(string(valueBytes), "\n"), "\r")
+
+		return aC.do(http.MethodPut, secretsPath+"/"+url.PathEscape(flags.Arg(1)), query, map[string]string{"value": value}, nil)
+	case "delete":
+		return aC.do(http.MethodDelete, secretsPath+"/"+url.PathEscape(flags.Arg(1)), query, nil, nil)
+	default:
+		return fmt.Errorf("unknown secrets command %q\n%s", subcommand, cliUsage)
+	}
+}
+
+func (aC *adminClient) runPlanCommand(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+
+	ref := flags.String("ref", "", "branch or ref to plan, the default branch by default")
+
+	commit := flags.String("commit", "", "commit to plan, the tip of the ref by default")
+
+	printJSON := flags.Bool("json", false, "print the plan as JSON")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New(cliUsage)
+	}
+
+	query := url.Values{}
+
+	if *ref != "" {
+		query.Set("ref", *ref)
+	}
+
+	if *commit != "" {
+		query.Set("commit", *commit)
+	}
+
+	var plan deployPlan
+
+	err = aC.do(http.MethodGet, "/projects/"+url.PathEscape(flags.Arg(0))+"/plan", query, nil, &plan)
+
+	if err != nil {
+		return err
+	}
+
+	if *printJSON {
+		planBytes, err := json.MarshalIndent(plan, "", "    ")
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(planBytes))
+
+		return nil
+	}
+
+	fmt.Printf("deploying %s (%s) at %s of %s would change:\n\n", plan.App, plan.Environment, plan.Commit, plan.Ref)
+
+	tableWriter := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tableWriter, "SERVICE\tACTION\tIMAGE\tCHANGED SETTINGS")
+
+	for _, service := range plan.Services {
+		imageChange := ""
+
+		if service.ImageChanged {
+			imageChange = service.Image
+		}
+
+		changes := strings.Join(service.ChangedSettings, ", ")
+
+		if service.Note != "" {
+			changes = strings.TrimPrefix(changes+"; "+service.Note, "; ")
+		}
+
+		fmt.Fprintf(tableWriter, "%s\t%s\t%s\t%s\n", service.Service, service.Action, imageChange, changes)
+	}
+
+	err = tableWriter.Flush()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+
+	if len(plan.Routes) == 0 {
+		fmt.Println("routes are unchanged")
+	}
+
+	routeSigns := map[string]string{routeAdd: "+", routeChange: "~", routeRemove: "-"}
+
+	for _, route := range plan.Routes {
+		fmt.Printf("%s %s%s -> %s\n", routeSigns[route.Action], route.Route.Domain, route.Route.Route, route.Route.ForwardHost)
+
+		if route.Previous != nil {
+			fmt.Printf("  was -> %s\n", route.Previous.ForwardHost)
+		}
+	}
+
+	for _, note := range plan.Notes {
+		fmt.Println("note:", note)
+	}
+
+	return nil
+}
+
+func (aC *adminClient) runTeardownCommand(args []string) error {
+	flags := flag.NewFlagSet("teardown", flag.ContinueOnError)
+
+	removeVolumes := flags.Bool("remove-volumes", false, "remove the app's named volumes as well, deleting its data")
+
+	err := flags.Parse(args)
+
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New(cliUsage)
+	}
+
+	// A teardown waits for a running deploy of the app to finish first
+	aC.httpClient.Timeout = 20 * time.Minute
+
+	var appTeardown teardown
+
+	err = aC.do(http.MethodPost, "/projects/"+url.PathEscape(flags.Arg(0))+"/teardown", nil, map[string]bool{"removeVolumes": *removeVolumes}, &appTeardown)
+
+	if err != nil {
+		return err
+	}
+
+	if appTeardown.NothingRemoved {
+		fmt.Printf("tore down %s (%s), but nothing of project %s was found to remove\n", appTeardown.App, appTeardown.Environment, appTeardown.Project)
+
+		return nil
+	}
+
+	fmt.Printf("tore down %s (%s), removed %d routes\n", appTeardown.App, appTeardown.Environment, appTeardown.Routes)
+
+	for _, removed := range []struct {
+		kind  string
+		names []string
+	}{
+		{"container", appTeardown.Containers},
+		{"network", appTeardown.Networks},
+		{"volume", appTeardown.Volumes},
+	} {
+		for _, name := range removed.names {
+			fmt.Printf("removed %s %s\n", removed.kind, name)
+		}
+	}
+
+	if !appTeardown.RemoveVolumes {
+		fmt.Println("volumes were kept")
+	}
+
+	return nil
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var composeNameRegex = regexp.MustCompile(`[^a-z0-9]`)
+
+// composeStringList is a compose field that is either a single string or a
+// list of them, like command or env_file.
+type composeStringList []string
+
+func (cSL *composeStringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+
+	if unmarshal(&single) == nil {
+		*cSL = composeStringList{single}
+
+		return nil
+	}
+
+	var list []interface{}
+
+	err := unmarshal(&list)
+
+	if err != nil {
+		return err
+	}
+
+	*cSL = make(composeStringList, 0, len(list))
+
+	for _, item := range list {
+		*cSL = append(*cSL, fmt.Sprint(item))
+	}
+
+	return nil
+}
+
+// composeCommand is a command given either as a list of arguments or as a
+// string, which is split like a shell would.
+type composeCommand []string
+
+func (cC *composeCommand) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+
+	if unmarshal(&command) == nil {
+		args, err := splitCommand(command)
+
+		if err != nil {
+			return err
+		}
+
+		*cC = args
+
+		return nil
+	}
+
+	var args composeStringList
+
+	err := unmarshal(&args)
+
+	*cC = composeCommand(args)
+
+	return err
+}
+
+// composeMapping is a compose field that is either a map or a list of
+// "KEY=value" strings, like environment or labels. A list entry without a
+// value maps to nil, for environment that means it comes from the host.
+type composeMapping map[string]*string
+
+func (cM *composeMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cM = make(composeMapping)
+
+	var list []string
+
+	if unmarshal(&list) == nil {
+		for _, item := range list {
+			itemParts := strings.SplitN(item, "=", 2)
+
+			if len(itemParts) == 1 {
+				(*cM)[itemParts[0]] = nil
+			} else {
+				(*cM)[itemParts[0]] = &itemParts[1]
+			}
+		}
+
+		return nil
+	}
+
+	var mapping map[string]interface{}
+
+	err := unmarshal(&mapping)
+
+	if err != nil {
+		return err
+	}
+
+	for key, value := range mapping {
+		if value == nil {
+			(*cM)[key] = nil
+
+			continue
+		}
+
+		valueString := fmt.Sprint(value)
+
+		(*cM)[key] = &valueString
+	}
+
+	return nil
+}
+
+// composeServiceNetworks is a service's networks, either a list of names or a
+// map of names to their aliases.
+type composeServiceNetworks map[string][]string
+
+func (cSN *composeServiceNetworks) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*cSN = make(composeServiceNetworks)
+
+	var list []string
+
+	if unmarshal(&list) == nil {
+		for _, networkName := range list {
+			(*cSN)[networkName] = nil
+		}
+
+		return nil
+	}
+
+	var mapping map[string]*struct {
+		Aliases []string `yaml:"aliases"`
+	}
+
+	err := unmarshal(&mapping)
+
+	if err != nil {
+		return err
+	}
+
+	for networkName, networkSettings := range mapping {
+		(*cSN)[networkName] = nil
+
+		if networkSettings != nil {
+			(*cSN)[networkName] = networkSettings.Aliases
+		}
+	}
+
+	return nil
+}
+
+// composeDependencies is depends_on, either a list of services or a map of
+// them to conditions, which are ignored.
+type composeDependencies []string
+
+func (cD *composeDependencies) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+
+	if unmarshal(&list) == nil {
+		*cD = list
+
+		return nil
+	}
+
+	var mapping map[string]interface{}
+
+	err := unmarshal(&mapping)
+
+	if err != nil {
+		return err
+	}
+
+	*cD = make(composeDependencies, 0, len(mapping))
+
+	for serviceName := range mapping {
+		*cD = append(*cD, serviceName)
+	}
+
+	sort.Strings(*cD)
+
+	return nil
+}
+
+// composeHealthTest is a healthcheck's test, a string is run with the
+// container's shell.
+type composeHealthTest []string
+
+func (cHT *composeHealthTest) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+
+	if unmarshal(&command) == nil {
+		*cHT = composeHealthTest{"CMD-SHELL", command}
+
+		return nil
+	}
+
+	var test []string
+
+	err := unmarshal(&test)
+
+	*cHT = test
+
+	return err
+}
+
+type composeHealthcheck struct {
+	Test     composeHealthTest `yaml:"test"`
+	Interval string            `yaml:"interval"`
+	Timeout  string            `yaml:"timeout"`
+	Retries  int               `yaml:"retries"`
+	Disable  bool              `yaml:"disable"`
+}
+
+type composeService struct {
+	Image         string                 `yaml:"image"`
+	ContainerName string                 `yaml:"container_name"`
+	Command       composeCommand         `yaml:"command"`
+	Entrypoint    composeCommand         `yaml:"entrypoint"`
+	Environment   composeMapping         `yaml:"environment"`
+	EnvFile       composeStringList      `yaml:"env_file"`
+	Labels        composeMapping         `yaml:"labels"`
+	Ports         composeStringList      `yaml:"ports"`
+	Expose        composeStringList      `yaml:"expose"`
+	Volumes       []string               `yaml:"volumes"`
+	Networks      composeServiceNetworks `yaml:"networks"`
+	NetworkMode   string                 `yaml:"network_mode"`
+	DependsOn     composeDependencies    `yaml:"depends_on"`
+	Restart       string                 `yaml:"restart"`
+	User          string                 `yaml:"user"`
+	WorkingDir    string                 `yaml:"working_dir"`
+	Hostname      string                 `yaml:"hostname"`
+	ExtraHosts    composeStringList      `yaml:"extra_hosts"`
+	Healthcheck   *composeHealthcheck    `yaml:"healthcheck"`
+}
+
+type composeNetwork struct {
+	Driver     string            `yaml:"driver"`
+	DriverOpts map[string]string `yaml:"driver_opts"`
+	External   bool              `yaml:"external"`
+	Internal   bool              `yaml:"internal"`
+	Name       string            `yaml:"name"`
+	Labels     composeMapping    `yaml:"labels"`
+}
+
+type composeVolume struct {
+	Driver     string            `yaml:"driver"`
+	DriverOpts map[string]string `yaml:"driver_opts"`
+	External   bool              `yaml:"external"`
+	Name       string            `yaml:"name"`
+	Labels     composeMapping    `yaml:"labels"`
+}
+
+// composeProject is the part of a compose file the server knows how to run,
+// anything it doesn't know about, like build sections, is ignored.
+type composeProject struct {
+	Name        string                     `yaml:"-"`
+	Dir         string                     `yaml:"-"`
+	Environment map[string]string          `yaml:"-"`
+	Services    map[string]*composeService `yaml:"services"`
+	Networks    map[string]*composeNetwork `yaml:"networks"`
+	Volumes     map[string]*composeVolume  `yaml:"volumes"`
+	// readFile reads the project's files, like env files, by their path in
+	// the app's checkout.
+	readFile func(filePath string) ([]byte, error)
+}
+
+// loadComposeProject reads the compose file of the app in appDir, variables
+// are filled in from environment, falling back to the app's .env file.
+// Service environment variables without a value are taken from environment
+// as well, before the server's own environment.
+func loadComposeProject(projectName, appDir, composeFile string, environment map[string]string) (*composeProject, error) {
+	return parseComposeProject(projectName, appDir, composeFile, checkoutFileReader(appDir), environment)
+}
+
+// checkoutFileReader reads the app's files as they are in its checkout,
+// paths use slashes and are relative to it.
+func checkoutFileReader(appDir string) func(string) ([]byte, error) {
+	return func(filePath string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(appDir, filepath.FromSlash(filePath)))
+	}
+}
+
+// parseComposeProject is loadComposeProject with the compose file, .env and
+// env files read through readFile, like from another commit than the
+// checked out one.
+func parseComposeProject(projectName, appDir, composeFile string, readFile func(string) ([]byte, error), environment map[string]string) (*composeProject, error) {
+	composeBytes, err := readFile(composeFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dotEnv, err := readEnvFile(readFile, ".env")
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for key, value := range environment {
+		dotEnv[key] = value
+	}
+
+	composeBytes, err = interpolateCompose(composeBytes, dotEnv)
+
+	if err != nil {
+		return nil, fmt.Errorf("error interpolating %s: %w", composeFile, err)
+	}
+
+	project := &composeProject{}
+
+	err = yaml.Unmarshal(composeBytes, project)
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", composeFile, err)
+	}
+
+	project.Name = composeProjectName(projectName)
+	project.Dir = appDir
+	project.Environment = environment
+	project.readFile = readFile
+
+	if project.Name == "" {
+		return nil, fmt.Errorf("project name %q has no usable characters", projectName)
+	}
+
+	if len(project.Services) == 0 {
+		return nil, fmt.Errorf("%s has no services", composeFile)
+	}
+
+	for serviceName, service := range project.Services {
+		if service == nil || service.Image == "" {
+			return nil, fmt.Errorf("service %s has no image", serviceName)
+		}
+
+		for _, dependency := range service.DependsOn {
+			if _, exists := project.Services[dependency]; !exists {
+				return nil, fmt.Errorf("service %s depends on undefined service %s", serviceName, dependency)
+			}
+		}
+
+		for networkName := range service.Networks {
+			if _, exists := project.Networks[networkName]; !exists && networkName != "default" {
+				return nil, fmt.Errorf("service %s uses undefined network %s", serviceName, networkName)
+			}
+		}
+	}
+
+	return project, nil
+}
+
+// composeProjectName is the name a project's containers, networks and
+// volumes are labelled and named with, like docker-compose it is the app's
+// name in lower case with everything but letters and digits left out.
+func composeProjectName(projectName string) string {
+	return composeNameRegex.ReplaceAllString(strings.ToLower(projectName), "")
+}
+
+// serviceOrder sorts the services so every service comes after the services
+// it depends on.
+func (cP *composeProject) serviceOrder() ([]string, error) {
+	serviceNames := make([]string, 0, len(cP.Services))
+
+	for serviceName := range cP.Services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	sort.Strings(serviceNames)
+
+	ordered := make([]string, 0, len(serviceNames))
+
+	visitState := make(map[string]int)
+
+	var visit func(serviceName string) error
+
+	visit = func(serviceName string) error {
+		switch visitState[serviceName] {
+		case 1:
+			return fmt.Errorf("services depend on each other in a cycle through %s", serviceName)
+		case 2:
+			return nil
+		}
+
+		visitState[serviceName] = 1
+
+		for _, dependency := range cP.Services[serviceName].DependsOn {
+			err := visit(dependency)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		visitState[serviceName] = 2
+
+		ordered = append(ordered, serviceName)
+
+		return nil
+	}
+
+	for _, serviceName := range serviceNames {
+		err := visit(serviceName)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+func (cP *composeProject) networkName(networkName string) string {
+	if network := cP.Networks[networkName]; network != nil {
+		if network.Name != "" {
+			return network.Name
+		}
+
+		if network.External {
+			return networkName
+		}
+	}
+
+	return cP.Name + "_" + networkName
+}
+
+func (cP *composeProject) volumeName(volumeName string) string {
+	if volume := cP.Volumes[volumeName]; volume != nil {
+		if volume.Name != "" {
+			return volume.Name
+		}
+
+		if volume.External {
+			return volumeName
+		}
+	}
+
+	return cP.Name + "_" + volumeName
+}
+
+func (cP *composeProject) containerName(serviceName string) string {
+	if containerName := cP.Services[serviceName].ContainerName; containerName != "" {
+		return containerName
+	}
+
+	return fmt.Sprintf("%s_%s_1", cP.Name, serviceName)
+}
+
+// readEnvFile parses a file of KEY=value lines read through readFile, blank
+// lines and lines starting with # are skipped.
+func readEnvFile(readFile func(string) ([]byte, error), envFilePath string) (map[string]string, error) {
+	envVars := make(map[string]string)
+
+	envFileBytes, err := readFile(envFilePath)
+
+	if err != nil {
+		return envVars, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(envFileBytes))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lineParts := strings.SplitN(line, "=", 2)
+
+		if len(lineParts) == 1 {
+			envVars[lineParts[0]] = os.Getenv(lineParts[0])
+
+			continue
+		}
+
+		envVars[strings.TrimSpace(lineParts[0])] = lineParts[1]
+	}
+
+	return envVars, scanner.Err()
+}
+
+var composeVariableRegex = regexp.MustCompile(`\$(\$|[A-Za-z_][A-Za-z0-9_]*|\{[^}]*\})`)
+
+// interpolateCompose fills in $VAR, ${VAR}, ${VAR:-default}, ${VAR-default},
+// ${VAR:?error} and ${VAR?error} from environment and then the server's own
+// environment, "$$" is a literal "$". The file is parsed first and only its
+// scalar values are filled in, so a value can't add YAML of its own and keys
+// and comments are left alone.
+func interpolateCompose(composeBytes []byte, environment map[string]string) ([]byte, error) {
+	var compose interface{}
+
+	err := yaml.Unmarshal(composeBytes, &compose)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := func(key string) (string, bool) {
+		if value, exists := environment[key]; exists {
+			return value, true
+		}
+
+		return os.LookupEnv(key)
+	}
+
+	compose, err = interpolateComposeValue(compose, lookup)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(compose)
+}
+
+// interpolateComposeValue interpolates every string in a parsed compose
+// value, a string holding nothing but a boolean or an integer once filled in
+// becomes one, so "${EXTERNAL}" can still set a boolean field.
+func interpolateComposeValue(value interface{}, lookup func(string) (string, bool)) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		for key, mapValue := range typedValue {
+			interpolatedValue, err := interpolateComposeValue(mapValue, lookup)
+
+			if err != nil {
+				return nil, err
+			}
+
+			typedValue[key] = interpolatedValue
+		}
+	case []interface{}:
+		for i, listValue := range typedValue {
+			interpolatedValue, err := interpolateComposeValue(listValue, lookup)
+
+			if err != nil {
+				return nil, err
+			}
+
+			typedValue[i] = interpolatedValue
+		}
+	case string:
+		interpolated, err := interpolateComposeString(typedValue, lookup)
+
+		if err != nil || interpolated == typedValue {
+			return interpolated, err
+		}
+
+		if boolValue, err := strconv.ParseBool(interpolated); err == nil && interpolated == strconv.FormatBool(boolValue) {
+			return boolValue, nil
+		}
+
+		if intValue, err := strconv.Atoi(interpolated); err == nil && interpolated == strconv.Itoa(intValue) {
+			return intValue, nil
+		}
+
+		return interpolated, nil
+	}
+
+	return value, nil
+}
+
+func interpolateComposeString(value string, lookup func(string) (string, bool)) (string, error) {
+	var interpolateErr error
+
+	interpolated := composeVariableRegex.ReplaceAllStringFunc(value, func(match string) string {
+		expression := match[1:]
+
+		if expression == "$" {
+			return "$"
+		}
+
+		if !strings.HasPrefix(expression, "{") {
+			variableValue, _ := lookup(expression)
+
+			return variableValue
+		}
+
+		expression = strings.TrimSuffix(strings.TrimPrefix(expression, "{"), "}")
+
+		operatorIndex := strings.IndexAny(expression, ":-?")
+
+		if operatorIndex == -1 {
+			variableValue, _ := lookup(expression)
+
+			return variableValue
+		}
+
+		key, operator := expression[:operatorIndex], expression[operatorIndex:]
+
+		variableValue, exists := lookup(key)
+
+		emptyCounts := strings.HasPrefix(operator, ":")
+
+		operator = strings.TrimPrefix(operator, ":")
+
+		if operator == "" {
+			interpolateErr = fmt.Errorf("bad variable %q", match)
+
+			return match
+		}
+
+		missing := !exists || (emptyCounts && variableValue == "")
+
+		switch operator[0] {
+		case '-':
+			if missing {
+				return operator[1:]
+			}
+		case '?':
+			if missing {
+				interpolateErr = fmt.Errorf("variable %s is required: %s", key, operator[1:])
+			}
+		default:
+			interpolateErr = fmt.Errorf("bad variable %q", match)
+		}
+
+		return variableValue
+	})
+
+	return interpolated, interpolateErr
+}
+
+// splitCommand splits a command like a POSIX shell would, without expanding
+// anything.
+func splitCommand(command string) ([]string, error) {
+	args := make([]string, 0)
+
+	var currentArg strings.Builder
+
+	inArg, quote, escaped := false, rune(0), false
+
+	for _, character := range command {
+		switch {
+		case escaped:
+			currentArg.WriteRune(character)
+
+			escaped = false
+		case character == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if character == quote {
+				quote = 0
+			} else {
+				currentArg.WriteRune(character)
+			}
+		case character == '\'' || character == '"':
+			quote, inArg = character, true
+		case character == ' ' || character == '\t' || character == '\n':
+			if inArg {
+				args = append(args, currentArg.String())
+
+				currentArg.Reset()
+
+				inArg = false
+			}
+		default:
+			currentArg.WriteRune(character)
+
+			inArg = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in command")
+	}
+
+	if inArg {
+		args = append(args, currentArg.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestInterpolateCompose(t *testing.T) {
+	environment := map[string]string{
+		"TAG":      "1.2.3",
+		"EMPTY":    "",
+		"EXTERNAL": "true",
+		"RETRIES":  "3",
+		"PIN":      "0123",
+		"INJECTED": "x\nports: [\"22:22\"]",
+	}
+
+	tests := []struct {
+		name    string
+		compose string
+		want    string
+		wantErr bool
+	}{
+		{"bare variable", `image: web:$TAG`, `image: web:1.2.3`, false},
+		{"braced variable", `image: web:${TAG}-slim`, `image: web:1.2.3-slim`, false},
+		{"unset variable", `image: web:${MISSING}`, `image: "web:"`, false},
+		{"default when unset", `image: web:${MISSING:-latest}`, `image: web:latest`, false},
+		{"default when empty", `image: web:${EMPTY:-latest}`, `image: web:latest`, false},
+		{"default only when unset", `image: web:${EMPTY-latest}`, `image: "web:"`, false},
+		{"set variable ignores default", `image: web:${TAG:-latest}`, `image: web:1.2.3`, false},
+		{"escaped dollar", `command: echo $$HOME`, `command: echo $HOME`, false},
+		{"required and set", `image: web:${TAG:?needs a tag}`, `image: web:1.2.3`, false},
+		{"required and unset", `image: web:${MISSING?needs a tag}`, ``, true},
+		{"required and empty", `image: web:${EMPTY:?needs a tag}`, ``, true},
+		{"missing operator", `image: web:${TAG:}`, ``, true},
+		{"unknown operator", `image: web:${TAG:+x}`, ``, true},
+		{"lists", `ports: ["${RETRIES}000:80", "$TAG"]`, `ports: [3000:80, 1.2.3]`, false},
+		{"keys are left alone", `labels: {$TAG: web}`, `labels: {$TAG: web}`, false},
+		{"comments are left alone", "# ${MISSING:?unused}\nimage: web", `image: web`, false},
+		{"values can't add yaml", `image: $INJECTED`, `image: "x\nports: [\"22:22\"]"`, false},
+		{"booleans", `external: ${EXTERNAL}`, `external: true`, false},
+		{"integers", `retries: ${RETRIES}`, `retries: 3`, false},
+		{"integers keep their zeros", `pin: ${PIN}`, `pin: "0123"`, false},
+		{"untouched strings stay strings", `version: "3"`, `version: "3"`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			interpolatedBytes, err := interpolateCompose([]byte(test.compose), environment)
+
+			if (err != nil) != test.wantErr {
+				t.Fatalf("interpolateCompose(%q) error = %v, want error %v", test.compose, err, test.wantErr)
+			}
+
+			if test.wantErr {
+				return
+			}
+
+			var got, want interface{}
+
+			err = yaml.Unmarshal(interpolatedBytes, &got)
+
+			if err != nil {
+				t.Fatalf("interpolated compose file doesn't parse: %s", err)
+			}
+
+			err = yaml.Unmarshal([]byte(test.want), &want)
+
+			if err != nil {
+				t.Fatalf("bad expected yaml: %s", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("interpolateCompose(%q) = %q, want %q", test.compose, interpolatedBytes, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// maxDeliveries is how many webhook deliveries are remembered, older ones are
+// forgotten along with their archived payloads.
+const maxDeliveries = 1000
+
+var deliveryIDRegex = regexp.MustCompile(`^[A-Za-z0-9_.{}-]{1,128}$`)
+
+var errDeliveryNotFound = errors.New("delivery not found")
+
+// archivedHeaders are the request headers kept with a delivery, enough to
+// parse it again. Secrets like X-Gitlab-Token are deliberately left out.
+var archivedHeaders = []string{
+	"Content-Type",
+	"User-Agent",
+	"X-GitHub-Delivery",
+	"X-GitHub-Event",
+	"X-Gitea-Delivery",
+	"X-Gitea-Event",
+	"X-Gitlab-Event",
+	"X-Gitlab-Event-UUID",
+	"X-Event-Key",
+	"X-Request-UUID",
+}
+
+type webhookDelivery struct {
+	ID            string              `json:"id"`
+	Provider      string              `json:"provider"`
+	ReceivedAt    time.Time           `json:"receivedAt"`
+	PayloadHash   string              `json:"payloadHash"`
+	Header        map[string][]string `json:"header"`
+	Status        int                 `json:"status"`
+	Result        interface{}         `json:"result"`
+	RedeliveredAt []time.Time         `json:"redeliveredAt,omitempty"`
+}
+
+// deliveryStore remembers recent webhook deliveries so retried or replayed
+// ones are only acted on once, and archives their payloads for inspection and
+// redelivery. Deliveries are matched on both the provider's delivery ID and a
+// hash of the payload, since the ID header isn't covered by the signature.
+type deliveryStore struct {
+	indexPath   string
+	payloadsDir string
+	deliveries  []*webhookDelivery
+	lock        *sync.Mutex
+}
+
+func newDeliveryStore(deliveriesDir string) (*deliveryStore, error) {
+	payloadsDir := filepath.Join(deliveriesDir, "payloads")
+
+	err := os.MkdirAll(payloadsDir, 0700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dS := &deliveryStore{
+		indexPath:   filepath.Join(deliveriesDir, "deliveries.json"),
+		payloadsDir: payloadsDir,
+		deliveries:  make([]*webhookDelivery, 0),
+		lock:        &sync.Mutex{},
+	}
+
+	err = readJSONFile(dS.indexPath, &dS.deliveries)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dS, nil
+}
+
+func (dS *deliveryStore) payloadPath(payloadHash string) string {
+	return filepath.Join(dS.payloadsDir, payloadHash+".json")
+}
+
+// record archives a delivery, if it was already seen the earlier delivery is
+// returned instead and duplicate is true. Deliveries without a usable ID are
+// given a random one.
+func (dS *deliveryStore) record(provider, deliveryID string, header http.Header, payload []byte) (delivery *webhookDelivery, duplicate bool, err error) {
+	payloadHashBytes := sha256.Sum256(payload)
+
+	payloadHash := hex.EncodeToString(payloadHashBytes[:])
+
+	if !deliveryIDRegex.MatchString(deliveryID) {
+		deliveryID = newRandomID()
+	}
+
+	dS.lock.Lock()
+
+	defer dS.lock.Unlock()
+
+	for _, delivery := range dS.deliveries {
+		if delivery.PayloadHash == payloadHash || (delivery.Provider == provider && delivery.ID == deliveryID) {
+			deliveryCopy := *delivery
+
+			return &deliveryCopy, true, nil
+		}
+	}
+
+	err = ioutil.WriteFile(dS.payloadPath(payloadHash), payload, 0600)
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	delivery = &webhookDelivery{
+		ID:          deliveryID,
+		Provider:    provider,
+		ReceivedAt:  time.Now(),
+		PayloadHash: payloadHash,
+		Header:      make(map[string][]string),
+	}
+
+	for _, headerKey := range archivedHeaders {
+		headerKey = http.CanonicalHeaderKey(headerKey)
+
+		if headerValues, exists := header[headerKey]; exists {
+			delivery.Header[headerKey] = headerValues
+		}
+	}
+
+	dS.deliveries = append(dS.deliveries, delivery)
+
+	for len(dS.deliveries) > maxDeliveries {
+		os.Remove(dS.payloadPath(dS.deliveries[0].PayloadHash))
+
+		dS.deliveries = dS.deliveries[1:]
+	}
+
+	deliveryCopy := *delivery
+
+	return &deliveryCopy, false, writeJSONFile(dS.indexPath, dS.deliveries)
+}
+
+// forget drops a delivery that couldn't be handled, so the provider's retry
+// of it isn't mistaken for a duplicate.
+func (dS *deliveryStore) forget(payloadHash string) error {
+	dS.lock.Lock()
+
+	defer dS.lock.Unlock()
+
+	for index, delivery := range dS.deliveries {
+		if delivery.PayloadHash == payloadHash {
+			os.Remove(dS.payloadPath(payloadHash))
+
+			dS.deliveries = append(dS.deliveries[:index], dS.deliveries[index+1:]...)
+
+			return writeJSONFile(dS.indexPath, dS.deliveries)
+		}
+	}
+
+	return errDeliveryNotFound
+}
+
+// finish records how the server answered the delivery.
+func (dS *deliveryStore) finish(payloadHash string, status int, result interface{}) error {
+	dS.lock.Lock()
+
+	defer dS.lock.Unlock()
+
+	for _, delivery := range dS.deliveries {
+		if delivery.PayloadHash == payloadHash {
+			delivery.Status = status
+			delivery.Result = result
+
+			return writeJSONFile(dS.indexPath, dS.deliveries)
+		}
+	}
+
+	return errDeliveryNotFound
+}
+
+// redelivered notes that the delivery was deliberately handled again.
+func (dS *deliveryStore) redelivered(payloadHash string) error {
+	dS.lock.Lock()
+
+	defer dS.lock.Unlock()
+
+	for _, delivery := range dS.deliveries {
+		if delivery.PayloadHash == payloadHash {
+			delivery.RedeliveredAt = append(delivery.RedeliveredAt, time.Now())
+
+			return writeJSONFile(dS.indexPath, dS.deliveries)
+		}
+	}
+
+	return errDeliveryNotFound
+}
+
+func (dS *deliveryStore) list() []*webhookDelivery {
+	dS.lock.Lock()
+
+	defer dS.lock.Unlock()
+
+	deliveries := make([]*webhookDelivery, 0, len(dS.deliveries))
+
+	for _, delivery := range dS.deliveries {
+		deliveryCopy := *delivery
+
+		deliveries = append(deliveries, &deliveryCopy)
+	}
+
+	return deliveries
+}
+
+// get returns the delivery with the given ID along with its payload.
+func (dS *deliveryStore) get(deliveryID string) (*webhookDelivery, []byte, error) {
+	dS.lock.Lock()
+
+	defer dS.lock.Unlock()
+
+	for index := len(dS.deliveries) - 1; index >= 0; index-- {
+		delivery := dS.deliveries[index]
+
+		if delivery.ID != deliveryID {
+			continue
+		}
+
+		payload, err := ioutil.ReadFile(dS.payloadPath(delivery.PayloadHash))
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		deliveryCopy := *delivery
+
+		return &deliveryCopy, payload, nil
+	}
+
+	return nil, nil, errDeliveryNotFound
+}
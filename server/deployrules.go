@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	branchRefPrefix = "refs/heads/"
+	tagRefPrefix    = "refs/tags/"
+)
+
+// shouldDeploy decides whether a push to ref deploys under rules, the reason
+// explains the decision either way.
+func shouldDeploy(rules *uyghurs.DeployRules, ref, defaultBranch string) (bool, string) {
+	if rules == nil {
+		if defaultBranch == "" {
+			defaultBranch = "master"
+		}
+
+		rules = &uyghurs.DeployRules{
+			Branches: []string{defaultBranch},
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(ref, branchRefPrefix):
+		branch := strings.TrimPrefix(ref, branchRefPrefix)
+
+		for _, branchPattern := range rules.Branches {
+			if globMatch(branchPattern, branch) {
+				return true, fmt.Sprintf("branch %q matches %q", branch, branchPattern)
+			}
+		}
+
+		return false, fmt.Sprintf("branch %q matches no deploy rule", branch)
+	case strings.HasPrefix(ref, tagRefPrefix):
+		tag := strings.TrimPrefix(ref, tagRefPrefix)
+
+		for _, tagPattern := range rules.Tags {
+			if globMatch(tagPattern, tag) {
+				return true, fmt.Sprintf("tag %q matches %q", tag, tagPattern)
+			}
+		}
+
+		if len(rules.SemverTags) != 0 {
+			tagVersion, err := parseSemver(tag)
+
+			if err != nil {
+				return false, fmt.Sprintf("tag %q is not a semantic version", tag)
+			}
+
+			for _, semverConstraint := range rules.SemverTags {
+				matches, err := tagVersion.satisfies(semverConstraint)
+
+				if err != nil {
+					return false, fmt.Sprintf("bad semver constraint %q: %s", semverConstraint, err)
+				}
+
+				if matches {
+					return true, fmt.Sprintf("tag %q satisfies %q", tag, semverConstraint)
+				}
+			}
+		}
+
+		return false, fmt.Sprintf("tag %q matches no deploy rule", tag)
+	default:
+		return false, fmt.Sprintf("ref %q is neither a branch nor a tag", ref)
+	}
+}
+
+// globMatch matches name against pattern using path.Match rules, so "*" does
+// not cross a "/", a malformed pattern never matches.
+func globMatch(pattern, name string) bool {
+	matches, err := path.Match(pattern, name)
+
+	return err == nil && matches
+}
+
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+// parseSemver parses versions like "v1.2.3", "1.2.3-rc.1" or "1.2", build
+// metadata is ignored and missing minor or patch numbers are zero.
+func parseSemver(version string) (semver, error) {
+	version = strings.TrimPrefix(version, "v")
+
+	if plusIndex := strings.Index(version, "+"); plusIndex != -1 {
+		version = version[:plusIndex]
+	}
+
+	var parsedVersion semver
+
+	if dashIndex := strings.Index(version, "-"); dashIndex != -1 {
+		parsedVersion.prerelease = version[dashIndex+1:]
+
+		version = version[:dashIndex]
+	}
+
+	versionParts := strings.Split(version, ".")
+
+	if len(versionParts) > 3 {
+		return semver{}, fmt.Errorf("too many version parts in %q", version)
+	}
+
+	numbers := []*int{&parsedVersion.major, &parsedVersion.minor, &parsedVersion.patch}
+
+	for i, versionPart := range versionParts {
+		number, err := strconv.Atoi(versionPart)
+
+		if err != nil || number < 0 {
+			return semver{}, fmt.Errorf("bad version number %q", versionPart)
+		}
+
+		*numbers[i] = number
+	}
+
+	return parsedVersion, nil
+}
+
+func (s semver) compare(other semver) int {
+	for _, difference := range []int{s.major - other.major, s.minor - other.minor, s.patch - other.patch} {
+		if difference < 0 {
+			return -1
+		}
+
+		if difference > 0 {
+			return 1
+		}
+	}
+
+	switch {
+	case s.prerelease == other.prerelease:
+		return 0
+	case s.prerelease == "":
+		return 1
+	case other.prerelease == "":
+		return -1
+	default:
+		return comparePrereleases(s.prerelease, other.prerelease)
+	}
+}
+
+// comparePrereleases orders prereleases identifier by identifier, numeric
+// identifiers numerically and below alphanumeric ones, so rc.2 comes before
+// rc.10 and rc.1 before rc.1.1.
+func comparePrereleases(a, b string) int {
+	aIdentifiers, bIdentifiers := strings.Split(a, "."), strings.Split(b, ".")
+
+	for i := 0; i < len(aIdentifiers) && i < len(bIdentifiers); i++ {
+		aNumber, aErr := strconv.Atoi(aIdentifiers[i])
+
+		bNumber, bErr := strconv.Atoi(bIdentifiers[i])
+
+		switch {
+		case aErr == nil && bErr == nil && aNumber != bNumber:
+			if aNumber < bNumber {
+				return -1
+			}
+
+			return 1
+		case aErr == nil && bErr != nil:
+			return -1
+		case aErr != nil && bErr == nil:
+			return 1
+		case aIdentifiers[i] < bIdentifiers[i]:
+			return -1
+		case aIdentifiers[i] > bIdentifiers[i]:
+			return 1
+		}
+	}
+
+	switch {
+	case len(aIdentifiers) < len(bIdentifiers):
+		return -1
+	case len(aIdentifiers) > len(bIdentifiers):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// satisfies checks the version against a space separated list of
+// constraints which all have to hold. Constraints are comparisons (">=1.2",
+// "<2", "=1.4.0"), caret and tilde ranges ("^1.2.0", "~1.2.0") or wildcards
+// ("1.x", "1.2.*", "*"). Prereleases only satisfy constraints that mention a
+// prerelease themselves.
+func (s semver) satisfies(constraints string) (bool, error) {
+	mentionsPrerelease := false
+
+	for _, constraint := range strings.Fields(constraints) {
+		operator := constraint[:len(constraint)-len(strings.TrimLeft(constraint, "<>=!^~"))]
+
+		versionString := constraint[len(operator):]
+
+		if versionString == "*" || versionString == "x" || versionString == "X" {
+			continue
+		}
+
+		wildcardParts := 0
+
+		versionParts := strings.Split(strings.TrimPrefix(versionString, "v"), ".")
+
+		for len(versionParts) > 0 {
+			lastPart := versionParts[len(versionParts)-1]
+
+			if lastPart != "x" && lastPart != "X" && lastPart != "*" {
+				break
+			}
+
+			versionParts = versionParts[:len(versionParts)-1]
+
+			wildcardParts++
+		}
+
+		constraintVersion, err := parseSemver(strings.Join(versionParts, "."))
+
+		if err != nil {
+			return false, err
+		}
+
+		if constraintVersion.prerelease != "" {
+			mentionsPrerelease = true
+		}
+
+		var matches bool
+
+		switch {
+		case wildcardParts != 0 || operator == "~" || operator == "^":
+			lower := constraintVersion
+
+			var upper semver
+
+			specifiedParts := len(versionParts)
+
+			switch {
+			case operator == "^" && constraintVersion.major != 0:
+				upper = semver{major: constraintVersion.major + 1}
+			case operator == "^" && constraintVersion.minor != 0:
+				upper = semver{minor: constraintVersion.minor + 1}
+			case operator == "^":
+				upper = semver{patch: constraintVersion.patch + 1}
+			case specifiedParts <= 1:
+				upper = semver{major: constraintVersion.major + 1}
+			default:
+				upper = semver{major: constraintVersion.major, minor: constraintVersion.minor + 1}
+			}
+
+			// Anything below the upper bound counts, including its prereleases
+			upper.prerelease = "0"
+
+			matches = s.compare(lower) >= 0 && s.compare(upper) < 0
+		case operator == "" || operator == "=" || operator == "==":
+			matches = s.compare(constraintVersion) == 0
+		case operator == "!=":
+			matches = s.compare(constraintVersion) != 0
+		case operator == ">":
+			matches = s.compare(constraintVersion) > 0
+		case operator == ">=":
+			matches = s.compare(constraintVersion) >= 0
+		case operator == "<":
+			matches = s.compare(constraintVersion) < 0
+		case operator == "<=":
+			matches = s.compare(constraintVersion) <= 0
+		default:
+			return false, fmt.Errorf("unknown operator %q", operator)
+		}
+
+		if !matches {
+			return false, nil
+		}
+	}
+
+	if s.prerelease != "" && !mentionsPrerelease {
+		return false, nil
+	}
+
+	return true, nil
+}
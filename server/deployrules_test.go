@@ -0,0 +1,166 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+func TestShouldDeploy(t *testing.T) {
+	rules := &uyghurs.DeployRules{
+		Branches:   []string{"master", "release/*"},
+		Tags:       []string{"deploy-*"},
+		SemverTags: []string{">=1.0.0 <2", "^3.1.0"},
+	}
+
+	tests := []struct {
+		name          string
+		rules         *uyghurs.DeployRules
+		ref           string
+		defaultBranch string
+		want          bool
+	}{
+		{"default branch without rules", nil, "refs/heads/main", "main", true},
+		{"other branch without rules", nil, "refs/heads/feature", "main", false},
+		{"master without rules or default branch", nil, "refs/heads/master", "", true},
+		{"tag without rules", nil, "refs/tags/v1.0.0", "main", false},
+		{"exact branch", rules, "refs/heads/master", "main", true},
+		{"glob branch", rules, "refs/heads/release/1.2", "main", true},
+		{"glob doesn't cross slashes", rules, "refs/heads/release/1.2/hotfix", "main", false},
+		{"default branch isn't implied by rules", rules, "refs/heads/main", "main", false},
+		{"glob tag", rules, "refs/tags/deploy-42", "main", true},
+		{"semver tag in range", rules, "refs/tags/v1.4.2", "main", true},
+		{"semver tag above range", rules, "refs/tags/v2.0.0", "main", false},
+		{"semver tag in caret range", rules, "refs/tags/3.9.0", "main", true},
+		{"semver tag below caret range", rules, "refs/tags/3.0.9", "main", false},
+		{"prerelease tag", rules, "refs/tags/v1.5.0-rc.1", "main", false},
+		{"tag that isn't a version", rules, "refs/tags/latest", "main", false},
+		{"neither branch nor tag", rules, "refs/pull/1/head", "main", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, reason := shouldDeploy(test.rules, test.ref, test.defaultBranch)
+
+			if got != test.want {
+				t.Errorf("shouldDeploy(%q) = %v (%s), want %v", test.ref, got, reason, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		version string
+		want    semver
+		wantErr bool
+	}{
+		{"1.2.3", semver{major: 1, minor: 2, patch: 3}, false},
+		{"v1.2.3", semver{major: 1, minor: 2, patch: 3}, false},
+		{"1.2", semver{major: 1, minor: 2}, false},
+		{"1.2.3-rc.1", semver{major: 1, minor: 2, patch: 3, prerelease: "rc.1"}, false},
+		{"1.2.3+build.5", semver{major: 1, minor: 2, patch: 3}, false},
+		{"1.2.3.4", semver{}, true},
+		{"1.a.3", semver{}, true},
+		{"", semver{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseSemver(test.version)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseSemver(%q) error = %v, want error %v", test.version, err, test.wantErr)
+
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("parseSemver(%q) = %+v, want %+v", test.version, got, test.want)
+		}
+	}
+}
+
+func TestSemverCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.3.0", "1.2.9", 1},
+		{"2.0.0", "1.9.9", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1.1", -1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+	}
+
+	for _, test := range tests {
+		a, _ := parseSemver(test.a)
+
+		b, _ := parseSemver(test.b)
+
+		if got := a.compare(b); got != test.want {
+			t.Errorf("%s compared to %s = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestSemverSatisfies(t *testing.T) {
+	tests := []struct {
+		version    string
+		constraint string
+		want       bool
+		wantErr    bool
+	}{
+		{"1.2.3", ">=1.2.0", true, false},
+		{"1.1.9", ">=1.2.0", false, false},
+		{"1.9.0", ">=1.0.0 <2", true, false},
+		{"2.0.0", ">=1.0.0 <2", false, false},
+		{"1.4.0", "=1.4.0", true, false},
+		{"1.4.0", "1.4.0", true, false},
+		{"1.4.1", "!=1.4.0", true, false},
+		{"1.4.0", ">1.4.0", false, false},
+		{"1.4.0", "<=1.4.0", true, false},
+		{"1.9.9", "^1.2.0", true, false},
+		{"2.0.0", "^1.2.0", false, false},
+		{"0.2.9", "^0.2.3", true, false},
+		{"0.3.0", "^0.2.3", false, false},
+		{"0.0.3", "^0.0.3", true, false},
+		{"0.0.4", "^0.0.3", false, false},
+		{"1.2.9", "~1.2.0", true, false},
+		{"1.3.0", "~1.2.0", false, false},
+		{"1.9.0", "~1", true, false},
+		{"1.7.2", "1.x", true, false},
+		{"2.0.0", "1.x", false, false},
+		{"1.2.7", "1.2.*", true, false},
+		{"1.3.0", "1.2.*", false, false},
+		{"5.0.0", "*", true, false},
+		{"2.0.0-rc.1", "^1.2.0", false, false},
+		{"1.5.0-rc.1", ">=1.0.0", false, false},
+		{"1.5.0-rc.1", ">=1.5.0-rc.0", true, false},
+		{"1.0.0", ">=a.b", false, true},
+		{"1.0.0", "%1.0.0", false, true},
+	}
+
+	for _, test := range tests {
+		version, err := parseSemver(test.version)
+
+		if err != nil {
+			t.Fatalf("parseSemver(%q): %s", test.version, err)
+		}
+
+		got, err := version.satisfies(test.constraint)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s satisfies %q error = %v, want error %v", test.version, test.constraint, err, test.wantErr)
+
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%s satisfies %q = %v, want %v", test.version, test.constraint, got, test.want)
+		}
+	}
+}
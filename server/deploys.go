@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+var (
+	projectNameRegex  = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	deployRefRegex    = regexp.MustCompile(`^refs/(heads|tags)/[A-Za-z0-9._/-]+$`)
+	deployCommitRegex = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+)
+
+// deployRequest asks for a project to be deployed outside of a webhook, at
+// the tip of Ref or at Commit. An empty Ref is the default branch, a Ref
+// without a "refs/" prefix is taken as a branch name.
+type deployRequest struct {
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+// push turns the request into the push a webhook would have sent for it, an
+// empty After has the worker resolve the ref itself.
+func (dR deployRequest) push(repository uyghurs.Repository) (uyghurs.GithubPush, error) {
+	ref := dR.Ref
+
+	if ref == "" {
+		defaultBranch := repository.DefaultBranch
+
+		if defaultBranch == "" {
+			defaultBranch = "master"
+		}
+
+		ref = branchRefPrefix + defaultBranch
+	} else if !strings.HasPrefix(ref, "refs/") {
+		ref = branchRefPrefix + ref
+	}
+
+	if !deployRefRegex.MatchString(ref) || strings.Contains(ref, "..") {
+		return uyghurs.GithubPush{}, fmt.Errorf("invalid ref %q", dR.Ref)
+	}
+
+	if dR.Commit != "" && !deployCommitRegex.MatchString(dR.Commit) {
+		return uyghurs.GithubPush{}, fmt.Errorf("invalid commit %q", dR.Commit)
+	}
+
+	return uyghurs.GithubPush{
+		Ref:        ref,
+		After:      strings.ToLower(dR.Commit),
+		Repository: repository,
+	}, nil
+}
+
+// checkoutCommit moves the app directory to exactly commit, fetching it from
+// origin if it isn't known yet. Local changes to tracked files are dropped.
+func checkoutCommit(appDir, commit string) error {
+	err := fetchCommit(appDir, commit)
+
+	if err != nil {
+		return err
+	}
+
+	checkoutOutput, err := exec.Command("git", "-C", appDir, "checkout", "--quiet", "--force", "--detach", commit).CombinedOutput()
+
+	if err != nil {
+		return fmt.Errorf("error checking out %s: %w: %s", commit, err, strings.TrimSpace(string(checkoutOutput)))
+	}
+
+	return nil
+}
+
+// fetchCommit fetches commit from origin unless the app directory already
+// has it, the checkout itself is left alone.
+func fetchCommit(appDir, commit string) error {
+	if !deployCommitRegex.MatchString(commit) {
+		return fmt.Errorf("invalid commit %q", commit)
+	}
+
+	err := exec.Command("git", "-C", appDir, "cat-file", "-e", commit+"^{commit}").Run()
+
+	if err != nil {
+		fetchOutput, err := exec.Command("git", "-C", appDir, "fetch", "--quiet", "--tags", "origin").CombinedOutput()
+
+		if err != nil {
+			return fmt.Errorf("error fetching origin: %w: %s", err, strings.TrimSpace(string(fetchOutput)))
+		}
+	}
+
+	// Commits no branch or tag points to anymore have to be asked for by name
+	err = exec.Command("git", "-C", appDir, "cat-file", "-e", commit+"^{commit}").Run()
+
+	if err != nil {
+		fetchOutput, err := exec.Command("git", "-C", appDir, "fetch", "--quiet", "origin", commit).CombinedOutput()
+
+		if err != nil {
+			return fmt.Errorf("error fetching %s: %w: %s", commit, err, strings.TrimSpace(string(fetchOutput)))
+		}
+	}
+
+	return nil
+}
+
+// resolveCommit is the full commit a push would deploy, commit if it isn't
+// empty or the tip of ref on origin otherwise. The commit is fetched but not
+// checked out.
+func resolveCommit(appDir string, githubPush uyghurs.GithubPush) (string, error) {
+	commit := githubPush.After
+
+	if commit == "" {
+		// Tags are listed peeled as well, the peeled line comes last and
+		// names the commit rather than the tag
+		lsRemoteOutput, err := exec.Command("git", "-C", appDir, "ls-remote", "origin", githubPush.Ref, githubPush.Ref+"^{}").Output()
+
+		if err != nil {
+			return "", fmt.Errorf("error listing %s on origin: %w", githubPush.Ref, err)
+		}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(lsRemoteOutput)), "\n") {
+			if lineFields := strings.Fields(line); len(lineFields) == 2 {
+				commit = lineFields[0]
+			}
+		}
+
+		if commit == "" {
+			return "", fmt.Errorf("%s doesn't exist on origin", githubPush.Ref)
+		}
+	}
+
+	err := fetchCommit(appDir, commit)
+
+	if err != nil {
+		return "", err
+	}
+
+	revisionOutput, err := exec.Command("git", "-C", appDir, "rev-parse", "--verify", commit+"^{commit}").Output()
+
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %w", commit, err)
+	}
+
+	return strings.TrimSpace(string(revisionOutput)), nil
+}
+
+// commitFile reads a file of the app as it is at commit, without checking
+// the commit out.
+func commitFile(appDir, commit, filePath string) ([]byte, error) {
+	showOutput, err := exec.Command("git", "-C", appDir, "show", commit+":"+filePath).Output()
+
+	if exitErr, isExitErr := err.(*exec.ExitError); isExitErr {
+		return nil, fmt.Errorf("error reading %s at %s: %s", filePath, commit, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return showOutput, nil
+}
+
+// commitFileReader reads the app's files as they are at commit in repoDir,
+// files the commit doesn't track, like a .env kept only on this host, are
+// read from the checkout in appDir since checking commit out leaves them be.
+func commitFileReader(repoDir, appDir, commit string) func(string) ([]byte, error) {
+	readCheckoutFile := checkoutFileReader(appDir)
+
+	return func(filePath string) ([]byte, error) {
+		filePath = path.Clean(filePath)
+
+		err := exec.Command("git", "-C", repoDir, "cat-file", "-e", commit+":"+filePath).Run()
+
+		if err != nil {
+			return readCheckoutFile(filePath)
+		}
+
+		return commitFile(repoDir, commit, filePath)
+	}
+}
+
+// scratchClone makes a throwaway bare clone of the app's checkout that
+// shares its objects and fetches from the same origin, so commits can be
+// fetched and read without touching the checkout deploys use. The returned
+// function removes the clone.
+func scratchClone(appDir string) (string, func(), error) {
+	remoteURLOutput, err := exec.Command("git", "-C", appDir, "remote", "get-url", "origin").Output()
+
+	if err != nil {
+		return "", nil, fmt.Errorf("error getting origin of %s: %w", appDir, err)
+	}
+
+	scratchDir, err := ioutil.TempDir("", "uyghurs-scratch-")
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	removeScratchDir := func() {
+		os.RemoveAll(scratchDir)
+	}
+
+	cloneOutput, err := exec.Command("git", "clone", "--quiet", "--bare", "--shared", appDir, scratchDir).CombinedOutput()
+
+	if err != nil {
+		removeScratchDir()
+
+		return "", nil, fmt.Errorf("error cloning %s: %w: %s", appDir, err, strings.TrimSpace(string(cloneOutput)))
+	}
+
+	remoteOutput, err := exec.Command("git", "-C", scratchDir, "remote", "set-url", "origin", strings.TrimSpace(string(remoteURLOutput))).CombinedOutput()
+
+	if err != nil {
+		removeScratchDir()
+
+		return "", nil, fmt.Errorf("error setting origin of the scratch clone: %w: %s", err, strings.TrimSpace(string(remoteOutput)))
+	}
+
+	return scratchDir, removeScratchDir, nil
+}
+
+// checkoutRevision is the commit the app directory has checked out.
+func checkoutRevision(appDir string) (string, error) {
+	revisionOutput, err := exec.Command("git", "-C", appDir, "rev-parse", "HEAD").Output()
+
+	if err != nil {
+		return "", fmt.Errorf("error getting revision of %s: %w", appDir, err)
+	}
+
+	return strings.TrimSpace(string(revisionOutput)), nil
+}
+
+// checkoutRepository describes the repository the app directory was cloned
+// from, for projects that haven't been deployed through the server yet.
+func checkoutRepository(appDir string) (uyghurs.Repository, error) {
+	remoteURLOutput, err := exec.Command("git", "-C", appDir, "remote", "get-url", "origin").Output()
+
+	if err != nil {
+		return uyghurs.Repository{}, fmt.Errorf("error getting origin of %s: %w", appDir, err)
+	}
+
+	remoteURL := strings.TrimSpace(string(remoteURLOutput))
+
+	if remoteURL == "" {
+		return uyghurs.Repository{}, errors.New("app checkout has no origin")
+	}
+
+	repository := uyghurs.Repository{
+		Name:     filepath.Base(appDir),
+		CloneURL: remoteURL,
+	}
+
+	// The default branch is only known if the clone recorded origin's HEAD,
+	// otherwise fall back to whatever is checked out
+	defaultBranchOutput, err := exec.Command("git", "-C", appDir, "symbolic-ref", "--short", "refs/remotes/origin/HEAD").Output()
+
+	if err == nil {
+		repository.DefaultBranch = strings.TrimPrefix(strings.TrimSpace(string(defaultBranchOutput)), "origin/")
+	} else if currentBranchOutput, err := exec.Command("git", "-C", appDir, "symbolic-ref", "--short", "HEAD").Output(); err == nil {
+		repository.DefaultBranch = strings.TrimSpace(string(currentBranchOutput))
+	}
+
+	return repository, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+)
+
+// deployTask is a deploy waiting for its project, run deploys it and
+// supersede is called instead if a newer deploy of the project replaces it
+// before it starts.
+type deployTask struct {
+	name      string
+	run       func()
+	supersede func(newerTask string)
+}
+
+// deployExecutor runs deploys off of the caller's goroutine, one at a time
+// for every project and at most maxDeploys at a time across projects. A
+// project only ever has one deploy waiting, a newer one replaces it, so
+// after a burst of pushes only the newest is deployed.
+type deployExecutor struct {
+	slots   chan struct{}
+	running map[string]bool
+	waiting map[string]*deployTask
+	lock    *sync.Mutex
+}
+
+func newDeployExecutor(maxDeploys int) *deployExecutor {
+	if maxDeploys < 1 {
+		maxDeploys = 1
+	}
+
+	return &deployExecutor{
+		slots:   make(chan struct{}, maxDeploys),
+		running: make(map[string]bool),
+		waiting: make(map[string]*deployTask),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// submit schedules a deploy of project, superseding any deploy of it that
+// hasn't started yet.
+func (dE *deployExecutor) submit(project string, task *deployTask) {
+	dE.lock.Lock()
+
+	defer dE.lock.Unlock()
+
+	if supersededTask, exists := dE.waiting[project]; exists {
+		go supersededTask.supersede(task.name)
+	}
+
+	dE.waiting[project] = task
+
+	if dE.running[project] {
+		return
+	}
+
+	dE.running[project] = true
+
+	go dE.runProject(project)
+}
+
+// runProject runs the project's waiting deploys until there are none left.
+func (dE *deployExecutor) runProject(project string) {
+	for {
+		dE.slots <- struct{}{}
+
+		dE.lock.Lock()
+
+		task, exists := dE.waiting[project]
+
+		if !exists {
+			delete(dE.running, project)
+
+			dE.lock.Unlock()
+
+			<-dE.slots
+
+			return
+		}
+
+		delete(dE.waiting, project)
+
+		dE.lock.Unlock()
+
+		task.run()
+
+		<-dE.slots
+	}
+}
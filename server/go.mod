@@ -4,11 +4,12 @@ go 1.13
 
 require (
 	github.com/docker/docker v1.13.1
-	github.com/fatih/structs v1.1.0
+	github.com/docker/go-connections v0.4.0
 	github.com/gin-gonic/gin v1.6.3
 	github.com/joho/godotenv v1.3.0
-	github.com/mitchellh/mapstructure v1.3.3
 	github.com/the-rileyj/uyghurs v0.1.10
 	gopkg.in/olahol/melody.v1 v1.0.0-20170518105555-d52139073376
 	gopkg.in/yaml.v2 v2.2.8
 )
+
+replace github.com/the-rileyj/uyghurs => ../
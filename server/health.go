@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	defaultReadinessTimeout = 2 * time.Minute
+	readinessPollInterval   = 2 * time.Second
+	readinessProbeTimeout   = 5 * time.Second
+	// readyPollsNeeded is how many polls in a row everything has to be ready
+	// for, so a container that comes up and immediately falls over isn't let
+	// through.
+	readyPollsNeeded = 2
+)
+
+var errServiceNotReady = errors.New("service isn't ready")
+
+// readinessTimeout returns how long a deploy has to become ready.
+func readinessTimeout(readiness *uyghurs.Readiness) (time.Duration, error) {
+	if readiness == nil || readiness.Timeout == "" {
+		return defaultReadinessTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(readiness.Timeout)
+
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid readiness timeout %q", readiness.Timeout)
+	}
+
+	return timeout, nil
+}
+
+// validateReadiness checks the readiness timeout and that every probe names a
+// service of the project and a valid port, so bad readiness settings fail the
+// deploy before any container is replaced.
+func validateReadiness(readiness *uyghurs.Readiness, project *composeProject) error {
+	if readiness == nil {
+		return nil
+	}
+
+	_, err := readinessTimeout(readiness)
+
+	if err != nil {
+		return err
+	}
+
+	for _, probe := range readiness.Probes {
+		if probe == nil {
+			return errors.New("empty readiness probe")
+		}
+
+		if _, exists := project.Services[probe.Service]; !exists {
+			return fmt.Errorf("readiness probe for unknown service %q", probe.Service)
+		}
+
+		if probe.Port < 1 || probe.Port > 65535 {
+			return fmt.Errorf("invalid readiness probe port %d for %s", probe.Port, probe.Service)
+		}
+	}
+
+	return nil
+}
+
+// waitReady waits for the services a reconcile brought up to be ready: their
+// containers running, healthy if they have a health check, and passing the
+// project's readiness probes. Services that don't restart are also ready once
+// they exited with 0, like one-off setup containers. Containers exiting,
+// restarting or turning unhealthy fail straight away, anything else fails once
+// the readiness timeout runs out.
+func (cR *composeReconciler) waitReady(ctx context.Context, serviceResults []serviceResult, readiness *uyghurs.Readiness) error {
+	timeout, err := readinessTimeout(readiness)
+
+	if err != nil {
+		return err
+	}
+
+	var probes []*uyghurs.ReadinessProbe
+
+	if readiness != nil {
+		probes = readiness.Probes
+	}
+
+	containerIDs := make(map[string]string)
+
+	// Only restarts since this deploy count, a container left running as it
+	// was may have restarted any number of times long before it
+	restartBaselines := make(map[string]int)
+
+	for _, serviceResult := range serviceResults {
+		if serviceResult.ContainerID == "" {
+			continue
+		}
+
+		containerIDs[serviceResult.Service] = serviceResult.ContainerID
+
+		if serviceResult.Action == serviceUnchanged {
+			containerJSON, err := cR.cli.ContainerInspect(ctx, serviceResult.ContainerID)
+
+			if err != nil {
+				return fmt.Errorf("error inspecting %s: %w", serviceResult.Service, err)
+			}
+
+			restartBaselines[serviceResult.Service] = containerJSON.RestartCount
+		}
+	}
+
+	for _, probe := range probes {
+		if _, exists := containerIDs[probe.Service]; !exists {
+			return fmt.Errorf("readiness probe for unknown service %q", probe.Service)
+		}
+
+		if probe.Port < 1 || probe.Port > 65535 {
+			return fmt.Errorf("invalid readiness probe port %d for %s", probe.Port, probe.Service)
+		}
+	}
+
+	readyContext, cancel := context.WithTimeout(ctx, timeout)
+
+	defer cancel()
+
+	probeClient := &http.Client{Timeout: readinessProbeTimeout}
+
+	readyPolls := 0
+
+	for {
+		err := cR.checkReady(readyContext, probeClient, containerIDs, restartBaselines, probes)
+
+		switch {
+		case err == nil:
+			readyPolls++
+
+			if readyPolls >= readyPollsNeeded {
+				return nil
+			}
+		case errors.Is(err, errServiceNotReady):
+			readyPolls = 0
+		default:
+			return err
+		}
+
+		select {
+		case <-readyContext.Done():
+			if err == nil {
+				err = errors.New("services didn't stay ready")
+			}
+
+			return fmt.Errorf("not ready after %s: %w", timeout, err)
+		case <-time.After(readinessPollInterval):
+		}
+	}
+}
+
+// checkReady checks every service once, errors wrapping errServiceNotReady
+// are worth waiting on, any other error means the deploy has failed. A
+// container has restarted if its restart count went past its baseline.
+func (cR *composeReconciler) checkReady(ctx context.Context, probeClient *http.Client, containerIDs map[string]string, restartBaselines map[string]int, probes []*uyghurs.ReadinessProbe) error {
+	containerIPs := make(map[string]string)
+
+	for serviceName, containerID := range containerIDs {
+		containerJSON, err := cR.cli.ContainerInspect(ctx, containerID)
+
+		if err != nil {
+			return fmt.Errorf("error inspecting %s: %w", serviceName, err)
+		}
+
+		state := containerJSON.State
+
+		if state == nil {
+			return fmt.Errorf("%w: %s has no state yet", errServiceNotReady, serviceName)
+		}
+
+		if state.Restarting || containerJSON.RestartCount > restartBaselines[serviceName] {
+			return fmt.Errorf("%s is restarting, exit code %d", serviceName, state.ExitCode)
+		}
+
+		if !state.Running && state.Status == "exited" && state.ExitCode == 0 && !restartsContainer(containerJSON.HostConfig) {
+			continue
+		}
+
+		if !state.Running {
+			return fmt.Errorf("%s is %s, exit code %d", serviceName, state.Status, state.ExitCode)
+		}
+
+		if state.Health != nil {
+			switch state.Health.Status {
+			case "unhealthy":
+				return fmt.Errorf("%s is unhealthy", serviceName)
+			case "healthy":
+			default:
+				return fmt.Errorf("%w: %s is %s", errServiceNotReady, serviceName, state.Health.Status)
+			}
+		}
+
+		if containerJSON.NetworkSettings != nil {
+			for _, endpoint := range containerJSON.NetworkSettings.Networks {
+				if endpoint != nil && endpoint.IPAddress != "" {
+					containerIPs[serviceName] = endpoint.IPAddress
+
+					break
+				}
+			}
+		}
+	}
+
+	for _, probe := range probes {
+		containerIP, exists := containerIPs[probe.Service]
+
+		if !exists {
+			return fmt.Errorf("%w: %s has no address to probe", errServiceNotReady, probe.Service)
+		}
+
+		err := probeReady(ctx, probeClient, containerIP, probe)
+
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errServiceNotReady, probe.Service, err)
+		}
+	}
+
+	return nil
+}
+
+// restartsContainer checks whether docker restarts a container with
+// hostConfig once it has exited successfully.
+func restartsContainer(hostConfig *container.HostConfig) bool {
+	if hostConfig == nil {
+		return false
+	}
+
+	switch hostConfig.RestartPolicy.Name {
+	case "", "no", "on-failure":
+		return false
+	default:
+		return true
+	}
+}
+
+// probeReady makes one HTTP request for a readiness probe, it passes on any
+// of the probe's statuses or, without any, on a 2xx or 3xx.
+func probeReady(ctx context.Context, probeClient *http.Client, containerIP string, probe *uyghurs.ReadinessProbe) error {
+	probePath := probe.Path
+
+	if probePath == "" || probePath[0] != '/' {
+		probePath = "/" + probePath
+	}
+
+	probeURL := "http://" + net.JoinHostPort(containerIP, strconv.Itoa(probe.Port)) + probePath
+
+	probeRequest, err := http.NewRequest(http.MethodGet, probeURL, nil)
+
+	if err != nil {
+		return err
+	}
+
+	probeResponse, err := probeClient.Do(probeRequest.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	probeResponse.Body.Close()
+
+	if len(probe.Statuses) == 0 {
+		if probeResponse.StatusCode >= 200 && probeResponse.StatusCode < 400 {
+			return nil
+		}
+	}
+
+	for _, status := range probe.Statuses {
+		if probeResponse.StatusCode == status {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("GET %s returned %d", probeURL, probeResponse.StatusCode)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/the-rileyj/uyghurs"
+)
+
+func TestValidateReadiness(t *testing.T) {
+	project := &composeProject{
+		Services: map[string]*composeService{"web": {}},
+	}
+
+	tests := []struct {
+		name      string
+		readiness *uyghurs.Readiness
+		wantErr   bool
+	}{
+		{"no readiness", nil, false},
+		{"default timeout", &uyghurs.Readiness{}, false},
+		{"timeout", &uyghurs.Readiness{Timeout: "90s"}, false},
+		{"timeout without a unit", &uyghurs.Readiness{Timeout: "90"}, true},
+		{"zero timeout", &uyghurs.Readiness{Timeout: "0s"}, true},
+		{"negative timeout", &uyghurs.Readiness{Timeout: "-1m"}, true},
+		{"probe", &uyghurs.Readiness{Probes: []*uyghurs.ReadinessProbe{{Service: "web", Port: 80}}}, false},
+		{"probe for unknown service", &uyghurs.Readiness{Probes: []*uyghurs.ReadinessProbe{{Service: "db", Port: 80}}}, true},
+		{"probe without a port", &uyghurs.Readiness{Probes: []*uyghurs.ReadinessProbe{{Service: "web"}}}, true},
+		{"empty probe", &uyghurs.Readiness{Probes: []*uyghurs.ReadinessProbe{nil}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateReadiness(test.readiness, project)
+
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateReadiness error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestRestartsContainer(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   bool
+	}{
+		{"", false},
+		{"no", false},
+		{"on-failure", false},
+		{"always", true},
+		{"unless-stopped", true},
+	}
+
+	for _, test := range tests {
+		hostConfig := &container.HostConfig{RestartPolicy: container.RestartPolicy{Name: test.policy}}
+
+		if got := restartsContainer(hostConfig); got != test.want {
+			t.Errorf("restartsContainer(%q) = %v, want %v", test.policy, got, test.want)
+		}
+	}
+}
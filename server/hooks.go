@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	preDeployHook  = "pre-deploy"
+	postDeployHook = "post-deploy"
+)
+
+const (
+	hookLabel = "uyghurs.hook"
+
+	defaultHookTimeout = 5 * time.Minute
+
+	// maxHookOutput is how much of the end of a hook's output is kept
+	maxHookOutput = 4096
+)
+
+var errHookFailed = errors.New("hook failed")
+
+type hookResult struct {
+	Name       string    `json:"name"`
+	Phase      string    `json:"phase"`
+	Service    string    `json:"service,omitempty"`
+	ExitCode   int64     `json:"exitCode"`
+	Output     string    `json:"output,omitempty"`
+	Err        string    `json:"err,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+}
+
+// validateHooks checks that every hook names a build and service that exist,
+// so a bad hook fails the deploy before any hook runs.
+func validateHooks(hooks *uyghurs.DeployHooks, project *composeProject, buildsInfo []*uyghurs.BuildInfo) error {
+	if hooks == nil {
+		return nil
+	}
+
+	buildNames := make(map[string]bool)
+
+	for _, buildInfo := range buildsInfo {
+		buildNames[buildInfo.Name] = true
+	}
+
+	for _, hook := range append(append([]*uyghurs.DeployHook{}, hooks.PreDeploy...), hooks.PostDeploy...) {
+		if hook == nil || len(hook.Command) == 0 {
+			return fmt.Errorf("hook %s has no command", hookName(hook))
+		}
+
+		if !buildNames[hook.Build] {
+			return fmt.Errorf("hook %s runs unknown build %q", hookName(hook), hook.Build)
+		}
+
+		if _, exists := project.Services[hook.Service]; hook.Service != "" && !exists {
+			return fmt.Errorf("hook %s runs like unknown service %s", hookName(hook), hook.Service)
+		}
+
+		if hook.Timeout != "" {
+			if timeout, err := time.ParseDuration(hook.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("invalid timeout %q for hook %s", hook.Timeout, hookName(hook))
+			}
+		}
+	}
+
+	return nil
+}
+
+func hookName(hook *uyghurs.DeployHook) string {
+	if hook == nil {
+		return ""
+	}
+
+	if hook.Name != "" {
+		return hook.Name
+	}
+
+	return strings.Join(hook.Command, " ")
+}
+
+// runHooks runs hooks one after another with the images in buildImages, by
+// BuildInfo name, stopping at the first one that fails.
+func (cR *composeReconciler) runHooks(ctx context.Context, project *composeProject, phase string, hooks []*uyghurs.DeployHook, commit string, buildImages map[string]string) ([]hookResult, error) {
+	results := make([]hookResult, 0, len(hooks))
+
+	for _, hook := range hooks {
+		result := cR.runHook(ctx, project, phase, hook, commit, buildImages[hook.Build])
+
+		results = append(results, result)
+
+		if result.Err != "" {
+			return results, fmt.Errorf("%s %w: %s: %s", phase, errHookFailed, result.Name, result.Err)
+		}
+	}
+
+	return results, nil
+}
+
+// runHook runs a single hook in a container that is removed once it exits.
+func (cR *composeReconciler) runHook(ctx context.Context, project *composeProject, phase string, hook *uyghurs.DeployHook, commit, image string) hookResult {
+	result := hookResult{
+		Name:      hookName(hook),
+		Phase:     phase,
+		Service:   hookService(project, hook, image),
+		ExitCode:  -1,
+		StartedAt: time.Now(),
+	}
+
+	defer func() {
+		result.FinishedAt = time.Now()
+	}()
+
+	timeout := defaultHookTimeout
+
+	if hook.Timeout != "" {
+		timeout, _ = time.ParseDuration(hook.Timeout)
+	}
+
+	fmt.Printf("running %s hook %s of %s\n", phase, result.Name, project.Name)
+
+	imageID, err := cR.ensureImage(ctx, image)
+
+	if err != nil {
+		result.Err = err.Error()
+
+		return result
+	}
+
+	spec, err := newHookSpec(project, result.Service, commit, imageID)
+
+	if err != nil {
+		result.Err = err.Error()
+
+		return result
+	}
+
+	spec.Config.Cmd = hook.Command
+	spec.serviceName = fmt.Sprintf("%s hook %s", phase, result.Name)
+
+	hookContext, cancel := context.WithTimeout(ctx, timeout)
+
+	defer cancel()
+
+	containerID, err := cR.startContainer(hookContext, spec)
+
+	if containerID != "" {
+		// The hook's context may be over by now, the container is removed
+		// either way
+		defer func() {
+			removeErr := cR.removeContainer(context.Background(), containerID, false)
+
+			if removeErr != nil {
+				fmt.Printf("error removing hook container %s: %s\n", spec.containerName, removeErr)
+			}
+		}()
+	}
+
+	if err != nil {
+		result.Err = err.Error()
+
+		return result
+	}
+
+	result.ExitCode, err = cR.cli.ContainerWait(hookContext, containerID)
+
+	result.Output = cR.hookOutput(containerID)
+
+	for _, outputLine := range strings.Split(strings.TrimRight(result.Output, "\n"), "\n") {
+		fmt.Printf("%s hook %s: %s\n", phase, result.Name, outputLine)
+	}
+
+	switch {
+	case hookContext.Err() == context.DeadlineExceeded:
+		result.Err = fmt.Sprintf("timed out after %s", timeout)
+	case err != nil:
+		result.Err = err.Error()
+	case result.ExitCode != 0:
+		result.Err = fmt.Sprintf("exited with %d", result.ExitCode)
+	}
+
+	return result
+}
+
+// hookOutput is the end of what a hook printed, hooks run with a TTY so
+// their output isn't multiplexed.
+func (cR *composeReconciler) hookOutput(containerID string) string {
+	logsContext, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	logs, err := cR.cli.ContainerLogs(logsContext, containerID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+
+	if err != nil {
+		return fmt.Sprintf("error reading output: %s", err)
+	}
+
+	defer logs.Close()
+
+	outputBytes, err := ioutil.ReadAll(logs)
+
+	if err != nil {
+		return fmt.Sprintf("error reading output: %s", err)
+	}
+
+	if len(outputBytes) > maxHookOutput {
+		outputBytes = outputBytes[len(outputBytes)-maxHookOutput:]
+	}
+
+	return strings.Replace(string(outputBytes), "\r\n", "\n", -1)
+}
+
+// hookService is the service a hook runs like, the one it names or the first
+// service running the hook's image.
+func hookService(project *composeProject, hook *uyghurs.DeployHook, image string) string {
+	if hook.Service != "" {
+		return hook.Service
+	}
+
+	serviceNames := make([]string, 0, len(project.Services))
+
+	for serviceName := range project.Services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+
+	sort.Strings(serviceNames)
+
+	for _, serviceName := range serviceNames {
+		if imageRepository(project.Services[serviceName].Image) == imageRepository(image) {
+			return serviceName
+		}
+	}
+
+	return ""
+}
+
+// newHookSpec creates the container configuration of a hook, the service's
+// environment, volumes and networks without its ports, restart policy, health
+// check or network aliases, so it can run next to the service's container.
+// Hooks without a service only get the project's environment.
+func newHookSpec(project *composeProject, serviceName, commit, imageID string) (*serviceSpec, error) {
+	spec := &serviceSpec{
+		Config:         &container.Config{},
+		HostConfig:     &container.HostConfig{},
+		NetworkAliases: make(map[string][]string),
+	}
+
+	if serviceName != "" {
+		var err error
+
+		spec, err = newServiceSpec(project, serviceName, commit, imageID)
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for key, value := range project.Environment {
+			spec.Config.Env = append(spec.Config.Env, key+"="+value)
+		}
+
+		sort.Strings(spec.Config.Env)
+	}
+
+	spec.Config.Image = imageID
+	spec.Config.Tty = true
+	spec.Config.ExposedPorts = nil
+	spec.Config.Healthcheck = nil
+	spec.Config.Labels = map[string]string{
+		hookLabel:   project.Name,
+		commitLabel: commit,
+	}
+
+	spec.HostConfig.PortBindings = nil
+	spec.HostConfig.RestartPolicy = container.RestartPolicy{}
+
+	spec.NetworkAliases = make(map[string][]string)
+
+	spec.ImageID = imageID
+	spec.containerName = fmt.Sprintf("%s_hook_%s", project.Name, newRandomID()[:8])
+	spec.commit = commit
+	spec.projectName = project.Name
+
+	return spec, nil
+}
@@ -2,47 +2,46 @@ package main
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha1"
-	"crypto/sha256"
-	"crypto/sha512"
-	"encoding/hex"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"hash"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"github.com/fatih/structs"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"github.com/mitchellh/mapstructure"
 	"github.com/the-rileyj/uyghurs"
 	"gopkg.in/olahol/melody.v1"
 	"gopkg.in/yaml.v2"
 )
 
+// The server's TLS certificate and key, commands find the server's host in
+// the certificate.
+const (
+	tlsCertPath = "secrets/RJcert.crt"
+	tlsKeyPath  = "secrets/RJsecret.key"
+)
+
 type projectMetadataHandler struct {
 	projectsMetadataMap map[string]*uyghurs.ProjectMetadata
 	lock                *sync.Mutex
 	routerConnection    *melody.Session
 }
 
-func newProjectMetadataHandler(baseDir string, development bool) *projectMetadataHandler {
-	projectsMetadataMap := getProjectsMetadataMap("apps/", development)
+func newProjectMetadataHandler(apps *appRegistry, tornDown map[string]bool) *projectMetadataHandler {
+	projectsMetadataMap := getProjectsMetadataMap(apps, tornDown)
 
 	return &projectMetadataHandler{
 		lock:                &sync.Mutex{},
@@ -64,82 +63,133 @@ func (pMH *projectMetadataHandler) getAllProjectsMetadata() []*uyghurs.ProjectMe
 	return projectsMetadata
 }
 
+// setRouterConnection stores s as the router connection if there isn't one
+// already, it reports whether s was stored.
+func (pMH *projectMetadataHandler) setRouterConnection(s *melody.Session) bool {
+	pMH.lock.Lock()
+
+	defer pMH.lock.Unlock()
+
+	if pMH.routerConnection != nil {
+		return false
+	}
+
+	pMH.routerConnection = s
+
+	return true
+}
+
+func (pMH *projectMetadataHandler) clearRouterConnection(s *melody.Session) {
+	pMH.lock.Lock()
+
+	defer pMH.lock.Unlock()
+
+	if pMH.routerConnection == s {
+		pMH.routerConnection = nil
+	}
+}
+
+func (pMH *projectMetadataHandler) getProjectMetadata(projectName string) (*uyghurs.ProjectMetadata, bool) {
+	pMH.lock.Lock()
+
+	defer pMH.lock.Unlock()
+
+	projectMetadata, exists := pMH.projectsMetadataMap[projectName]
+
+	return projectMetadata, exists
+}
+
 func (pMH *projectMetadataHandler) updateProjectMetadata(projectMetadata *uyghurs.ProjectMetadata) {
 	pMH.lock.Lock()
 
 	pMH.projectsMetadataMap[projectMetadata.ProjectName] = projectMetadata
 
+	routerConnection := pMH.routerConnection
+
 	pMH.lock.Unlock()
 
-	if pMH.routerConnection != nil {
-		routerUpdateBytes, err := json.MarshalIndent([]*uyghurs.ProjectMetadata{projectMetadata}, "", "    ")
+	writeToRouter(routerConnection, projectMetadata)
+}
 
-		if err != nil {
-			log.Println("error occurred marshalling JSON for router:", err)
-		}
+// removeProjectMetadata drops a project that was torn down and tells the
+// router to remove its routes, it returns how many routes the project had.
+func (pMH *projectMetadataHandler) removeProjectMetadata(projectName string) int {
+	pMH.lock.Lock()
 
-		err = pMH.routerConnection.Write(routerUpdateBytes)
+	projectMetadata, exists := pMH.projectsMetadataMap[projectName]
 
-		if err != nil {
-			log.Println("error occurred writing JSON for router:", err)
-		}
-	}
-}
+	delete(pMH.projectsMetadataMap, projectName)
+
+	routerConnection := pMH.routerConnection
 
-func getProjectsMetadataMap(baseDir string, development bool) map[string]*uyghurs.ProjectMetadata {
-	dockerComposeFile := "docker-compose.yml"
+	pMH.lock.Unlock()
+
+	// The removal is sent even for projects that aren't known, in case the
+	// router still has routes from before the server restarted
+	writeToRouter(routerConnection, &uyghurs.ProjectMetadata{
+		ProjectName:   projectName,
+		ProjectRoutes: make([]*uyghurs.RouteInfo, 0),
+		Removed:       true,
+	})
 
-	if development {
-		dockerComposeFile = "docker-compose.dev.yml"
+	if !exists {
+		return 0
 	}
 
-	projectsMetadataMap := make(map[string]*uyghurs.ProjectMetadata, 0)
+	return len(projectMetadata.ProjectRoutes)
+}
 
-	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+func writeToRouter(routerConnection *melody.Session, projectMetadata *uyghurs.ProjectMetadata) {
+	if routerConnection == nil {
+		return
+	}
 
-		windowsProjectDirSplit := strings.Split(path, "\\")
-		linuxProjectDirSplit := strings.Split(path, "/")
+	routerUpdateBytes, err := json.MarshalIndent([]*uyghurs.ProjectMetadata{projectMetadata}, "", "    ")
 
-		projectDirSplit := windowsProjectDirSplit
+	if err != nil {
+		log.Println("error occurred marshalling JSON for router:", err)
+	}
 
-		if len(windowsProjectDirSplit) == 1 {
-			projectDirSplit = linuxProjectDirSplit
-		}
+	err = routerConnection.Write(routerUpdateBytes)
 
-		if len(projectDirSplit) == 2 && info.IsDir() {
-			dockerComposePath := filepath.Join(path, dockerComposeFile)
+	if err != nil {
+		log.Println("error occurred writing JSON for router:", err)
+	}
+}
 
-			if _, fileErr := os.Stat(dockerComposePath); os.IsNotExist(fileErr) {
-				return nil
-			}
+// getProjectsMetadataMap reads the settings of every app from its checkout,
+// apps that are torn down are left out.
+func getProjectsMetadataMap(apps *appRegistry, tornDown map[string]bool) map[string]*uyghurs.ProjectMetadata {
+	projectsMetadataMap := make(map[string]*uyghurs.ProjectMetadata, 0)
+
+	for _, app := range apps.list() {
+		if tornDown[app.App] {
+			continue
+		}
 
-			dockerComposeBytes, fileErr := ioutil.ReadFile(dockerComposePath)
+		dockerComposePath := filepath.Join(apps.appDir(app), filepath.FromSlash(app.ComposeFile))
 
-			if fileErr != nil {
-				return fileErr
-			}
+		if _, fileErr := os.Stat(dockerComposePath); os.IsNotExist(fileErr) {
+			continue
+		}
 
-			var hongKongSettings uyghurs.HongKongSettings
+		dockerComposeBytes, err := ioutil.ReadFile(dockerComposePath)
 
-			fileErr = yaml.Unmarshal(dockerComposeBytes, &hongKongSettings)
+		if err != nil {
+			panic(err)
+		}
 
-			if fileErr != nil {
-				return fileErr
-			}
+		var hongKongSettings uyghurs.HongKongSettings
 
-			hongKongSettings.HongKongProjectSettings.ProjectName = filepath.Base(path)
+		err = yaml.Unmarshal(dockerComposeBytes, &hongKongSettings)
 
-			projectsMetadataMap[filepath.Base(path)] = &hongKongSettings.HongKongProjectSettings
+		if err != nil {
+			panic(err)
 		}
 
-		return nil
-	})
+		hongKongSettings.HongKongProjectSettings.ProjectName = app.App
 
-	if err != nil {
-		panic(err)
+		projectsMetadataMap[app.App] = &hongKongSettings.HongKongProjectSettings
 	}
 
 	return projectsMetadataMap
@@ -152,6 +202,41 @@ func main() {
 
 	port := flag.Int("p", 8443, "port to run on")
 
+	dataDir := flag.String("data", "data/", "directory to keep persistent server state in")
+
+	pingInterval := flag.Duration("ping-interval", 15*time.Second, "how often workers are sent heartbeats")
+
+	workerTimeout := flag.Duration("worker-timeout", 45*time.Second, "how long a worker can go without answering heartbeats before it is declared dead")
+
+	leaseDuration := flag.Duration("lease", 30*time.Minute, "how long a worker has to answer a work request before it is retried")
+
+	maxAttempts := flag.Int("max-attempts", 5, "how many times a work request is dispatched before it is marked failed")
+	maxDeploys := flag.Int("max-deploys", 2, "how many projects can be deployed at once")
+
+	maxPulls := flag.Int("max-pulls", 3, "how many images can be pulled at once")
+
+	pullTimeout := flag.Duration("pull-timeout", 10*time.Minute, "how long pulling a deploy's images may take unless an app sets its own")
+
+	approvalTimeout := flag.Duration("approval-timeout", 24*time.Hour, "how long builds of apps that need approval wait for it unless an app sets its own")
+
+	keepImages := flag.Int("keep-images", 5, "how many released images of every build are kept unless an app sets its own, 0 keeps every image")
+
+	imageCleanupInterval := flag.Duration("image-cleanup-interval", 6*time.Hour, "how often old images are cleaned up besides after every deploy")
+
+	appsConfig := flag.String("apps-config", "apps.yml", "file registering the repositories to deploy and their apps")
+
+	defaultRegistry := flag.String("registry", "docker.io/therileyjohnson", "registry namespace images are pushed to unless an app names its own")
+
+	defaultImageTemplate := flag.String("image-template", uyghurs.DefaultImageTemplate, "how images are named unless an app names its own, {registry}, {app} and {build} are filled in")
+
+	dockerConfig := flag.String("docker-config", defaultDockerConfigPath(), "docker config.json to read registry credentials from")
+
+	registrySecrets := flag.String("registry-secrets", "registries.yml", "file with registry credentials, used over the ones in the docker config")
+
+	maxDeliveryAge := flag.Duration("max-delivery-age", 24*time.Hour, "how long after an event its webhook is still accepted")
+
+	serverURL := flag.String("server", "", "server that commands like secrets are run against, by default this one, at the host its TLS certificate is for")
+
 	flag.Parse()
 
 	if *envFile {
@@ -162,6 +247,27 @@ func main() {
 		}
 	}
 
+	// Given a command the binary is a client of a running server instead
+	if flag.NArg() != 0 {
+		if *serverURL == "" {
+			var err error
+
+			*serverURL, err = defaultServerURL(*port, *development)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		err := runCLI(flag.Args(), *serverURL, strings.Trim(os.Getenv("ADMIN_SECRET"), "\r\n"))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
 	envVars := make(map[string]string)
 
 	for _, envVarKey := range []string{"GITHUB_SECRET", "HONG_KONG_SECRET", "ROUTER_SECRET"} {
@@ -175,385 +281,2085 @@ func main() {
 		envVars[envVarKey] = strings.Trim(envVarValue, "\r\n")
 	}
 
+	// The admin API is optional, without a secret it is disabled
+	adminSecret := strings.Trim(os.Getenv("ADMIN_SECRET"), "\r\n")
+
+	if adminSecret == "" {
+		fmt.Println(`environmental variable "ADMIN_SECRET" is not set, the admin API is disabled`)
+	}
+
 	githubSecret := envVars["GITHUB_SECRET"]
 	hongKongSecret := envVars["HONG_KONG_SECRET"]
 	routerSecret := envVars["ROUTER_SECRET"]
 
+	// The key secrets are encrypted with is optional, without it no secrets
+	// can be set
+	uyghursSecrets := uyghurs.UyghursSecrets{
+		UyghursKey: strings.Trim(os.Getenv("UYGHURS_KEY"), "\r\n"),
+	}
+
 	///
 
-	projectsMetadata := newProjectMetadataHandler("apps/", *development)
+	defaultComposeFile := "docker-compose.yml"
 
-	cli, err := client.NewEnvClient()
+	if *development {
+		defaultComposeFile = "docker-compose.dev.yml"
+	}
+
+	err := validateImageTemplate(*defaultImageTemplate, *defaultRegistry, "app")
 
 	if err != nil {
-		panic(err)
+		log.Fatalf("invalid -image-template: %s", err)
 	}
 
-	server := gin.Default()
+	apps, err := loadAppRegistry(*appsConfig, "apps/", appConfig{
+		ComposeFile:     defaultComposeFile,
+		Registry:        *defaultRegistry,
+		ImageTemplate:   *defaultImageTemplate,
+		PullTimeout:     pullTimeout.String(),
+		KeepImages:      *keepImages,
+		ApprovalTimeout: approvalTimeout.String(),
+	})
 
-	isServerErr := func(c *gin.Context, err error) bool {
-		if err != nil {
-			fmt.Println("ERR:", err)
+	if err != nil {
+		panic(err)
+	}
 
-			c.AbortWithStatus(http.StatusInternalServerError)
+	if len(apps.list()) == 0 {
+		fmt.Printf("no apps are registered in %s, every webhook will be rejected\n", *appsConfig)
+	}
 
-			return true
-		}
+	teardowns, err := newTeardownStore(filepath.Join(*dataDir, "teardowns.json"))
 
-		return false
+	if err != nil {
+		panic(err)
 	}
 
-	workerWebsocketHandler := melody.New()
-	routerWebsocketHandler := melody.New()
+	projectsMetadata := newProjectMetadataHandler(apps, teardowns.tornDown())
 
-	workerWebsocketHandler.Config.MaxMessageSize = 10240
+	cli, err := client.NewEnvClient()
 
-	var workerConnection *melody.Session
+	if err != nil {
+		panic(err)
+	}
 
-	server.GET("/worker/:hongKongSecret", func(c *gin.Context) {
-		hongKongRequestSecret := c.Param("hongKongSecret")
+	credentials, err := loadRegistryCredentials(*dockerConfig, *registrySecrets)
 
-		if hongKongRequestSecret != hongKongSecret {
-			fmt.Println("bad worker connection request, aborting...")
+	if err != nil {
+		panic(err)
+	}
 
-			c.AbortWithStatus(http.StatusInternalServerError)
+	if registryHosts := credentials.hosts(); len(registryHosts) != 0 {
+		sort.Strings(registryHosts)
 
-			return
-		}
+		fmt.Println("using credentials for registries:", strings.Join(registryHosts, ", "))
+	}
 
-		workerWebsocketHandler.HandleRequest(c.Writer, c.Request)
-	})
+	puller := newImagePuller(cli, credentials, *maxPulls)
 
-	workerWebsocketHandler.HandleConnect(func(s *melody.Session) {
-		if workerConnection != nil {
-			// Unknown connector, ignore
-			s.Close()
+	reconciler := newComposeReconciler(cli, puller)
 
-			return
-		}
+	deployExecutor := newDeployExecutor(*maxDeploys)
 
-		fmt.Println("Worker connected!")
+	queue, err := newWorkQueue(filepath.Join(*dataDir, "queue.json"), *leaseDuration, *maxAttempts)
 
-		workerConnection = s
-	})
+	if err != nil {
+		panic(err)
+	}
 
-	workerWebsocketHandler.HandleDisconnect(func(s *melody.Session) {
-		workerConnection = nil
+	buildLogs, err := newBuildLogStore(filepath.Join(*dataDir, "logs"))
 
-		fmt.Println("Worker disconnected!")
-	})
+	if err != nil {
+		panic(err)
+	}
 
-	workerWebsocketHandler.HandleMessage(func(s *melody.Session, msg []byte) {
-		if s == workerConnection {
-			var workerMessage uyghurs.WorkerMessage
+	deliveries, err := newDeliveryStore(filepath.Join(*dataDir, "deliveries"))
 
-			err := json.Unmarshal(msg, &workerMessage)
+	if err != nil {
+		panic(err)
+	}
 
-			if err != nil {
-				fmt.Println("Error unmarshalling worker message:", err)
+	releases, err := newReleaseStore(filepath.Join(*dataDir, "releases.json"))
 
-				return
-			}
+	if err != nil {
+		panic(err)
+	}
 
-			switch uyghurs.WorkerMessageType(workerMessage.Type) {
-			case uyghurs.WorkResponseType:
-				var messageData uyghurs.WorkResponse
+	secrets, err := newSecretStore(filepath.Join(*dataDir, "secrets.json"), uyghursSecrets)
 
-				err := mapstructure.Decode(workerMessage.MessageData, &messageData)
+	if err != nil {
+		log.Fatalf("error loading secrets: %s", err)
+	}
 
-				if err != nil {
-					fmt.Println("Error parsing worker work response:", err, string(msg))
+	if uyghursSecrets.UyghursKey == "" {
+		fmt.Println("UYGHURS_KEY is not set, app secrets can't be set or deployed")
+	}
 
-					return
-				}
+	cleaner := newImageCleaner(cli, releases)
 
-				if messageData.Err != "" {
-					fmt.Println("Error with worker work response:", messageData.Err)
+	cleanUpImages := func(cleanApps []*appConfig) {
+		cleanupContext, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
 
-					return
-				}
+		defer cancel()
 
-				fmt.Println("Received WorkResponse")
+		report, err := cleaner.cleanup(cleanupContext, cleanApps, false)
 
-				for _, hongKongBuildSetting := range messageData.ProjectMetadata.BuildsInfo {
-					timeoutContext, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err != nil {
+			fmt.Println("error cleaning up images:", err)
 
-					type pullResponse struct {
-						err error
-					}
+			return
+		}
 
-					responseChan := make(chan pullResponse)
+		for _, entry := range report.Images {
+			switch entry.Action {
+			case imageRemoved:
+				fmt.Printf("removed image %s of %s %s\n", entry.ImageID, entry.App, entry.Build)
+			case imageFailed:
+				fmt.Printf("error removing image %s of %s %s: %s\n", entry.ImageID, entry.App, entry.Build, entry.Err)
+			}
+		}
+	}
 
-					go func() {
-						imagePullResponse, err := cli.ImagePull(
-							timeoutContext,
-							fmt.Sprintf("docker.io/therileyjohnson/%s_%s:latest", messageData.GithubData.Repository.Name, hongKongBuildSetting.Name),
-							types.ImagePullOptions{
-								All: true,
-							},
-						)
+	if *imageCleanupInterval > 0 {
+		go func() {
+			for range time.Tick(*imageCleanupInterval) {
+				cleanUpImages(apps.list())
+			}
+		}()
+	}
 
-						io.Copy(ioutil.Discard, imagePullResponse)
+	server := gin.Default()
 
-						responseChan <- pullResponse{err}
-					}()
+	adminRoutes := server.Group("/", func(c *gin.Context) {
+		if adminSecret == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": "the admin API is disabled, ADMIN_SECRET is not set"})
 
-					var pushErr error
+			return
+		}
 
-					select {
-					case <-timeoutContext.Done():
-						pushErr = timeoutContext.Err()
+		authorizationHeader := c.Request.Header.Get("Authorization")
 
-						if pushErr != nil {
-							fmt.Println("pulling image timed out")
-						}
-					case responseInfo := <-responseChan:
-						pushErr = responseInfo.err
-					}
+		if subtle.ConstantTimeCompare([]byte(authorizationHeader), []byte("Bearer "+adminSecret)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
 
-					cancel()
+			return
+		}
+	})
 
-					if pushErr != nil {
-						fmt.Println("error pulling image:", pushErr)
+	isServerErr := func(c *gin.Context, err error) bool {
+		if err != nil {
+			fmt.Println("ERR:", err)
 
-						return
-					}
+			c.AbortWithStatus(http.StatusInternalServerError)
 
-					fmt.Println("pulled image successfully")
-				}
+			return true
+		}
 
-				workingDir, err := os.Getwd()
+		return false
+	}
 
-				if err != nil {
-					fmt.Println("error getting current working dir:", err)
+	workerWebsocketHandler := melody.New()
+	routerWebsocketHandler := melody.New()
 
-					return
-				}
+	workerWebsocketHandler.Config.MaxMessageSize = 10240
 
-				appWorkingDir := path.Join(workingDir, fmt.Sprintf("apps/%s", messageData.GithubData.Repository.Name))
+	workers := newWorkerPool()
 
-				// appRepo, err := git.PlainOpen(appWorkingDir)
+	drainQueue := func() {
+		err := queue.drain(func(job *workJob) (string, string, error) {
+			workerRequestBytes, err := uyghurs.MarshalWorkerMessage(job.WorkRequest)
 
-				// if err != nil {
-				// 	fmt.Println("error opening dir for git:", err)
+			if err != nil {
+				return "", "", err
+			}
 
-				// 	return
-				// }
+			workerName, workerID, err := workers.dispatch(job.ID, workerRequestBytes)
 
-				// appRepo.Fetch(&git.FetchOptions{})
+			if err != nil {
+				return "", "", err
+			}
 
-				// if err != nil {
-				// 	fmt.Println("error pulling origin for app git repo:", err)
+			fmt.Printf("sent job %s for %s to %s\n", job.ID, job.WorkRequest.GithubData.Repository.Name, workerName)
 
-				// 	return
-				// }
+			return workerName, workerID, nil
+		})
 
-				// appRepoHead, err := appRepo.Head()
+		if err != nil && err != errNoIdleWorker {
+			fmt.Println("error draining work queue:", err)
+		}
+	}
 
-				// if err != nil {
-				// 	fmt.Println("error getting HEAD for app git repo:", err)
+	// requeueWork puts the job of a worker that went away back in the queue
+	// and ends the build logs it was still sending
+	requeueWork := func(deadWorker *worker) {
+		buildLogs.abandon(deadWorker, fmt.Sprintf("worker %s went away", deadWorker.name))
 
-				// 	return
-				// }
+		if deadWorker.assignment == "" {
+			return
+		}
 
-				// appWorkTree, err := appRepo.Worktree()
+		err := queue.release(deadWorker.assignment, fmt.Sprintf("worker %s went away", deadWorker.name))
 
-				// if err != nil {
-				// 	fmt.Println("error getting working tree for app git repo:", err)
+		if err != nil && err != errJobNotFound {
+			fmt.Printf("error releasing job %s from worker %s: %s\n", deadWorker.assignment, deadWorker.name, err)
+		}
+	}
 
-				// 	return
-				// }
+	go func() {
+		for range time.Tick(*pingInterval) {
+			for _, deadWorker := range workers.removeDeadWorkers(*workerTimeout) {
+				fmt.Printf("Worker %s missed heartbeats, declaring it dead\n", deadWorker.name)
 
-				// appWorkTree.Reset(&git.ResetOptions{
-				// 	Commit: appRepoHead.Hash(),
-				// 	Mode:   git.HardReset,
-				// })
+				deadWorker.session.Close()
 
-				// if err != nil {
-				// 	fmt.Println("error pulling origin for app git repo:", err)
+				requeueWork(deadWorker)
+			}
 
-				// 	return
-				// }
+			expiredJobIDs, err := queue.expireLeases()
 
-				gitPullCommand := exec.Command("git", "pull")
+			if err != nil {
+				fmt.Println("error expiring job leases:", err)
+			}
 
-				gitPullCommand.Dir = appWorkingDir
+			for _, expiredJobID := range expiredJobIDs {
+				workers.dropAssignment(expiredJobID)
+			}
 
-				err = gitPullCommand.Run()
+			expiredReleases, err := releases.expireApprovals()
 
-				if err != nil {
-					fmt.Println("error pulling app repo:", err)
+			if err != nil {
+				fmt.Println("error expiring releases waiting for approval:", err)
+			}
 
-					return
-				}
+			for _, expiredRelease := range expiredReleases {
+				fmt.Printf("release %s of %s expired without being approved\n", expiredRelease.ID, expiredRelease.App)
 
-				dockerComposeCommand := exec.Command("docker-compose", "up", "-d")
+				err = queue.discardApproval(expiredRelease.JobID, expiredRelease.Err)
 
-				dockerComposeCommand.Dir = appWorkingDir
+				if err != nil && err != errJobNotFound {
+					fmt.Printf("error finishing job %s: %s\n", expiredRelease.JobID, err)
+				}
+			}
 
-				err = dockerComposeCommand.Run()
+			pingRequestBytes, err := uyghurs.MarshalWorkerMessage(uyghurs.PingRequest{
+				SentAt: time.Now().Unix(),
+			})
 
-				if err != nil {
-					fmt.Println("error running docker-compose:", err)
+			if err != nil {
+				fmt.Println("error marshalling ping request:", err)
 
-					return
-				}
+				continue
+			}
 
-				fmt.Println("brought up docker-compose for:", messageData.GithubData.Repository.Name)
+			workers.broadcast(pingRequestBytes)
 
-				projectsMetadata.updateProjectMetadata(&messageData.ProjectMetadata)
+			drainQueue()
+		}
+	}()
 
-				fmt.Printf("notified RJserver of route changes for %s\n", messageData.GithubData.Repository.Name)
-			case uyghurs.PingResponseType:
-				fmt.Println("Received PingResponse")
-			default:
-				fmt.Println("Unknown worker message type:", workerMessage.Type)
+	server.GET("/worker/:hongKongSecret", func(c *gin.Context) {
+		hongKongRequestSecret := c.Param("hongKongSecret")
 
-				return
-			}
-		}
-	})
+		if hongKongRequestSecret != hongKongSecret {
+			fmt.Println("bad worker connection request, aborting...")
 
-	routerWebsocketHandler.HandleConnect(func(s *melody.Session) {
-		if projectsMetadata.routerConnection != nil {
-			// Unknown connector, ignore
-			s.Close()
+			c.AbortWithStatus(http.StatusInternalServerError)
 
 			return
 		}
 
-		projectsMetadata.routerConnection = s
+		workerWebsocketHandler.HandleRequest(c.Writer, c.Request)
+	})
+
+	rejectWorker := func(s *melody.Session, reason string) {
+		fmt.Println("rejecting worker:", reason)
+
+		handshakeResponseBytes, err := uyghurs.MarshalWorkerMessage(uyghurs.HandshakeResponse{
+			ProtocolVersion: uyghurs.ProtocolVersion,
+			Accepted:        false,
+			Err:             reason,
+		})
+
+		if err == nil {
+			s.Write(handshakeResponseBytes)
+		}
+
+		if rejectedWorker := workers.removeWorker(s); rejectedWorker != nil {
+			requeueWork(rejectedWorker)
+		}
+
+		s.Close()
+	}
+
+	workerWebsocketHandler.HandleConnect(func(s *melody.Session) {
+		connectedWorker := workers.addWorker(s)
+
+		fmt.Printf("Worker %s connected, waiting for handshake\n", connectedWorker.name)
+	})
+
+	workerWebsocketHandler.HandleDisconnect(func(s *melody.Session) {
+		disconnectedWorker := workers.removeWorker(s)
+
+		if disconnectedWorker == nil {
+			return
+		}
+
+		fmt.Printf("Worker %s disconnected!\n", disconnectedWorker.name)
+
+		requeueWork(disconnectedWorker)
+
+		go drainQueue()
+	})
+
+	// appWorkingDir is the absolute path of the app's checkout.
+	appWorkingDir := func(app *appConfig) (string, error) {
+		workingDir, err := os.Getwd()
+
+		if err != nil {
+			return "", fmt.Errorf("error getting current working dir: %w", err)
+		}
+
+		return filepath.Join(workingDir, apps.appDir(app)), nil
+	}
+
+	// loadAppProject loads the app's compose file with the secrets of its
+	// environment, which never leave memory
+	loadAppProject := func(app *appConfig, appDir string) (*composeProject, error) {
+		secretEnvironment, err := secrets.environment(app.App, app.Environment)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return loadComposeProject(app.App, appDir, app.ComposeFile, secretEnvironment)
+	}
+
+	// rollBack brings an app back to an earlier release, checking out the
+	// compose file it ran with and pinning its services to the exact images.
+	rollBack := func(ctx context.Context, app *appConfig, target *release) ([]serviceResult, error) {
+		appDir, err := appWorkingDir(app)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkoutCommit(appDir, target.ComposeRevision)
+
+		if err != nil {
+			return nil, err
+		}
+
+		project, err := loadAppProject(app, appDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		serviceResults, err := reconciler.reconcile(ctx, project, target.Commit, target.Images)
+
+		if err != nil {
+			return serviceResults, err
+		}
+
+		return serviceResults, reconciler.waitReady(ctx, serviceResults, target.ProjectMetadata.Readiness)
+	}
+
+	// deployBuild brings up what a worker built on this host. Images are
+	// deployed by the commit they were built at, never by a moving tag, so
+	// the compose file and images always match.
+	deployBuild := func(ctx context.Context, app *appConfig, newRelease *release, workResponse *uyghurs.WorkResponse) ([]serviceResult, error) {
+		builtImages := make(map[string]string)
+
+		buildImages := make(map[string]string)
+
+		images := make([]string, 0, len(workResponse.ProjectMetadata.BuildsInfo))
+
+		for _, hongKongBuildSetting := range workResponse.ProjectMetadata.BuildsInfo {
+			image, err := app.buildImage(hongKongBuildSetting.Name, newRelease.Commit, workResponse.Images)
+
+			if err != nil {
+				return nil, err
+			}
+
+			images = append(images, image)
+
+			buildImages[hongKongBuildSetting.Name] = image
+
+			builtImages[imageRepository(app.imageName(hongKongBuildSetting.Name))] = image
+		}
+
+		pullContext, cancel := context.WithTimeout(ctx, app.pullTimeout())
+
+		err := puller.pullAll(pullContext, images)
+
+		cancel()
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("pulled %d images for %s\n", len(images), app.App)
+
+		appDir, err := appWorkingDir(app)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = checkoutCommit(appDir, newRelease.Commit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		project, err := loadAppProject(app, appDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		hooks := newRelease.ProjectMetadata.Hooks
+
+		err = validateHooks(hooks, project, newRelease.ProjectMetadata.BuildsInfo)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = validateReadiness(newRelease.ProjectMetadata.Readiness, project)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if hooks != nil && len(hooks.PreDeploy) != 0 {
+			// Hooks like migrations need the project's networks and volumes,
+			// creating them leaves the running containers alone
+			err = reconciler.prepare(ctx, project)
+
+			if err != nil {
+				return nil, err
+			}
+
+			hookResults, err := reconciler.runHooks(ctx, project, preDeployHook, hooks.PreDeploy, newRelease.Commit, buildImages)
+
+			newRelease.Hooks = append(newRelease.Hooks, hookResults...)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		serviceResults, err := reconciler.reconcile(ctx, project, newRelease.Commit, pinnedImages(project, builtImages))
+
+		if err != nil {
+			return serviceResults, err
+		}
+
+		err = reconciler.waitReady(ctx, serviceResults, newRelease.ProjectMetadata.Readiness)
+
+		if err != nil {
+			return serviceResults, err
+		}
+
+		if hooks != nil && len(hooks.PostDeploy) != 0 {
+			// The deploy is ready and stays, a failing post-deploy hook is
+			// only recorded
+			hookResults, err := reconciler.runHooks(ctx, project, postDeployHook, hooks.PostDeploy, newRelease.Commit, buildImages)
+
+			newRelease.Hooks = append(newRelease.Hooks, hookResults...)
+
+			if err != nil {
+				fmt.Printf("deploy of %s is up but %s\n", app.App, err)
+			}
+		}
+
+		return serviceResults, nil
+	}
+
+	// deployRelease brings up a started release, by rolling back to an
+	// earlier release's images and compose revision if rollBackTo is given or
+	// by deploying what a worker built otherwise. A release that doesn't come
+	// up ready is rolled back to the app's last known-good release, only a
+	// ready release gets its routes sent to the router. A failing pre-deploy
+	// hook leaves the containers as they were, so only the checkout is put
+	// back and the release fails without a rollback.
+	deployRelease := func(app *appConfig, newRelease *release, rollBackTo *release, workResponse *uyghurs.WorkResponse) error {
+		knownGood, hasKnownGood := releases.lastKnownGood(app.App)
+
+		reconcileContext, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+
+		defer cancel()
+
+		appDir, err := appWorkingDir(app)
+
+		previousRevision := ""
+
+		if err == nil {
+			previousRevision, _ = checkoutRevision(appDir)
+		}
+
+		if err == nil && rollBackTo != nil {
+			newRelease.Services, err = rollBack(reconcileContext, app, rollBackTo)
+		} else if err == nil {
+			newRelease.Services, err = deployBuild(reconcileContext, app, newRelease, workResponse)
+		}
+
+		if err == nil {
+			newRelease.ComposeRevision, err = checkoutRevision(appDir)
+		}
+
+		if errors.Is(err, errHookFailed) {
+			fmt.Printf("deploy of %s failed before touching its containers: %s\n", app.App, err)
+
+			if previousRevision != "" {
+				restoreErr := checkoutCommit(appDir, previousRevision)
+
+				if restoreErr != nil {
+					err = fmt.Errorf("%w; restoring the checkout to %s failed: %v", err, previousRevision, restoreErr)
+				}
+			}
+		} else if err != nil && hasKnownGood && (rollBackTo == nil || knownGood.ID != rollBackTo.ID) {
+			fmt.Printf("deploy of %s failed, rolling back to %s: %s\n", app.App, knownGood.Commit, err)
+
+			_, rollBackErr := rollBack(reconcileContext, app, knownGood)
+
+			if rollBackErr != nil {
+				err = fmt.Errorf("%w; rolling back to %s failed: %v", err, knownGood.Commit, rollBackErr)
+			} else {
+				newRelease.RolledBackTo = knownGood.ID
+
+				err = fmt.Errorf("%w; rolled back to %s", err, knownGood.Commit)
+			}
+		}
+
+		errString := ""
+
+		if err != nil {
+			errString = err.Error()
+		} else {
+			newRelease.Images = make(map[string]string)
+
+			for _, serviceResult := range newRelease.Services {
+				if serviceResult.ImageID != "" {
+					newRelease.Images[serviceResult.Service] = serviceResult.ImageID
+				}
+			}
+		}
+
+		finishErr := releases.finish(newRelease, errString)
+
+		if finishErr != nil {
+			fmt.Printf("error recording release %s of %s: %s\n", newRelease.ID, app.App, finishErr)
+		}
+
+		cleanUpImages([]*appConfig{app})
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("brought up services for:", app.App)
+
+		// Deploying an app that was torn down brings it back for good
+		err = teardowns.clear(app.App)
+
+		if err != nil {
+			fmt.Printf("error forgetting teardown of %s: %s\n", app.App, err)
+		}
+
+		projectMetadata := newRelease.ProjectMetadata
+
+		projectsMetadata.updateProjectMetadata(&projectMetadata)
+
+		fmt.Printf("notified RJserver of route changes for %s\n", app.App)
+
+		return nil
+	}
+
+	// jobRelease is the release of what a worker built for a job, it isn't
+	// recorded yet
+	jobRelease := func(job *workJob, workResponse *uyghurs.WorkResponse) (*appConfig, *release, error) {
+		app, err := apps.lookup(job.WorkRequest.GithubData.Repository.FullName)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !deployCommitRegex.MatchString(workResponse.GithubData.After) {
+			return nil, nil, fmt.Errorf("worker built invalid commit %q", workResponse.GithubData.After)
+		}
+
+		newRelease := &release{
+			App:             app.App,
+			Environment:     app.Environment,
+			JobID:           job.ID,
+			Trigger:         job.Trigger,
+			Ref:             workResponse.GithubData.Ref,
+			Commit:          workResponse.GithubData.After,
+			BuiltImages:     workResponse.Images,
+			ProjectMetadata: workResponse.ProjectMetadata,
+			QueuedAt:        job.QueuedAt,
+		}
+
+		newRelease.ProjectMetadata.ProjectName = app.App
+
+		return app, newRelease, nil
+	}
+
+	// deployJobRelease deploys the started release of a job, along with the
+	// commit the app was rolled back to if it didn't come up ready
+	deployJobRelease := func(app *appConfig, newRelease *release, workResponse *uyghurs.WorkResponse) ([]serviceResult, string, error) {
+		err := deployRelease(app, newRelease, nil, workResponse)
+
+		rolledBackTo := ""
+
+		if newRelease.RolledBackTo != "" {
+			if knownGood, err := releases.get(app.App, newRelease.RolledBackTo); err == nil {
+				rolledBackTo = knownGood.Commit
+			}
+		}
+
+		return newRelease.Services, rolledBackTo, err
+	}
+
+	// deployJob deploys what a worker built for a job as a new release, the
+	// commit the app was rolled back to is returned along with the error if
+	// it didn't come up ready.
+	deployJob := func(job *workJob, workResponse *uyghurs.WorkResponse) ([]serviceResult, string, error) {
+		app, newRelease, err := jobRelease(job, workResponse)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		err = releases.start(newRelease)
+
+		if err != nil {
+			return nil, "", fmt.Errorf("error recording release: %w", err)
+		}
+
+		return deployJobRelease(app, newRelease, workResponse)
+	}
+
+	finishJobDeploy := func(jobID string, serviceResults []serviceResult, rolledBackTo string, err error) {
+		errString := ""
+
+		if err != nil {
+			fmt.Printf("error deploying job %s: %s\n", jobID, err)
+
+			errString = err.Error()
+		}
+
+		err = queue.finishDeploy(jobID, errString, serviceResults, rolledBackTo)
+
+		if err != nil {
+			fmt.Printf("error finishing job %s: %s\n", jobID, err)
+		}
+	}
+
+	// awaitApproval records what a worker built for an app that needs every
+	// deploy approved, the release replaces any older one still waiting
+	awaitApproval := func(job *workJob, workResponse *uyghurs.WorkResponse) error {
+		app, newRelease, err := jobRelease(job, workResponse)
+
+		if err != nil {
+			return err
+		}
+
+		supersededReleases, err := releases.await(newRelease, time.Now().Add(app.approvalTimeout()))
+
+		if err != nil {
+			return fmt.Errorf("error recording release: %w", err)
+		}
+
+		for _, supersededRelease := range supersededReleases {
+			err = queue.discardApproval(supersededRelease.JobID, supersededRelease.Err)
+
+			if err != nil && err != errJobNotFound {
+				fmt.Printf("error finishing job %s: %s\n", supersededRelease.JobID, err)
+			}
+		}
+
+		err = queue.awaitApproval(job.ID)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("release %s of %s at %s is waiting for approval until %s\n", newRelease.ID, app.App, newRelease.Commit, newRelease.Approval.Deadline.Format(time.RFC3339))
+
+		return nil
+	}
+
+	workerWebsocketHandler.HandleMessage(func(s *melody.Session, msg []byte) {
+		if _, isWorker := workers.getWorker(s); isWorker {
+			var workerMessage uyghurs.WorkerMessage
+
+			err := json.Unmarshal(msg, &workerMessage)
+
+			if err != nil {
+				fmt.Println("Error unmarshalling worker message:", err)
+
+				return
+			}
+
+			if !uyghurs.ProtocolVersionSupported(workerMessage.Version) {
+				rejectWorker(s, fmt.Sprintf("unsupported protocol version %d, server supports versions %d to %d", workerMessage.Version, uyghurs.MinProtocolVersion, uyghurs.ProtocolVersion))
+
+				return
+			}
+
+			messageData, err := workerMessage.DecodeMessageData()
+
+			if err != nil {
+				fmt.Println("Error parsing worker message:", err, string(msg))
+
+				return
+			}
+
+			if handshakeRequest, isHandshake := messageData.(*uyghurs.HandshakeRequest); isHandshake {
+				if !uyghurs.ProtocolVersionSupported(handshakeRequest.ProtocolVersion) {
+					rejectWorker(s, fmt.Sprintf("unsupported protocol version %d, server supports versions %d to %d", handshakeRequest.ProtocolVersion, uyghurs.MinProtocolVersion, uyghurs.ProtocolVersion))
+
+					return
+				}
+
+				handshakeResponseBytes, err := uyghurs.MarshalWorkerMessage(uyghurs.HandshakeResponse{
+					ProtocolVersion: uyghurs.ProtocolVersion,
+					Accepted:        true,
+				})
+
+				if err != nil {
+					fmt.Println("error marshalling handshake response:", err)
+
+					return
+				}
+
+				err = s.Write(handshakeResponseBytes)
+
+				if err != nil {
+					fmt.Println("error writing handshake response:", err)
+
+					return
+				}
+
+				workers.completeHandshake(s, handshakeRequest.WorkerName)
+
+				fmt.Printf("Worker %s completed handshake with protocol version %d\n", handshakeRequest.WorkerName, handshakeRequest.ProtocolVersion)
+
+				drainQueue()
+
+				return
+			}
+
+			if !workers.isHandshaken(s) {
+				rejectWorker(s, "handshake required before any other message")
+
+				return
+			}
+
+			switch messageData := messageData.(type) {
+			case *uyghurs.WorkResponse:
+				if messageData.Busy {
+					busyWorker := workers.markBusy(s)
+
+					if busyWorker == nil {
+						return
+					}
+
+					err := queue.returnJob(messageData.JobID, busyWorker.id)
+
+					if err != nil {
+						fmt.Printf("error returning job %s that %s was too busy for: %s\n", messageData.JobID, busyWorker.name, err)
+
+						return
+					}
+
+					fmt.Printf("%s was too busy for job %s, it is back in the queue\n", busyWorker.name, messageData.JobID)
+
+					go drainQueue()
+
+					return
+				}
+
+				respondingWorker, connected := workers.getWorker(s)
+
+				if !connected {
+					return
+				}
+
+				if workers.finishWork(s, messageData.JobID) {
+					go drainQueue()
+				}
+
+				job, err := queue.complete(messageData.JobID, respondingWorker.id, messageData.Err)
+
+				if err == errJobNotFound {
+					fmt.Printf("ignoring work response for job %q, it already finished or is unknown\n", messageData.JobID)
+
+					return
+				}
+
+				if err == errNotLeaseHolder {
+					fmt.Printf("ignoring work response for job %q from %s, it doesn't hold the job's lease\n", messageData.JobID, respondingWorker.name)
+
+					return
+				}
+
+				if err != nil {
+					fmt.Printf("error completing job %s: %s\n", messageData.JobID, err)
+
+					return
+				}
+
+				if messageData.Err != "" {
+					fmt.Println("Error with worker work response:", messageData.Err)
+
+					return
+				}
+
+				fmt.Printf("Received WorkResponse for job %s\n", job.ID)
+
+				project := job.WorkRequest.App
+
+				if project == "" {
+					project = job.WorkRequest.GithubData.Repository.FullName
+				}
+
+				if app, err := apps.lookup(job.WorkRequest.GithubData.Repository.FullName); err == nil && app.RequireApproval {
+					err = awaitApproval(job, messageData)
+
+					if err != nil {
+						finishJobDeploy(job.ID, nil, "", err)
+					}
+
+					return
+				}
+
+				// Deploys run on the executor so a slow one doesn't hold up
+				// messages from every other worker
+				deployExecutor.submit(project, &deployTask{
+					name: "job " + job.ID,
+					run: func() {
+						serviceResults, rolledBackTo, err := deployJob(job, messageData)
+
+						finishJobDeploy(job.ID, serviceResults, rolledBackTo, err)
+					},
+					supersede: func(newerTask string) {
+						fmt.Printf("job %s of %s was superseded by %s\n", job.ID, project, newerTask)
+
+						err := queue.supersedeDeploy(job.ID, "superseded by "+newerTask)
+
+						if err != nil {
+							fmt.Printf("error finishing job %s: %s\n", job.ID, err)
+						}
+					},
+				})
+			case *uyghurs.PingResponse:
+				workers.recordPing(s, messageData.State)
+			case *uyghurs.BuildLog:
+				buildLogWorker, _ := workers.getWorker(s)
+
+				err := buildLogs.append(buildLogWorker, messageData.Repository, messageData.Commit, messageData.Sequence, messageData.Data, messageData.Final)
+
+				if err != nil {
+					fmt.Println("error storing build log:", err)
+				}
+			default:
+				fmt.Println("Unexpected worker message type:", workerMessage.Type)
+
+				return
+			}
+		}
+	})
+
+	routerWebsocketHandler.HandleConnect(func(s *melody.Session) {
+		if !projectsMetadata.setRouterConnection(s) {
+			// Unknown connector, ignore
+			s.Close()
+
+			return
+		}
 
 		fmt.Println("Router connected!")
 
-		routerRequestBytes, err := json.MarshalIndent(projectsMetadata.getAllProjectsMetadata(), "", "    ")
+		routerRequestBytes, err := json.MarshalIndent(projectsMetadata.getAllProjectsMetadata(), "", "    ")
+
+		if err != nil {
+			log.Println("error occurred marshalling JSON for router:", err)
+		}
+
+		err = s.Write(routerRequestBytes)
+
+		if err != nil {
+			log.Println("error occurred writing JSON for router:", err)
+		}
+
+		log.Println("Sent route info to router!")
+	})
+
+	routerWebsocketHandler.HandleDisconnect(func(s *melody.Session) {
+		projectsMetadata.clearRouterConnection(s)
+
+		fmt.Println("Router disconnected!")
+	})
+
+	server.GET("/router/:routerSecret", func(c *gin.Context) {
+		routerSecretString := c.Param("routerSecret")
+
+		if routerSecretString != routerSecret {
+			fmt.Println("bad router connection request, aborting...")
+
+			c.AbortWithStatus(http.StatusInternalServerError)
+
+			return
+		}
+
+		routerWebsocketHandler.HandleRequest(c.Writer, c.Request)
+	})
+
+	// tearDown takes an app down, its routes are removed first so the router
+	// stops sending it traffic before its containers go away
+	tearDown := func(app *appConfig, trigger string, removeVolumes bool) *teardown {
+		appTeardown := &teardown{
+			App:           app.App,
+			Project:       composeProjectName(app.App),
+			Environment:   app.Environment,
+			Trigger:       trigger,
+			RemoveVolumes: removeVolumes,
+			StartedAt:     time.Now(),
+		}
+
+		appTeardown.Routes = projectsMetadata.removeProjectMetadata(app.App)
+
+		fmt.Printf("notified RJserver of route removal for %s\n", app.App)
+
+		teardownContext, cancel := context.WithTimeout(context.Background(), 15*time.Minute)
+
+		defer cancel()
+
+		err := reconciler.teardown(teardownContext, appTeardown)
+
+		appTeardown.NothingRemoved = appTeardown.Routes == 0 && len(appTeardown.Containers) == 0 && len(appTeardown.Networks) == 0 && len(appTeardown.Volumes) == 0
+
+		switch {
+		case err != nil:
+			appTeardown.Err = err.Error()
+
+			fmt.Printf("error tearing down %s: %s\n", app.App, err)
+		case appTeardown.NothingRemoved:
+			fmt.Printf("tore down %s, but found no routes or containers, networks or volumes of project %s to remove\n", app.App, appTeardown.Project)
+		default:
+			fmt.Printf("tore down %s, removed %d containers\n", app.App, len(appTeardown.Containers))
+		}
+
+		appTeardown.FinishedAt = time.Now()
+
+		err = teardowns.record(appTeardown)
+
+		if err != nil {
+			fmt.Printf("error recording teardown of %s: %s\n", app.App, err)
+		}
+
+		return appTeardown
+	}
+
+	// submitTeardown tears an app down on the executor, so it waits for a
+	// running deploy of the app and replaces one that hasn't started. The
+	// teardown is sent on the returned channel once it's done, or nil if a
+	// newer deploy replaced it before it started
+	submitTeardown := func(app *appConfig, trigger string, removeVolumes bool) <-chan *teardown {
+		done := make(chan *teardown, 1)
+
+		deployExecutor.submit(app.App, &deployTask{
+			name: "teardown of " + app.App,
+			run: func() {
+				done <- tearDown(app, trigger, removeVolumes)
+			},
+			supersede: func(newerTask string) {
+				fmt.Printf("teardown of %s was superseded by %s\n", app.App, newerTask)
+
+				done <- nil
+			},
+		})
+
+		return done
+	}
+
+	// tearDownDeletedBranch tears down an app outside of production when the
+	// branch its current release was deployed from is deleted, its volumes
+	// are kept
+	tearDownDeletedBranch := func(app *appConfig, githubPush uyghurs.GithubPush, trigger string) (int, gin.H, error) {
+		if app.Environment == productionEnvironment {
+			return http.StatusOK, gin.H{"status": "ignored", "reason": fmt.Sprintf("%s was deleted, production apps aren't torn down by deleting a branch", githubPush.Ref)}, nil
+		}
+
+		if !strings.HasPrefix(githubPush.Ref, branchRefPrefix) {
+			return http.StatusOK, gin.H{"status": "ignored", "reason": fmt.Sprintf("%s was deleted", githubPush.Ref)}, nil
+		}
+
+		// GitHub sends both a push and a delete event for a deleted branch,
+		// whichever comes second finds the app already gone
+		if _, deployed := projectsMetadata.getProjectMetadata(app.App); !deployed {
+			return http.StatusOK, gin.H{"status": "ignored", "reason": fmt.Sprintf("%s was deleted, %s isn't deployed", githubPush.Ref, app.App)}, nil
+		}
+
+		// Other branches the deploy rules match may be deleted while the app
+		// runs something else, only losing the branch it runs takes it down
+		if currentRelease, exists := releases.lastKnownGood(app.App); !exists || currentRelease.Ref != githubPush.Ref {
+			return http.StatusOK, gin.H{"status": "ignored", "reason": fmt.Sprintf("%s was deleted, %s isn't running a release of it", githubPush.Ref, app.App)}, nil
+		}
+
+		fmt.Printf("%s of %s was deleted, tearing down %s\n", githubPush.Ref, githubPush.Repository.Name, app.App)
+
+		submitTeardown(app, trigger, false)
+
+		return http.StatusAccepted, gin.H{"status": "tearing-down", "app": app.App}, nil
+	}
+
+	queueWork := func(app *appConfig, githubPush uyghurs.GithubPush, trigger string, deploy bool, reason string) (int, gin.H, error) {
+		workRequest := app.workRequest(githubPush)
+
+		if !deploy {
+			job, err := queue.skip(workRequest, trigger, reason)
+
+			if err != nil {
+				return 0, nil, err
+			}
+
+			fmt.Printf("skipped %s of %s: %s\n", githubPush.Ref, githubPush.Repository.Name, reason)
+
+			return http.StatusOK, gin.H{"status": jobSkipped, "jobId": job.ID, "reason": reason}, nil
+		}
+
+		job, err := queue.push(workRequest, trigger)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		fmt.Printf("queued job %s for %s: %s\n", job.ID, githubPush.Repository.Name, reason)
+
+		drainQueue()
+
+		return http.StatusAccepted, gin.H{"status": jobPending, "jobId": job.ID}, nil
+	}
+
+	// handleWebhookEvent acts on an event, source names the delivery it came
+	// in for the jobs it queues.
+	handleWebhookEvent := func(event *webhookEvent, source string) (int, gin.H, error) {
+		// Pings are answered whatever the repository, hosts send them when a
+		// webhook is set up, before it is added to apps.yml, and Bitbucket's
+		// test deliveries don't name a repository at all
+		if event.Kind == pingEvent {
+			repositoryName := event.Push.Repository.FullName
+
+			if repositoryName == "" {
+				repositoryName = "an unnamed repository"
+			}
+
+			fmt.Printf("received ping for %s: %s\n", repositoryName, event.Message)
+
+			return http.StatusOK, gin.H{"status": "pong"}, nil
+		}
+
+		app, err := apps.lookup(event.Push.Repository.FullName)
+
+		if err != nil {
+			fmt.Printf("rejected %s event: %s\n", event.Kind, err)
+
+			return http.StatusForbidden, gin.H{"err": err.Error()}, nil
+		}
+
+		var deployRules *uyghurs.DeployRules
+
+		if projectMetadata, exists := projectsMetadata.getProjectMetadata(app.App); exists {
+			deployRules = projectMetadata.DeployRules
+		}
+
+		switch event.Kind {
+		case pushEvent:
+			if event.Push.Deleted {
+				return tearDownDeletedBranch(app, event.Push, fmt.Sprintf("%s event in %s", event.Kind, source))
+			}
+
+			deploy, reason := shouldDeploy(deployRules, event.Push.Ref, event.Push.Repository.DefaultBranch)
+
+			return queueWork(app, event.Push, fmt.Sprintf("%s event in %s", event.Kind, source), deploy, reason)
+		case refCreateEvent:
+			// Creating a ref also sends a push event, which is what deploys it
+			fmt.Printf("%s %s created in %s\n", event.RefType, event.Push.Ref, event.Push.Repository.Name)
+
+			return http.StatusOK, gin.H{"status": "ignored", "reason": fmt.Sprintf("%s %s is deployed by its push event", event.RefType, event.Push.Ref)}, nil
+		case refDeleteEvent:
+			fmt.Printf("%s %s deleted in %s\n", event.RefType, event.Push.Ref, event.Push.Repository.Name)
+
+			return tearDownDeletedBranch(app, event.Push, fmt.Sprintf("%s event in %s", event.Kind, source))
+		case releaseEvent:
+			if event.Action != "published" {
+				return http.StatusOK, gin.H{"status": "ignored", "reason": fmt.Sprintf("release was %s, only published releases deploy", event.Action)}, nil
+			}
+
+			deploy, reason := false, "the project's deploy rules don't deploy releases"
+
+			if deployRules != nil && deployRules.Releases {
+				deploy, reason = true, fmt.Sprintf("release of %s was published", event.Push.Ref)
+			}
+
+			return queueWork(app, event.Push, fmt.Sprintf("%s event in %s", event.Kind, source), deploy, reason)
+		default:
+			return http.StatusBadRequest, gin.H{"err": fmt.Sprintf("unhandled event %q", event.Kind)}, nil
+		}
+	}
+
+	webhookProviders := map[string]webhookProvider{
+		"github": newWebhookProvider("github", githubSecret),
+	}
+
+	for providerName, secretEnvVarKey := range map[string]string{"gitlab": "GITLAB_SECRET", "gitea": "GITEA_SECRET", "bitbucket": "BITBUCKET_SECRET"} {
+		providerSecret := strings.Trim(os.Getenv(secretEnvVarKey), "\r\n")
+
+		if providerSecret == "" {
+			continue
+		}
+
+		webhookProviders[providerName] = newWebhookProvider(providerName, providerSecret)
+	}
+
+	handleWebhookEvents := func(events []*webhookEvent, source string) (int, gin.H, error) {
+		status := http.StatusOK
+
+		results := make([]gin.H, 0, len(events))
+
+		for _, event := range events {
+			eventStatus, result, err := handleWebhookEvent(event, source)
+
+			if err != nil {
+				return 0, nil, err
+			}
+
+			if eventStatus > status {
+				status = eventStatus
+			}
+
+			results = append(results, result)
+		}
+
+		if len(results) == 1 {
+			return status, results[0], nil
+		}
+
+		return status, gin.H{"results": results}, nil
+	}
+
+	handleWebhook := func(c *gin.Context, providerName string) {
+		provider, exists := webhookProviders[providerName]
+
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": fmt.Sprintf("webhook provider %q isn't configured", providerName)})
+
+			return
+		}
+
+		webhookPayloadBytes, err := ioutil.ReadAll(c.Request.Body)
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		if !*development {
+			err = provider.verify(c.Request.Header, webhookPayloadBytes)
+
+			if err != nil {
+				fmt.Println("bad webhook signature:", err)
+
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"err": err.Error()})
+
+				return
+			}
+		}
+
+		events, err := provider.parse(c.Request.Header, webhookPayloadBytes)
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		// A captured payload stays validly signed forever, so events are only
+		// accepted for a while after they happened, going by the payload's own
+		// timestamp or, for hosts whose payloads have none, the Date header.
+		// Deliveries with neither only have the duplicate check against replays
+		deliveredAt, _ := http.ParseTime(c.Request.Header.Get("Date"))
+
+		for _, event := range events {
+			sentAt := event.SentAt
+
+			if sentAt.IsZero() {
+				sentAt = deliveredAt
+			}
+
+			if event.Kind == pingEvent || sentAt.IsZero() || time.Since(sentAt) <= *maxDeliveryAge {
+				continue
+			}
+
+			fmt.Printf("rejected stale %s event for %s from %s\n", event.Kind, event.Push.Ref, sentAt.Format(time.RFC3339))
+
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": fmt.Sprintf("%s event from %s is too old", event.Kind, sentAt.Format(time.RFC3339))})
+
+			return
+		}
+
+		delivery, duplicate, err := deliveries.record(providerName, provider.deliveryID(c.Request.Header), c.Request.Header, webhookPayloadBytes)
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		if duplicate {
+			fmt.Printf("ignoring duplicate %s delivery %s\n", providerName, delivery.ID)
+
+			c.JSON(http.StatusOK, gin.H{"status": "duplicate", "deliveryId": delivery.ID, "result": delivery.Result})
+
+			return
+		}
+
+		status, result, err := handleWebhookEvents(events, fmt.Sprintf("%s delivery %s", providerName, delivery.ID))
+
+		if err != nil {
+			forgetErr := deliveries.forget(delivery.PayloadHash)
+
+			if forgetErr != nil {
+				fmt.Println("error forgetting failed delivery:", forgetErr)
+			}
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		err = deliveries.finish(delivery.PayloadHash, status, result)
+
+		if err != nil {
+			fmt.Println("error recording webhook result:", err)
+		}
+
+		result["deliveryId"] = delivery.ID
+
+		c.JSON(status, result)
+	}
+
+	server.POST("/", func(c *gin.Context) {
+		handleWebhook(c, "github")
+	})
+
+	server.POST("/hooks/:provider", func(c *gin.Context) {
+		handleWebhook(c, c.Param("provider"))
+	})
+
+	adminRoutes.GET("/queue", func(c *gin.Context) {
+		c.JSON(http.StatusOK, queue.list())
+	})
+
+	adminRoutes.GET("/deliveries", func(c *gin.Context) {
+		c.JSON(http.StatusOK, deliveries.list())
+	})
+
+	adminRoutes.GET("/deliveries/:deliveryID", func(c *gin.Context) {
+		delivery, payload, err := deliveries.get(c.Param("deliveryID"))
+
+		if err == errDeliveryNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"delivery": delivery, "payload": string(payload)})
+	})
+
+	// Redelivering handles an archived payload again as if it just arrived,
+	// skipping the duplicate and freshness checks
+	adminRoutes.POST("/deliveries/:deliveryID/redeliver", func(c *gin.Context) {
+		delivery, payload, err := deliveries.get(c.Param("deliveryID"))
+
+		if err == errDeliveryNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		provider, exists := webhookProviders[delivery.Provider]
+
+		if !exists {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": fmt.Sprintf("webhook provider %q isn't configured anymore", delivery.Provider)})
+
+			return
+		}
+
+		events, err := provider.parse(http.Header(delivery.Header), payload)
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		fmt.Printf("redelivering %s delivery %s\n", delivery.Provider, delivery.ID)
+
+		status, result, err := handleWebhookEvents(events, fmt.Sprintf("redelivery of %s delivery %s", delivery.Provider, delivery.ID))
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		err = deliveries.redelivered(delivery.PayloadHash)
+
+		if err != nil {
+			fmt.Println("error recording redelivery:", err)
+		}
+
+		result["deliveryId"] = delivery.ID
+
+		c.JSON(status, result)
+	})
+
+	// Manual deploys skip the deploy rules, whatever is asked for is deployed
+	adminRoutes.POST("/projects/:name/deploy", func(c *gin.Context) {
+		projectName := c.Param("name")
+
+		if !projectNameRegex.MatchString(projectName) || strings.Trim(projectName, ".") == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": fmt.Sprintf("invalid project name %q", projectName)})
+
+			return
+		}
+
+		var request deployRequest
+
+		err := json.NewDecoder(c.Request.Body).Decode(&request)
+
+		if err != nil && err != io.EOF {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		app, registered := apps.byApp(projectName)
+
+		if !registered {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": fmt.Sprintf("unknown project %q", projectName)})
+
+			return
+		}
+
+		repository, known := queue.lastRepository(app.Repository)
+
+		if !known {
+			repository, err = checkoutRepository(apps.appDir(app))
+
+			if err != nil {
+				fmt.Printf("can't deploy %s: %s\n", projectName, err)
+
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": fmt.Sprintf("don't know where to fetch %s from, it has never been pushed and has no checkout", projectName)})
+
+				return
+			}
+		}
+
+		repository.Name = path.Base(app.Repository)
+		repository.FullName = app.Repository
+
+		githubPush, err := request.push(repository)
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		job, err := queue.push(app.workRequest(githubPush), "manual deploy")
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		fmt.Printf("queued manual deploy %s of %s at %s\n", job.ID, projectName, githubPush.Ref)
+
+		drainQueue()
+
+		c.JSON(http.StatusAccepted, gin.H{"deployId": job.ID, "status": jobPending})
+	})
+
+	adminRoutes.GET("/deploys/:deployID", func(c *gin.Context) {
+		job, err := queue.get(c.Param("deployID"))
+
+		if err == errJobNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	})
+
+	lookupProject := func(c *gin.Context) (*appConfig, bool) {
+		app, registered := apps.byApp(c.Param("name"))
+
+		if !registered {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": fmt.Sprintf("unknown project %q", c.Param("name"))})
+		}
+
+		return app, registered
+	}
+
+	adminRoutes.GET("/projects/:name/releases", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		c.JSON(http.StatusOK, releases.list(app.App))
+	})
+
+	adminRoutes.GET("/projects/:name/releases/:releaseID", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		projectRelease, err := releases.get(app.App, c.Param("releaseID"))
+
+		if err == errReleaseNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		c.JSON(http.StatusOK, projectRelease)
+	})
+
+	// Rolling back deploys an earlier successful release again as a new
+	// release, with the images and compose revision it ran with
+	adminRoutes.POST("/projects/:name/releases/:releaseID/rollback", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		target, err := releases.get(app.App, c.Param("releaseID"))
+
+		if err == errReleaseNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		if target.Outcome != releaseSucceeded {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": fmt.Sprintf("release %s %s, only successful releases can be rolled back to", target.ID, target.Outcome)})
+
+			return
+		}
+
+		removedImages, err := cleaner.removedImages(c.Request.Context(), target)
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		if len(removedImages) != 0 {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": fmt.Sprintf("release %s can't be rolled back to, its images were cleaned up: %s", target.ID, strings.Join(removedImages, ", "))})
+
+			return
+		}
+
+		newRelease := &release{
+			App:             app.App,
+			Environment:     app.Environment,
+			Trigger:         fmt.Sprintf("rollback to release %s", target.ID),
+			Ref:             target.Ref,
+			Commit:          target.Commit,
+			ComposeRevision: target.ComposeRevision,
+			Images:          target.Images,
+			ProjectMetadata: target.ProjectMetadata,
+			QueuedAt:        time.Now(),
+		}
+
+		err = releases.start(newRelease)
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		fmt.Printf("rolling %s back to %s as release %s\n", app.App, target.Commit, newRelease.ID)
+
+		deployExecutor.submit(app.App, &deployTask{
+			name: "release " + newRelease.ID,
+			run: func() {
+				err := deployRelease(app, newRelease, target, nil)
+
+				if err != nil {
+					fmt.Printf("error rolling %s back to %s: %s\n", app.App, target.Commit, err)
+				}
+			},
+			supersede: func(newerTask string) {
+				err := releases.supersede(newRelease, "superseded by "+newerTask)
+
+				if err != nil {
+					fmt.Printf("error recording release %s of %s: %s\n", newRelease.ID, app.App, err)
+				}
+			},
+		})
+
+		c.JSON(http.StatusAccepted, gin.H{"releaseId": newRelease.ID, "status": releaseDeploying})
+	})
+
+	// Tearing down waits for the teardown, which waits for a running deploy
+	// of the app. Volumes are kept unless the body asks for them to be removed
+	adminRoutes.POST("/projects/:name/teardown", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
 
-		if err != nil {
-			log.Println("error occurred marshalling JSON for router:", err)
+		var request struct {
+			RemoveVolumes bool `json:"removeVolumes"`
 		}
 
-		err = s.Write(routerRequestBytes)
+		err := json.NewDecoder(c.Request.Body).Decode(&request)
 
-		if err != nil {
-			log.Println("error occurred writing JSON for router:", err)
+		if err != nil && err != io.EOF {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
 		}
 
-		log.Println("Sent route info to router!")
-	})
+		select {
+		case appTeardown := <-submitTeardown(app, "admin API", request.RemoveVolumes):
+			if appTeardown == nil {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": fmt.Sprintf("a newer deploy of %s replaced the teardown", app.App)})
 
-	routerWebsocketHandler.HandleDisconnect(func(s *melody.Session) {
-		projectsMetadata.routerConnection = nil
+				return
+			}
 
-		fmt.Println("Router disconnected!")
-	})
+			if appTeardown.Err != "" {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"err": appTeardown.Err, "teardown": appTeardown})
 
-	server.GET("/router/:routerSecret", func(c *gin.Context) {
-		routerSecretString := c.Param("routerSecret")
+				return
+			}
 
-		if routerSecretString != routerSecret {
-			fmt.Println("bad router connection request, aborting...")
+			c.JSON(http.StatusOK, appTeardown)
+		case <-c.Request.Context().Done():
+			fmt.Printf("teardown of %s continues without the client that asked for it\n", app.App)
+		}
+	})
 
-			c.AbortWithStatus(http.StatusInternalServerError)
+	adminRoutes.GET("/projects/:name/teardown", func(c *gin.Context) {
+		app, registered := lookupProject(c)
 
+		if !registered {
 			return
 		}
 
-		routerWebsocketHandler.HandleRequest(c.Writer, c.Request)
-	})
+		appTeardown, err := teardowns.get(app.App)
 
-	server.POST("/", func(c *gin.Context) {
-		githubRequestPayloadBytes, err := ioutil.ReadAll(c.Request.Body)
+		if err == errNotTornDown {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": fmt.Sprintf("%s isn't torn down", app.App)})
+
+			return
+		}
 
 		if isServerErr(c, err) {
 			return
 		}
 
-		if !*development {
-			githubRequestPayloadHeader := c.Request.Header.Get("X-Hub-Signature")
+		c.JSON(http.StatusOK, appTeardown)
+	})
 
-			if githubRequestPayloadHeader == "" {
-				isServerErr(c, errors.New("github request payload header wrong"))
+	// planDeploy works out what deploying a push of the app would change. The
+	// commit is fetched into a scratch clone and the project's files are read
+	// at it there, the app's checkout is never touched, and nothing is
+	// pulled, created or sent to the router
+	planDeploy := func(ctx context.Context, app *appConfig, githubPush uyghurs.GithubPush) (*deployPlan, error) {
+		appDir, err := appWorkingDir(app)
 
-				return
+		if err != nil {
+			return nil, err
+		}
+
+		scratchDir, removeScratchClone, err := scratchClone(appDir)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer removeScratchClone()
+
+		commit, err := resolveCommit(scratchDir, githubPush)
+
+		if err != nil {
+			return nil, err
+		}
+
+		readCommitFile := commitFileReader(scratchDir, appDir, commit)
+
+		composeBytes, err := readCommitFile(app.ComposeFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var hongKongSettings uyghurs.HongKongSettings
+
+		err = yaml.Unmarshal(composeBytes, &hongKongSettings)
+
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", app.ComposeFile, err)
+		}
+
+		secretEnvironment, err := secrets.environment(app.App, app.Environment)
+
+		if err != nil {
+			return nil, err
+		}
+
+		project, err := parseComposeProject(app.App, appDir, app.ComposeFile, readCommitFile, secretEnvironment)
+
+		if err != nil {
+			return nil, err
+		}
+
+		projectMetadata := hongKongSettings.HongKongProjectSettings
+
+		plan := &deployPlan{
+			App:         app.App,
+			Environment: app.Environment,
+			Ref:         githubPush.Ref,
+			Commit:      commit,
+			Notes:       make([]string, 0),
+		}
+
+		// A commit that was built before has its images pinned by digest,
+		// otherwise they are planned by the tag a build would give them
+		var commitRelease *release
+
+		for _, appRelease := range releases.list(app.App) {
+			if appRelease.Commit == commit && appRelease.BuiltImages != nil {
+				commitRelease = appRelease
+
+				break
 			}
+		}
 
-			githubRequestPayloadSignatureParts := strings.SplitN(githubRequestPayloadHeader, "=", 2)
+		builtImages := make(map[string]string)
 
-			if len(githubRequestPayloadSignatureParts) != 2 {
-				isServerErr(c, errors.New("error parsing signature"))
+		for _, buildInfo := range projectMetadata.BuildsInfo {
+			var images map[string]string
 
-				return
+			if commitRelease != nil {
+				images = commitRelease.BuiltImages
 			}
 
-			var githubHashFunc func() hash.Hash
+			image, err := app.buildImage(buildInfo.Name, commit, images)
 
-			switch githubRequestPayloadSignatureParts[0] {
-			case "sha1":
-				githubHashFunc = sha1.New
-			case "sha256":
-				githubHashFunc = sha256.New
-			case "sha512":
-				githubHashFunc = sha512.New
-			default:
-				isServerErr(c, fmt.Errorf("unknown hash type prefix: %q", githubRequestPayloadSignatureParts[0]))
+			if err != nil {
+				return nil, err
+			}
+
+			builtImages[imageRepository(app.imageName(buildInfo.Name))] = image
+		}
+
+		if commitRelease == nil && len(projectMetadata.BuildsInfo) != 0 {
+			plan.Notes = append(plan.Notes, fmt.Sprintf("%s hasn't been built yet, its images are planned by their commit tag", commit))
+		}
+
+		plan.Services, err = reconciler.plan(ctx, project, commit, pinnedImages(project, builtImages))
+
+		if err != nil {
+			return nil, err
+		}
+
+		var currentRoutes []*uyghurs.RouteInfo
+
+		if currentMetadata, exists := projectsMetadata.getProjectMetadata(app.App); exists {
+			currentRoutes = currentMetadata.ProjectRoutes
+		}
+
+		plan.Routes = planRoutes(currentRoutes, projectMetadata.ProjectRoutes)
+
+		err = validateHooks(projectMetadata.Hooks, project, projectMetadata.BuildsInfo)
+
+		if err == nil {
+			err = validateReadiness(projectMetadata.Readiness, project)
+		}
+
+		if err != nil {
+			plan.Notes = append(plan.Notes, fmt.Sprintf("the deploy would fail, %s", err))
+		} else if projectMetadata.Hooks != nil && len(projectMetadata.Hooks.PreDeploy) != 0 {
+			plan.Notes = append(plan.Notes, fmt.Sprintf("%d pre-deploy hooks would run before any container is replaced", len(projectMetadata.Hooks.PreDeploy)))
+		}
+
+		if app.RequireApproval {
+			plan.Notes = append(plan.Notes, "the build would wait for approval before deploying")
+		}
+
+		return plan, nil
+	}
+
+	// Plans are asked for like manual deploys, with ?ref= and ?commit=
+	adminRoutes.GET("/projects/:name/plan", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		repository, known := queue.lastRepository(app.Repository)
+
+		if !known {
+			var err error
+
+			repository, err = checkoutRepository(apps.appDir(app))
+
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": fmt.Sprintf("%s has no checkout to plan from", app.App)})
 
 				return
 			}
+		}
 
-			mac := hmac.New(githubHashFunc, []byte(githubSecret))
+		githubPush, err := deployRequest{Ref: c.Query("ref"), Commit: c.Query("commit")}.push(repository)
 
-			mac.Write(githubRequestPayloadBytes)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
 
-			expectedMAC := mac.Sum(nil)
+			return
+		}
 
-			signatureBytes, err := hex.DecodeString(githubRequestPayloadSignatureParts[1])
+		plan, err := planDeploy(c.Request.Context(), app, githubPush)
 
-			if isServerErr(c, err) {
-				return
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, plan)
+	})
+
+	adminRoutes.GET("/approvals", func(c *gin.Context) {
+		c.JSON(http.StatusOK, releases.pendingApproval())
+	})
+
+	// decideRelease approves or rejects a release waiting for approval, given
+	// an optional JSON body naming who decided and why. An approved release
+	// is deployed like any other build, a rejected one is discarded
+	decideRelease := func(c *gin.Context, approved bool) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		var request struct {
+			By     string `json:"by"`
+			Reason string `json:"reason"`
+		}
+
+		err := json.NewDecoder(c.Request.Body).Decode(&request)
+
+		if err != nil && err != io.EOF {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if request.By == "" {
+			request.By = "admin"
+		}
+
+		decidedRelease, err := releases.decide(app.App, c.Param("releaseID"), approved, request.By, request.Reason)
+
+		switch err {
+		case errReleaseNotFound:
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		case errReleaseNotPending:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": err.Error()})
+
+			return
+		case errApprovalExpired:
+			discardErr := queue.discardApproval(decidedRelease.JobID, decidedRelease.Err)
+
+			if discardErr != nil && discardErr != errJobNotFound {
+				fmt.Printf("error finishing job %s: %s\n", decidedRelease.JobID, discardErr)
 			}
 
-			if !hmac.Equal(signatureBytes, expectedMAC) {
-				isServerErr(c, fmt.Errorf("unequal hmacs %s != %s", string(signatureBytes), string(expectedMAC)))
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"err": err.Error()})
 
-				return
+			return
+		}
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		if !approved {
+			fmt.Printf("release %s of %s was rejected by %s\n", decidedRelease.ID, app.App, request.By)
+
+			err = queue.discardApproval(decidedRelease.JobID, decidedRelease.Err)
+
+			if err != nil && err != errJobNotFound {
+				fmt.Printf("error finishing job %s: %s\n", decidedRelease.JobID, err)
 			}
+
+			c.JSON(http.StatusOK, gin.H{"releaseId": decidedRelease.ID, "status": decidedRelease.Outcome})
+
+			return
+		}
+
+		fmt.Printf("release %s of %s was approved by %s, deploying %s\n", decidedRelease.ID, app.App, request.By, decidedRelease.Commit)
+
+		err = queue.approve(decidedRelease.JobID)
+
+		if err != nil && err != errJobNotFound {
+			fmt.Printf("error moving job %s on to deploying: %s\n", decidedRelease.JobID, err)
+		}
+
+		workResponse := &uyghurs.WorkResponse{
+			JobID: decidedRelease.JobID,
+			GithubData: uyghurs.GithubPush{
+				Ref:   decidedRelease.Ref,
+				After: decidedRelease.Commit,
+			},
+			ProjectMetadata: decidedRelease.ProjectMetadata,
+			Images:          decidedRelease.BuiltImages,
+		}
+
+		deployExecutor.submit(app.App, &deployTask{
+			name: "release " + decidedRelease.ID,
+			run: func() {
+				serviceResults, rolledBackTo, err := deployJobRelease(app, decidedRelease, workResponse)
+
+				finishJobDeploy(decidedRelease.JobID, serviceResults, rolledBackTo, err)
+			},
+			supersede: func(newerTask string) {
+				err := releases.supersede(decidedRelease, "superseded by "+newerTask)
+
+				if err != nil {
+					fmt.Printf("error recording release %s of %s: %s\n", decidedRelease.ID, app.App, err)
+				}
+
+				err = queue.supersedeDeploy(decidedRelease.JobID, "superseded by "+newerTask)
+
+				if err != nil && err != errJobNotFound {
+					fmt.Printf("error finishing job %s: %s\n", decidedRelease.JobID, err)
+				}
+			},
+		})
+
+		c.JSON(http.StatusAccepted, gin.H{"releaseId": decidedRelease.ID, "status": releaseDeploying})
+	}
+
+	adminRoutes.POST("/projects/:name/releases/:releaseID/approve", func(c *gin.Context) {
+		decideRelease(c, true)
+	})
+
+	adminRoutes.POST("/projects/:name/releases/:releaseID/reject", func(c *gin.Context) {
+		decideRelease(c, false)
+	})
+
+	// Secrets belong to the app's own environment unless another one is given
+	// as ?environment=, their values are never sent back
+	secretEnvironment := func(c *gin.Context, app *appConfig) string {
+		if environment := c.Query("environment"); environment != "" {
+			return environment
+		}
+
+		return app.Environment
+	}
+
+	adminRoutes.GET("/projects/:name/secrets", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		environment := secretEnvironment(c, app)
+
+		c.JSON(http.StatusOK, gin.H{"environment": environment, "secrets": secrets.list(app.App, environment)})
+	})
+
+	adminRoutes.PUT("/projects/:name/secrets/:secret", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
+		}
+
+		var request struct {
+			Value *string `json:"value"`
+		}
+
+		err := json.NewDecoder(c.Request.Body).Decode(&request)
+
+		if err == nil && request.Value == nil {
+			err = fmt.Errorf("missing value")
+		}
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		environment := secretEnvironment(c, app)
+
+		err = secrets.set(app.App, environment, c.Param("secret"), *request.Value)
+
+		if err == errSecretsNoKey {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		fmt.Printf("set secret %s of %s in %s\n", c.Param("secret"), app.App, environment)
+
+		c.Status(http.StatusNoContent)
+	})
+
+	adminRoutes.DELETE("/projects/:name/secrets/:secret", func(c *gin.Context) {
+		app, registered := lookupProject(c)
+
+		if !registered {
+			return
 		}
 
-		var githubPush uyghurs.GithubPush
+		environment := secretEnvironment(c, app)
 
-		err = json.Unmarshal(githubRequestPayloadBytes, &githubPush)
+		err := secrets.delete(app.App, environment, c.Param("secret"))
+
+		if err == errSecretNotFound {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": err.Error()})
+
+			return
+		}
 
 		if isServerErr(c, err) {
 			return
 		}
 
-		if workerConnection != nil {
-			workerRequest := uyghurs.WorkerMessage{
-				Type: int(uyghurs.WorkRequestType),
-				MessageData: structs.Map(uyghurs.WorkRequest{
-					GithubData: githubPush,
-				}),
-			}
+		fmt.Printf("deleted secret %s of %s in %s\n", c.Param("secret"), app.App, environment)
 
-			workerRequestBytes, err := json.MarshalIndent(workerRequest, "", "    ")
+		c.Status(http.StatusNoContent)
+	})
 
-			if isServerErr(c, err) {
-				return
-			}
+	// Cleaning up images is a dry run when asked with GET, only POST removes
+	// anything. Either cleans up every app unless one is given as ?app=
+	imageCleanupHandler := func(c *gin.Context) {
+		cleanApps := apps.list()
 
-			err = workerConnection.Write(workerRequestBytes)
+		if appName := c.Query("app"); appName != "" {
+			app, registered := apps.byApp(appName)
+
+			if !registered {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"err": fmt.Sprintf("unknown project %q", appName)})
 
-			if isServerErr(c, err) {
 				return
 			}
-		} else {
-			fmt.Println("no worker available for request")
+
+			cleanApps = []*appConfig{app}
+		}
+
+		report, err := cleaner.cleanup(c.Request.Context(), cleanApps, c.Request.Method != http.MethodPost)
+
+		if isServerErr(c, err) {
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+
+	adminRoutes.GET("/images/cleanup", imageCleanupHandler)
+
+	adminRoutes.POST("/images/cleanup", imageCleanupHandler)
+
+	adminRoutes.GET("/workers", func(c *gin.Context) {
+		c.JSON(http.StatusOK, workers.listWorkers())
+	})
+
+	adminRoutes.GET("/builds/:repository", func(c *gin.Context) {
+		buildLogInfos, err := buildLogs.list(c.Param("repository"))
+
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, buildLogInfos)
+	})
+
+	adminRoutes.GET("/builds/:repository/:commit/log", func(c *gin.Context) {
+		follow := c.Query("follow") == "true" || c.Query("follow") == "1"
+
+		if _, err := buildLogs.buildLogPath(c.Param("repository"), c.Param("commit")); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+
+			return
+		}
+
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Header("X-Content-Type-Options", "nosniff")
+
+		err := buildLogs.copyTo(c.Request.Context(), c.Writer, c.Writer.Flush, c.Param("repository"), c.Param("commit"), follow)
+
+		if os.IsNotExist(err) {
+			c.AbortWithStatus(http.StatusNotFound)
+
+			return
+		}
+
+		if err != nil {
+			fmt.Println("error copying build log:", err)
 		}
 	})
 
 	if *development {
 		server.Run(fmt.Sprintf(":%d", *port))
 	} else {
-		server.RunTLS(fmt.Sprintf(":%d", *port), "secrets/RJcert.crt", "secrets/RJsecret.key")
+		server.RunTLS(fmt.Sprintf(":%d", *port), tlsCertPath, tlsKeyPath)
 	}
 }
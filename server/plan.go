@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	planCreate    = "create"
+	planRecreate  = "recreate"
+	planUnchanged = "unchanged"
+	planRemove    = "remove"
+
+	routeAdd    = "add"
+	routeChange = "change"
+	routeRemove = "remove"
+)
+
+// deployPlan is what deploying a commit would change, worked out without
+// touching any container, image or route.
+type deployPlan struct {
+	App         string         `json:"app"`
+	Environment string         `json:"environment"`
+	Ref         string         `json:"ref"`
+	Commit      string         `json:"commit"`
+	Services    []*servicePlan `json:"services"`
+	Routes      []*routePlan   `json:"routes"`
+	Notes       []string       `json:"notes,omitempty"`
+}
+
+// servicePlan is what would happen to a service's container. The image is
+// the one it would run, ImageID is only known if the image is on the host.
+type servicePlan struct {
+	Service         string   `json:"service"`
+	Action          string   `json:"action"`
+	Image           string   `json:"image,omitempty"`
+	ImageID         string   `json:"imageId,omitempty"`
+	CurrentImageID  string   `json:"currentImageId,omitempty"`
+	ImageChanged    bool     `json:"imageChanged"`
+	ChangedSettings []string `json:"changedSettings,omitempty"`
+	Note            string   `json:"note,omitempty"`
+}
+
+type routePlan struct {
+	Action   string             `json:"action"`
+	Route    *uyghurs.RouteInfo `json:"route"`
+	Previous *uyghurs.RouteInfo `json:"previous,omitempty"`
+}
+
+// plan compares the services of the project with its running containers,
+// the services in pinnedImages would run that image instead of their own.
+// Images aren't pulled, one that isn't on the host counts as changed.
+func (cR *composeReconciler) plan(ctx context.Context, project *composeProject, commit string, pinnedImages map[string]string) ([]*servicePlan, error) {
+	serviceOrder, err := project.serviceOrder()
+
+	if err != nil {
+		return nil, err
+	}
+
+	existingContainers, err := cR.projectContainers(ctx, project.Name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	servicePlans := make([]*servicePlan, 0, len(serviceOrder))
+
+	for _, serviceName := range serviceOrder {
+		plan := &servicePlan{
+			Service: serviceName,
+			Action:  planCreate,
+			Image:   project.Services[serviceName].Image,
+		}
+
+		if pinnedImage, pinned := pinnedImages[serviceName]; pinned {
+			plan.Image = pinnedImage
+		}
+
+		servicePlans = append(servicePlans, plan)
+
+		serviceContainers := existingContainers[serviceName]
+
+		delete(existingContainers, serviceName)
+
+		if len(serviceContainers) != 0 {
+			plan.Action = planRecreate
+			plan.CurrentImageID = serviceContainers[0].ImageID
+		}
+
+		imageInspect, _, err := cR.cli.ImageInspectWithRaw(ctx, plan.Image)
+
+		if err != nil && !client.IsErrImageNotFound(err) {
+			return nil, err
+		}
+
+		if err != nil {
+			plan.Note = "image isn't on the host yet, it would be pulled"
+			plan.ImageChanged = plan.Action == planRecreate
+
+			continue
+		}
+
+		plan.ImageID = imageInspect.ID
+		plan.ImageChanged = plan.Action == planRecreate && plan.ImageID != plan.CurrentImageID
+
+		spec, err := newServiceSpec(project, serviceName, commit, plan.ImageID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(serviceContainers) != 1 {
+			continue
+		}
+
+		if serviceContainers[0].State != "running" {
+			plan.Note = "container isn't running"
+
+			continue
+		}
+
+		if serviceContainers[0].Labels[configHashLabel] == spec.configHashString {
+			plan.Action = planUnchanged
+
+			continue
+		}
+
+		plan.ChangedSettings, plan.Note = changedSettings(serviceContainers[0], spec)
+	}
+
+	orphanedServices := make([]string, 0, len(existingContainers))
+
+	for serviceName := range existingContainers {
+		orphanedServices = append(orphanedServices, serviceName)
+	}
+
+	sort.Strings(orphanedServices)
+
+	for _, serviceName := range orphanedServices {
+		servicePlans = append(servicePlans, &servicePlan{
+			Service:        serviceName,
+			Action:         planRemove,
+			CurrentImageID: existingContainers[serviceName][0].ImageID,
+		})
+	}
+
+	return servicePlans, nil
+}
+
+// changedSettings names the settings of a running container that differ
+// from spec, containers started before setting hashes were recorded can
+// only be told apart as a whole.
+func changedSettings(existingContainer types.Container, spec *serviceSpec) ([]string, string) {
+	var currentHashes map[string]string
+
+	err := json.Unmarshal([]byte(existingContainer.Labels[settingHashesLabel]), &currentHashes)
+
+	if err != nil || len(currentHashes) == 0 {
+		return nil, "container predates per-setting hashes, which settings changed is unknown"
+	}
+
+	settingNames := make([]string, 0)
+
+	for settingName, settingHash := range spec.settingHashes {
+		if currentHashes[settingName] != settingHash {
+			settingNames = append(settingNames, settingName)
+		}
+	}
+
+	sort.Strings(settingNames)
+
+	return settingNames, ""
+}
+
+// planRoutes compares the routes the router was last sent for a project with
+// the ones it would be sent, routes are told apart by domain and route.
+func planRoutes(currentRoutes, desiredRoutes []*uyghurs.RouteInfo) []*routePlan {
+	routeKey := func(route *uyghurs.RouteInfo) string {
+		return route.Domain + "\x00" + route.Route
+	}
+
+	currentByKey := make(map[string]*uyghurs.RouteInfo)
+
+	for _, route := range currentRoutes {
+		if route != nil {
+			currentByKey[routeKey(route)] = route
+		}
+	}
+
+	routePlans := make([]*routePlan, 0)
+
+	for _, route := range desiredRoutes {
+		if route == nil {
+			continue
+		}
+
+		currentRoute, exists := currentByKey[routeKey(route)]
+
+		delete(currentByKey, routeKey(route))
+
+		switch {
+		case !exists:
+			routePlans = append(routePlans, &routePlan{Action: routeAdd, Route: route})
+		case *currentRoute != *route:
+			routePlans = append(routePlans, &routePlan{Action: routeChange, Route: route, Previous: currentRoute})
+		}
+	}
+
+	for _, route := range currentRoutes {
+		if route != nil && currentByKey[routeKey(route)] == route {
+			routePlans = append(routePlans, &routePlan{Action: routeRemove, Route: route})
+		}
+	}
+
+	return routePlans
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+func TestPlanRoutes(t *testing.T) {
+	api := &uyghurs.RouteInfo{Domain: "example.com", Route: "/api", ForwardHost: "web:8080"}
+	apiMoved := &uyghurs.RouteInfo{Domain: "example.com", Route: "/api", ForwardHost: "api:8080"}
+	apiOtherDomain := &uyghurs.RouteInfo{Domain: "preview.example.com", Route: "/api", ForwardHost: "web:8080"}
+	root := &uyghurs.RouteInfo{Domain: "example.com", Route: "/", ForwardHost: "web:80"}
+
+	tests := []struct {
+		name    string
+		current []*uyghurs.RouteInfo
+		desired []*uyghurs.RouteInfo
+		want    []*routePlan
+	}{
+		{"nothing", nil, nil, []*routePlan{}},
+		{"first deploy", nil, []*uyghurs.RouteInfo{api, root}, []*routePlan{
+			{Action: routeAdd, Route: api},
+			{Action: routeAdd, Route: root},
+		}},
+		{"unchanged", []*uyghurs.RouteInfo{api, root}, []*uyghurs.RouteInfo{root, api}, []*routePlan{}},
+		{"changed forward host", []*uyghurs.RouteInfo{api}, []*uyghurs.RouteInfo{apiMoved}, []*routePlan{
+			{Action: routeChange, Route: apiMoved, Previous: api},
+		}},
+		{"same route on another domain", []*uyghurs.RouteInfo{api}, []*uyghurs.RouteInfo{apiOtherDomain}, []*routePlan{
+			{Action: routeAdd, Route: apiOtherDomain},
+			{Action: routeRemove, Route: api},
+		}},
+		{"removed", []*uyghurs.RouteInfo{api, root}, []*uyghurs.RouteInfo{root}, []*routePlan{
+			{Action: routeRemove, Route: api},
+		}},
+		{"teardown", []*uyghurs.RouteInfo{api, root}, nil, []*routePlan{
+			{Action: routeRemove, Route: api},
+			{Action: routeRemove, Route: root},
+		}},
+		{"nil routes are skipped", []*uyghurs.RouteInfo{nil, api}, []*uyghurs.RouteInfo{api, nil}, []*routePlan{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := planRoutes(test.current, test.desired)
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("planRoutes() = %s, want %s", describeRoutePlans(got), describeRoutePlans(test.want))
+			}
+		})
+	}
+}
+
+func describeRoutePlans(routePlans []*routePlan) []string {
+	descriptions := make([]string, 0, len(routePlans))
+
+	for _, plan := range routePlans {
+		descriptions = append(descriptions, plan.Action+" "+plan.Route.Domain+plan.Route.Route+" -> "+plan.Route.ForwardHost)
+	}
+
+	return descriptions
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const (
+	maxPullAttempts  = 3
+	pullRetryBackoff = 2 * time.Second
+)
+
+// pullMessage is one message of the JSON stream docker answers a pull with.
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error       string `json:"error"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+// imagePuller pulls images with the registry credentials they need, at most
+// a few at a time across every deploy. Failed pulls are retried with backoff
+// unless they failed for a reason retrying can't fix.
+type imagePuller struct {
+	cli         *client.Client
+	credentials *registryCredentials
+	slots       chan struct{}
+}
+
+func newImagePuller(cli *client.Client, credentials *registryCredentials, maxPulls int) *imagePuller {
+	if maxPulls < 1 {
+		maxPulls = 1
+	}
+
+	return &imagePuller{
+		cli:         cli,
+		credentials: credentials,
+		slots:       make(chan struct{}, maxPulls),
+	}
+}
+
+// pull pulls a single image, retrying transient failures until ctx is done.
+func (iP *imagePuller) pull(ctx context.Context, image string) error {
+	select {
+	case iP.slots <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("error pulling %s: %w", image, ctx.Err())
+	}
+
+	defer func() {
+		<-iP.slots
+	}()
+
+	var err error
+
+	for attempt := 1; attempt <= maxPullAttempts; attempt++ {
+		err = iP.pullOnce(ctx, image)
+
+		if err == nil || attempt == maxPullAttempts || !isTransientPullError(ctx, err) {
+			break
+		}
+
+		backoff := pullRetryBackoff << uint(attempt-1)
+
+		fmt.Printf("pulling %s failed, retrying in %s: %s\n", image, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("error pulling %s: %w", image, ctx.Err())
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("error pulling %s: %w", image, err)
+	}
+
+	return nil
+}
+
+// pullAll pulls images in parallel, the error lists every image that
+// couldn't be pulled.
+func (iP *imagePuller) pullAll(ctx context.Context, images []string) error {
+	pullErrs := make([]string, 0)
+
+	pullErrsLock := &sync.Mutex{}
+
+	waitGroup := &sync.WaitGroup{}
+
+	for _, image := range images {
+		waitGroup.Add(1)
+
+		go func(image string) {
+			defer waitGroup.Done()
+
+			err := iP.pull(ctx, image)
+
+			if err != nil {
+				pullErrsLock.Lock()
+
+				pullErrs = append(pullErrs, err.Error())
+
+				pullErrsLock.Unlock()
+			}
+		}(image)
+	}
+
+	waitGroup.Wait()
+
+	if len(pullErrs) != 0 {
+		sort.Strings(pullErrs)
+
+		return errors.New(strings.Join(pullErrs, "; "))
+	}
+
+	return nil
+}
+
+func (iP *imagePuller) pullOnce(ctx context.Context, image string) error {
+	registryAuth, err := iP.credentials.registryAuth(image)
+
+	if err != nil {
+		return err
+	}
+
+	pullResponse, err := iP.cli.ImagePull(ctx, image, types.ImagePullOptions{
+		RegistryAuth: registryAuth,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	defer pullResponse.Close()
+
+	return decodePullStream(image, pullResponse)
+}
+
+// decodePullStream follows a pull's message stream to the end, logging how
+// every layer gets along and returning the first error docker reports in it.
+func decodePullStream(image string, pullStream io.Reader) error {
+	decoder := json.NewDecoder(pullStream)
+
+	// Layers report their progress constantly, only changes of status and
+	// every quarter of a download or extraction are logged
+	layerProgress := make(map[string]string)
+
+	for {
+		var message pullMessage
+
+		err := decoder.Decode(&message)
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if message.ErrorDetail != nil && message.ErrorDetail.Message != "" {
+			return errors.New(message.ErrorDetail.Message)
+		}
+
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+
+		if message.Status == "" {
+			continue
+		}
+
+		if message.ID == "" {
+			fmt.Printf("%s: %s\n", image, message.Status)
+
+			continue
+		}
+
+		progress := message.Status
+
+		if message.ProgressDetail.Total > 0 {
+			progress = fmt.Sprintf("%s %d%%", message.Status, message.ProgressDetail.Current*4/message.ProgressDetail.Total*25)
+		}
+
+		if layerProgress[message.ID] != progress {
+			layerProgress[message.ID] = progress
+
+			fmt.Printf("%s: %s: %s\n", image, message.ID, progress)
+		}
+	}
+}
+
+// isTransientPullError guesses whether retrying a pull could help, images
+// that don't exist or aren't accessible won't be there on the next attempt.
+func isTransientPullError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	errString := strings.ToLower(err.Error())
+
+	for _, permanentErr := range []string{"not found", "manifest unknown", "unauthorized", "denied", "invalid reference", "repository name must"} {
+		if strings.Contains(errString, permanentErr) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	jobPending   = "pending"
+	jobLeased    = "leased"
+	jobDeploying = "deploying"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobSkipped   = "skipped"
+)
+
+// jobPendingApproval jobs were built for an app that needs every deploy
+// approved, they wait for their release to be approved or discarded.
+const jobPendingApproval = "pending-approval"
+
+// maxFinishedJobs is how many finished jobs are kept around for inspection.
+const maxFinishedJobs = 200
+
+var (
+	errJobNotFound    = errors.New("job not found")
+	errNotLeaseHolder = errors.New("job isn't leased to the worker")
+)
+
+type workJob struct {
+	ID            string              `json:"id"`
+	State         string              `json:"state"`
+	Trigger       string              `json:"trigger,omitempty"`
+	QueuedAt      time.Time           `json:"queuedAt"`
+	Attempts      int                 `json:"attempts"`
+	NotBefore     time.Time           `json:"notBefore"`
+	LeasedTo      string              `json:"leasedTo,omitempty"`
+	LeaseHolder   string              `json:"leaseHolder,omitempty"`
+	LeaseDeadline time.Time           `json:"leaseDeadline"`
+	FinishedAt    time.Time           `json:"finishedAt"`
+	Err           string              `json:"err,omitempty"`
+	Services      []serviceResult     `json:"services,omitempty"`
+	RolledBackTo  string              `json:"rolledBackTo,omitempty"`
+	WorkRequest   uyghurs.WorkRequest `json:"workRequest"`
+}
+
+type workQueueState struct {
+	Jobs     []*workJob `json:"jobs"`
+	Finished []*workJob `json:"finished"`
+}
+
+// workQueue is an on-disk FIFO of jobs waiting for or leased to a worker,
+// every change is written out before returning so nothing is lost on restart.
+// A leased job stays in the queue until a worker answers for it, if the lease
+// runs out or the worker goes away it is retried with backoff.
+type workQueue struct {
+	queuePath     string
+	state         workQueueState
+	leaseDuration time.Duration
+	maxAttempts   int
+	lock          *sync.Mutex
+}
+
+func newWorkQueue(queuePath string, leaseDuration time.Duration, maxAttempts int) (*workQueue, error) {
+	var state workQueueState
+
+	err := readJSONFile(queuePath, &state)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if state.Jobs == nil {
+		state.Jobs = make([]*workJob, 0)
+	}
+
+	for index := len(state.Jobs) - 1; index >= 0; index-- {
+		job := state.Jobs[index]
+
+		if job.State != jobDeploying {
+			continue
+		}
+
+		job.State = jobFailed
+		job.Err = "server stopped while deploying"
+		job.FinishedAt = time.Now()
+
+		state.Jobs = append(state.Jobs[:index], state.Jobs[index+1:]...)
+
+		state.Finished = append(state.Finished, job)
+	}
+
+	if state.Finished == nil {
+		state.Finished = make([]*workJob, 0)
+	}
+
+	return &workQueue{
+		queuePath:     queuePath,
+		state:         state,
+		leaseDuration: leaseDuration,
+		maxAttempts:   maxAttempts,
+		lock:          &sync.Mutex{},
+	}, nil
+}
+
+func (wQ *workQueue) save() error {
+	return writeJSONFile(wQ.queuePath, wQ.state)
+}
+
+// push queues a work request, trigger says what asked for it.
+func (wQ *workQueue) push(workRequest uyghurs.WorkRequest, trigger string) (*workJob, error) {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	job := &workJob{
+		ID:       newRandomID(),
+		State:    jobPending,
+		Trigger:  trigger,
+		QueuedAt: time.Now(),
+	}
+
+	workRequest.JobID = job.ID
+
+	job.WorkRequest = workRequest
+
+	wQ.state.Jobs = append(wQ.state.Jobs, job)
+
+	err := wQ.save()
+
+	if err != nil {
+		wQ.state.Jobs = wQ.state.Jobs[:len(wQ.state.Jobs)-1]
+
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// skip records a work request that was never queued, along with the reason
+// it was skipped.
+func (wQ *workQueue) skip(workRequest uyghurs.WorkRequest, trigger, reason string) (*workJob, error) {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	job := &workJob{
+		ID:       newRandomID(),
+		Trigger:  trigger,
+		QueuedAt: time.Now(),
+	}
+
+	workRequest.JobID = job.ID
+
+	job.WorkRequest = workRequest
+
+	wQ.state.Jobs = append(wQ.state.Jobs, job)
+
+	wQ.finishJob(len(wQ.state.Jobs)-1, jobSkipped, reason)
+
+	return job, wQ.save()
+}
+
+// retryBackoff is how long a job waits before its next attempt, doubling
+// from thirty seconds up to ten minutes.
+func retryBackoff(attempts int) time.Duration {
+	backoff := 30 * time.Second
+
+	for i := 1; i < attempts && backoff < 10*time.Minute; i++ {
+		backoff *= 2
+	}
+
+	if backoff > 10*time.Minute {
+		backoff = 10 * time.Minute
+	}
+
+	return backoff
+}
+
+// finishJob moves the job at index out of the active jobs, the caller saves.
+func (wQ *workQueue) finishJob(index int, state, errString string) *workJob {
+	job := wQ.state.Jobs[index]
+
+	job.State = state
+	job.Err = errString
+	job.FinishedAt = time.Now()
+
+	wQ.state.Jobs = append(wQ.state.Jobs[:index], wQ.state.Jobs[index+1:]...)
+
+	wQ.state.Finished = append(wQ.state.Finished, job)
+
+	if len(wQ.state.Finished) > maxFinishedJobs {
+		wQ.state.Finished = wQ.state.Finished[len(wQ.state.Finished)-maxFinishedJobs:]
+	}
+
+	return job
+}
+
+// retryJob gives up the lease on the job at index, it goes back to pending
+// after a backoff or fails once it has used up its attempts. The caller saves.
+func (wQ *workQueue) retryJob(index int, reason string) {
+	job := wQ.state.Jobs[index]
+
+	if job.Attempts >= wQ.maxAttempts {
+		wQ.finishJob(index, jobFailed, fmt.Sprintf("gave up after %d attempts: %s", job.Attempts, reason))
+
+		fmt.Printf("job %s failed after %d attempts: %s\n", job.ID, job.Attempts, reason)
+
+		return
+	}
+
+	job.State = jobPending
+	job.Err = reason
+	job.LeasedTo = ""
+	job.LeaseHolder = ""
+	job.NotBefore = time.Now().Add(retryBackoff(job.Attempts))
+
+	fmt.Printf("job %s will be retried after %s: %s\n", job.ID, job.NotBefore.Format(time.RFC3339), reason)
+}
+
+// release gives up the lease on the job, used when the worker holding it
+// disconnects or is declared dead.
+func (wQ *workQueue) release(jobID, reason string) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for index, job := range wQ.state.Jobs {
+		if job.ID == jobID && job.State == jobLeased {
+			wQ.retryJob(index, reason)
+
+			return wQ.save()
+		}
+	}
+
+	return errJobNotFound
+}
+
+// returnJob puts a job its worker was too busy to take back in the queue
+// straight away, it doesn't count as an attempt.
+func (wQ *workQueue) returnJob(jobID, workerID string) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for _, job := range wQ.state.Jobs {
+		if job.ID != jobID || job.State != jobLeased || job.LeaseHolder != workerID {
+			continue
+		}
+
+		job.State = jobPending
+		job.Attempts--
+		job.LeasedTo = ""
+		job.LeaseHolder = ""
+		job.NotBefore = time.Now()
+
+		return wQ.save()
+	}
+
+	return errJobNotFound
+}
+
+// expireLeases retries every job whose lease has run out and returns their
+// IDs, so the workers that held them can be taken off them.
+func (wQ *workQueue) expireLeases() ([]string, error) {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	expiredJobIDs := make([]string, 0)
+
+	for index := len(wQ.state.Jobs) - 1; index >= 0; index-- {
+		job := wQ.state.Jobs[index]
+
+		if job.State == jobLeased && time.Now().After(job.LeaseDeadline) {
+			expiredJobIDs = append(expiredJobIDs, job.ID)
+
+			wQ.retryJob(index, fmt.Sprintf("lease held by %s expired", job.LeasedTo))
+		}
+	}
+
+	if len(expiredJobIDs) == 0 {
+		return expiredJobIDs, nil
+	}
+
+	return expiredJobIDs, wQ.save()
+}
+
+// complete records the answer of the worker holding the job's lease, a failed
+// build finishes the job and a successful one moves it on to deploying.
+// errJobNotFound is returned if the job already got an answer and
+// errNotLeaseHolder if workerID doesn't hold its lease, like a worker whose
+// lease ran out and was given to another, so late or duplicate answers are
+// never acted on.
+func (wQ *workQueue) complete(jobID, workerID, errString string) (*workJob, error) {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for index, job := range wQ.state.Jobs {
+		if job.ID != jobID || job.State == jobDeploying || job.State == jobPendingApproval {
+			continue
+		}
+
+		if job.State != jobLeased || job.LeaseHolder != workerID {
+			return nil, errNotLeaseHolder
+		}
+
+		if errString != "" {
+			job = wQ.finishJob(index, jobFailed, errString)
+		} else {
+			job.State = jobDeploying
+			job.Err = ""
+		}
+
+		err := wQ.save()
+
+		if err != nil {
+			return nil, err
+		}
+
+		jobCopy := *job
+
+		return &jobCopy, nil
+	}
+
+	return nil, errJobNotFound
+}
+
+// finishDeploy finishes a deploying job once the server is done deploying
+// what the worker built, along with how each service fared and the commit
+// the app was rolled back to if it didn't come up ready.
+func (wQ *workQueue) finishDeploy(jobID, errString string, services []serviceResult, rolledBackTo string) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for index, job := range wQ.state.Jobs {
+		if job.ID != jobID || job.State != jobDeploying {
+			continue
+		}
+
+		state := jobSucceeded
+
+		if errString != "" {
+			state = jobFailed
+		}
+
+		job.Services = services
+		job.RolledBackTo = rolledBackTo
+
+		wQ.finishJob(index, state, errString)
+
+		return wQ.save()
+	}
+
+	return errJobNotFound
+}
+
+// awaitApproval parks a deploying job until its release is approved.
+func (wQ *workQueue) awaitApproval(jobID string) error {
+	return wQ.moveJob(jobID, jobDeploying, jobPendingApproval)
+}
+
+// approve moves a job waiting for approval on to deploying.
+func (wQ *workQueue) approve(jobID string) error {
+	return wQ.moveJob(jobID, jobPendingApproval, jobDeploying)
+}
+
+func (wQ *workQueue) moveJob(jobID, fromState, toState string) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for _, job := range wQ.state.Jobs {
+		if job.ID != jobID || job.State != fromState {
+			continue
+		}
+
+		job.State = toState
+
+		return wQ.save()
+	}
+
+	return errJobNotFound
+}
+
+// discardApproval skips a job waiting for approval whose release was
+// rejected, expired or replaced by a newer one.
+func (wQ *workQueue) discardApproval(jobID, reason string) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for index, job := range wQ.state.Jobs {
+		if job.ID != jobID || job.State != jobPendingApproval {
+			continue
+		}
+
+		wQ.finishJob(index, jobSkipped, reason)
+
+		return wQ.save()
+	}
+
+	return errJobNotFound
+}
+
+// supersedeDeploy skips a deploying job that a newer deploy of its project
+// replaced before it got its turn.
+func (wQ *workQueue) supersedeDeploy(jobID, reason string) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for index, job := range wQ.state.Jobs {
+		if job.ID != jobID || job.State != jobDeploying {
+			continue
+		}
+
+		wQ.finishJob(index, jobSkipped, reason)
+
+		return wQ.save()
+	}
+
+	return errJobNotFound
+}
+
+func (wQ *workQueue) get(jobID string) (*workJob, error) {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for _, jobs := range [][]*workJob{wQ.state.Jobs, wQ.state.Finished} {
+		for _, job := range jobs {
+			if job.ID == jobID {
+				jobCopy := *job
+
+				return &jobCopy, nil
+			}
+		}
+	}
+
+	return nil, errJobNotFound
+}
+
+// lastRepository returns the repository of the most recent job for the
+// repository with the given full owner/name, which is all the server knows
+// about where to fetch it from.
+func (wQ *workQueue) lastRepository(repositoryFullName string) (uyghurs.Repository, bool) {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	for _, jobs := range [][]*workJob{wQ.state.Jobs, wQ.state.Finished} {
+		for index := len(jobs) - 1; index >= 0; index-- {
+			repository := jobs[index].WorkRequest.GithubData.Repository
+
+			if strings.EqualFold(repository.FullName, repositoryFullName) && (repository.CloneURL != "" || repository.URL != "") {
+				return repository, true
+			}
+		}
+	}
+
+	return uyghurs.Repository{}, false
+}
+
+func (wQ *workQueue) list() workQueueState {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	state := workQueueState{
+		Jobs:     make([]*workJob, 0, len(wQ.state.Jobs)),
+		Finished: make([]*workJob, 0, len(wQ.state.Finished)),
+	}
+
+	for _, job := range wQ.state.Jobs {
+		jobCopy := *job
+
+		state.Jobs = append(state.Jobs, &jobCopy)
+	}
+
+	for _, job := range wQ.state.Finished {
+		jobCopy := *job
+
+		state.Finished = append(state.Finished, &jobCopy)
+	}
+
+	return state
+}
+
+// drain hands pending jobs whose backoff has passed to dispatch in order until
+// dispatch fails, dispatched jobs are leased to the worker dispatch returns.
+func (wQ *workQueue) drain(dispatch func(*workJob) (string, string, error)) error {
+	wQ.lock.Lock()
+
+	defer wQ.lock.Unlock()
+
+	dispatchedCount := 0
+
+	var dispatchErr error
+
+	for _, job := range wQ.state.Jobs {
+		if job.State != jobPending || time.Now().Before(job.NotBefore) {
+			continue
+		}
+
+		var workerName, workerID string
+
+		workerName, workerID, dispatchErr = dispatch(job)
+
+		if dispatchErr != nil {
+			break
+		}
+
+		job.State = jobLeased
+		job.Attempts++
+		job.LeasedTo = workerName
+		job.LeaseHolder = workerID
+		job.LeaseDeadline = time.Now().Add(wQ.leaseDuration)
+
+		dispatchedCount++
+	}
+
+	if dispatchedCount != 0 {
+		err := wQ.save()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return dispatchErr
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+// newTestQueue returns a queue backed by a temporary file along with a
+// function removing it.
+func newTestQueue(t *testing.T, leaseDuration time.Duration, maxAttempts int) (*workQueue, func()) {
+	dir, err := ioutil.TempDir("", "queue")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := newWorkQueue(filepath.Join(dir, "queue.json"), leaseDuration, maxAttempts)
+
+	if err != nil {
+		os.RemoveAll(dir)
+
+		t.Fatal(err)
+	}
+
+	return queue, func() { os.RemoveAll(dir) }
+}
+
+// leaseNext leases the next pending job to workerID, ignoring backoff.
+func leaseNext(t *testing.T, queue *workQueue, workerID string) {
+	queue.lock.Lock()
+
+	for _, job := range queue.state.Jobs {
+		job.NotBefore = time.Time{}
+	}
+
+	queue.lock.Unlock()
+
+	err := queue.drain(func(*workJob) (string, string, error) {
+		return "worker " + workerID, workerID, nil
+	})
+
+	if err != nil {
+		t.Fatalf("drain: %s", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{6, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := retryBackoff(test.attempts); got != test.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestWorkQueueLeases(t *testing.T) {
+	tests := []struct {
+		name          string
+		leaseDuration time.Duration
+		maxAttempts   int
+		leases        int
+		wantState     string
+		wantAttempts  int
+		wantBackoff   time.Duration
+	}{
+		{"lease still running", time.Hour, 3, 1, jobLeased, 1, 0},
+		{"expired lease is retried", -time.Second, 3, 1, jobPending, 1, 30 * time.Second},
+		{"retries back off", -time.Second, 3, 2, jobPending, 2, time.Minute},
+		{"fails after max attempts", -time.Second, 3, 3, jobFailed, 3, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue, cleanup := newTestQueue(t, test.leaseDuration, test.maxAttempts)
+
+			defer cleanup()
+
+			job, err := queue.push(uyghurs.WorkRequest{}, "test")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for lease := 0; lease < test.leases; lease++ {
+				leaseNext(t, queue, "worker-id")
+
+				_, err = queue.expireLeases()
+
+				if err != nil {
+					t.Fatalf("expireLeases: %s", err)
+				}
+			}
+
+			got, err := queue.get(job.ID)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.State != test.wantState || got.Attempts != test.wantAttempts {
+				t.Fatalf("job is %s after %d attempts, want %s after %d", got.State, got.Attempts, test.wantState, test.wantAttempts)
+			}
+
+			if test.wantState != jobPending {
+				return
+			}
+
+			if backoff := time.Until(got.NotBefore); backoff > test.wantBackoff || backoff < test.wantBackoff-time.Minute/2 {
+				t.Errorf("job retried in %s, want %s", backoff.Round(time.Second), test.wantBackoff)
+			}
+		})
+	}
+}
+
+func TestWorkQueueExpireLeasesReturnsJobs(t *testing.T) {
+	queue, cleanup := newTestQueue(t, -time.Second, 3)
+
+	defer cleanup()
+
+	job, err := queue.push(uyghurs.WorkRequest{}, "test")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaseNext(t, queue, "worker-id")
+
+	expiredJobIDs, err := queue.expireLeases()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(expiredJobIDs) != 1 || expiredJobIDs[0] != job.ID {
+		t.Errorf("expireLeases() = %q, want [%q]", expiredJobIDs, job.ID)
+	}
+
+	expiredJobIDs, err = queue.expireLeases()
+
+	if err != nil || len(expiredJobIDs) != 0 {
+		t.Errorf("second expireLeases() = %q, %v, want nothing", expiredJobIDs, err)
+	}
+}
+
+func TestWorkQueueComplete(t *testing.T) {
+	tests := []struct {
+		name      string
+		workerID  string
+		errString string
+		expire    bool
+		wantErr   error
+		wantState string
+	}{
+		{"lease holder succeeds", "holder", "", false, nil, jobDeploying},
+		{"lease holder fails", "holder", "build failed", false, nil, jobFailed},
+		{"another worker", "other", "", false, errNotLeaseHolder, jobLeased},
+		{"holder after its lease expired", "holder", "", true, errNotLeaseHolder, jobPending},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leaseDuration := time.Hour
+
+			if test.expire {
+				leaseDuration = -time.Second
+			}
+
+			queue, cleanup := newTestQueue(t, leaseDuration, 3)
+
+			defer cleanup()
+
+			job, err := queue.push(uyghurs.WorkRequest{}, "test")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaseNext(t, queue, "holder")
+
+			if test.expire {
+				_, err = queue.expireLeases()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = queue.complete(job.ID, test.workerID, test.errString)
+
+			if err != test.wantErr {
+				t.Fatalf("complete from %s error = %v, want %v", test.workerID, err, test.wantErr)
+			}
+
+			got, err := queue.get(job.ID)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.State != test.wantState {
+				t.Errorf("job is %s, want %s", got.State, test.wantState)
+			}
+
+			if test.wantErr != nil {
+				return
+			}
+
+			_, err = queue.complete(job.ID, test.workerID, test.errString)
+
+			if err != errJobNotFound && err != errNotLeaseHolder {
+				t.Errorf("duplicate complete error = %v, want it ignored", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+const (
+	projectLabel    = "uyghurs.project"
+	serviceLabel    = "uyghurs.service"
+	commitLabel     = "uyghurs.commit"
+	configHashLabel = "uyghurs.config-hash"
+	// settingHashesLabel hashes every setting of a service on its own, so a
+	// plan can tell which of them changed without storing their values
+	settingHashesLabel = "uyghurs.setting-hashes"
+)
+
+const (
+	serviceCreated   = "created"
+	serviceRecreated = "recreated"
+	serviceUnchanged = "unchanged"
+	serviceRemoved   = "removed"
+	serviceFailed    = "failed"
+)
+
+// serviceStopTimeout is how long a replaced container gets to stop before it
+// is killed.
+const serviceStopTimeout = 10 * time.Second
+
+type serviceResult struct {
+	Service     string `json:"service"`
+	Action      string `json:"action"`
+	ContainerID string `json:"containerId,omitempty"`
+	ImageID     string `json:"imageId,omitempty"`
+	Err         string `json:"err,omitempty"`
+}
+
+// serviceSpec is everything a service's container is created from, it is
+// hashed to tell whether a running container is still up to date.
+type serviceSpec struct {
+	Config           *container.Config
+	HostConfig       *container.HostConfig
+	NetworkAliases   map[string][]string
+	ImageID          string
+	primaryNetwork   string
+	networkNames     []string
+	containerName    string
+	commit           string
+	serviceName      string
+	projectName      string
+	configHashString string
+	settingHashes    map[string]string
+}
+
+// composeReconciler brings the containers, networks and volumes of a compose
+// project in line with its compose file through the Docker API, containers
+// are labelled with their project, service and commit so they can be found
+// again on the next deploy.
+type composeReconciler struct {
+	cli    *client.Client
+	puller *imagePuller
+}
+
+func newComposeReconciler(cli *client.Client, puller *imagePuller) *composeReconciler {
+	return &composeReconciler{
+		cli:    cli,
+		puller: puller,
+	}
+}
+
+// reconcile creates what is missing, replaces containers whose service changed
+// and removes containers of services that are gone. Services in pinnedImages
+// run that image ID instead of their image, which is how rollbacks get back
+// the exact images of an earlier release. Every service is tried, the error
+// sums up the services that failed.
+func (cR *composeReconciler) reconcile(ctx context.Context, project *composeProject, commit string, pinnedImages map[string]string) ([]serviceResult, error) {
+	serviceOrder, err := project.serviceOrder()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = cR.prepare(ctx, project)
+
+	if err != nil {
+		return nil, err
+	}
+
+	existingContainers, err := cR.projectContainers(ctx, project.Name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]serviceResult, 0, len(serviceOrder))
+
+	failedServices := make(map[string]bool)
+
+	for _, serviceName := range serviceOrder {
+		result := serviceResult{
+			Service: serviceName,
+		}
+
+		for _, dependency := range project.Services[serviceName].DependsOn {
+			if failedServices[dependency] {
+				result.Err = fmt.Sprintf("dependency %s failed", dependency)
+			}
+		}
+
+		if result.Err == "" {
+			result.Action, result.ContainerID, result.ImageID, err = cR.reconcileService(ctx, project, serviceName, commit, pinnedImages[serviceName], existingContainers[serviceName])
+
+			if err != nil {
+				result.Err = err.Error()
+			}
+		}
+
+		if result.Err != "" {
+			result.Action = serviceFailed
+
+			failedServices[serviceName] = true
+		}
+
+		delete(existingContainers, serviceName)
+
+		results = append(results, result)
+	}
+
+	orphanedServices := make([]string, 0, len(existingContainers))
+
+	for serviceName := range existingContainers {
+		orphanedServices = append(orphanedServices, serviceName)
+	}
+
+	sort.Strings(orphanedServices)
+
+	for _, serviceName := range orphanedServices {
+		result := serviceResult{
+			Service: serviceName,
+			Action:  serviceRemoved,
+		}
+
+		for _, orphanedContainer := range existingContainers[serviceName] {
+			err = cR.removeContainer(ctx, orphanedContainer.ID, false)
+
+			if err != nil {
+				result.Action = serviceFailed
+				result.Err = err.Error()
+
+				failedServices[serviceName] = true
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	if len(failedServices) != 0 {
+		failedServiceNames := make([]string, 0, len(failedServices))
+
+		for serviceName := range failedServices {
+			failedServiceNames = append(failedServiceNames, serviceName)
+		}
+
+		sort.Strings(failedServiceNames)
+
+		return results, fmt.Errorf("services failed to deploy: %s", strings.Join(failedServiceNames, ", "))
+	}
+
+	return results, nil
+}
+
+// prepare creates the networks and volumes of the project that don't exist
+// yet, without touching any container.
+func (cR *composeReconciler) prepare(ctx context.Context, project *composeProject) error {
+	err := cR.ensureNetworks(ctx, project)
+
+	if err != nil {
+		return err
+	}
+
+	return cR.ensureVolumes(ctx, project)
+}
+
+// projectContainers finds the containers of every service of the project.
+func (cR *composeReconciler) projectContainers(ctx context.Context, projectName string) (map[string][]types.Container, error) {
+	projectFilter := filters.NewArgs()
+
+	projectFilter.Add("label", projectLabel+"="+projectName)
+
+	containers, err := cR.cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: projectFilter,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	serviceContainers := make(map[string][]types.Container)
+
+	for _, serviceContainer := range containers {
+		serviceName := serviceContainer.Labels[serviceLabel]
+
+		serviceContainers[serviceName] = append(serviceContainers[serviceName], serviceContainer)
+	}
+
+	return serviceContainers, nil
+}
+
+func (cR *composeReconciler) ensureNetworks(ctx context.Context, project *composeProject) error {
+	usedNetworks := make(map[string]bool)
+
+	for _, service := range project.Services {
+		if service.NetworkMode != "" {
+			continue
+		}
+
+		if len(service.Networks) == 0 {
+			usedNetworks["default"] = true
+		}
+
+		for networkName := range service.Networks {
+			usedNetworks[networkName] = true
+		}
+	}
+
+	for networkName := range usedNetworks {
+		networkConfig := project.Networks[networkName]
+
+		if networkConfig == nil {
+			networkConfig = &composeNetwork{}
+		}
+
+		dockerNetworkName := project.networkName(networkName)
+
+		_, err := cR.cli.NetworkInspect(ctx, dockerNetworkName)
+
+		if err == nil {
+			continue
+		}
+
+		if !client.IsErrNetworkNotFound(err) {
+			return err
+		}
+
+		if networkConfig.External {
+			return fmt.Errorf("external network %s doesn't exist", dockerNetworkName)
+		}
+
+		labels := composeLabels(networkConfig.Labels)
+
+		labels[projectLabel] = project.Name
+
+		_, err = cR.cli.NetworkCreate(ctx, dockerNetworkName, types.NetworkCreate{
+			CheckDuplicate: true,
+			Driver:         networkConfig.Driver,
+			Options:        networkConfig.DriverOpts,
+			Internal:       networkConfig.Internal,
+			Labels:         labels,
+		})
+
+		if err != nil {
+			return fmt.Errorf("error creating network %s: %w", dockerNetworkName, err)
+		}
+
+		fmt.Printf("created network %s\n", dockerNetworkName)
+	}
+
+	return nil
+}
+
+func (cR *composeReconciler) ensureVolumes(ctx context.Context, project *composeProject) error {
+	for volumeName, volumeConfig := range project.Volumes {
+		if volumeConfig == nil {
+			volumeConfig = &composeVolume{}
+		}
+
+		dockerVolumeName := project.volumeName(volumeName)
+
+		_, err := cR.cli.VolumeInspect(ctx, dockerVolumeName)
+
+		if err == nil {
+			continue
+		}
+
+		if !client.IsErrVolumeNotFound(err) {
+			return err
+		}
+
+		if volumeConfig.External {
+			return fmt.Errorf("external volume %s doesn't exist", dockerVolumeName)
+		}
+
+		labels := composeLabels(volumeConfig.Labels)
+
+		labels[projectLabel] = project.Name
+
+		_, err = cR.cli.VolumeCreate(ctx, volumetypes.VolumesCreateBody{
+			Name:       dockerVolumeName,
+			Driver:     volumeConfig.Driver,
+			DriverOpts: volumeConfig.DriverOpts,
+			Labels:     labels,
+		})
+
+		if err != nil {
+			return fmt.Errorf("error creating volume %s: %w", dockerVolumeName, err)
+		}
+
+		fmt.Printf("created volume %s\n", dockerVolumeName)
+	}
+
+	return nil
+}
+
+// reconcileService leaves the service's container alone if it is running and
+// up to date, otherwise the container is replaced.
+func (cR *composeReconciler) reconcileService(ctx context.Context, project *composeProject, serviceName, commit, pinnedImage string, existingContainers []types.Container) (string, string, string, error) {
+	image := project.Services[serviceName].Image
+
+	if pinnedImage != "" {
+		image = pinnedImage
+	}
+
+	imageID, err := cR.ensureImage(ctx, image)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	spec, err := newServiceSpec(project, serviceName, commit, imageID)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if pinnedImage != "" {
+		spec.Config.Image = pinnedImage
+	}
+
+	if len(existingContainers) == 1 && existingContainers[0].Labels[configHashLabel] == spec.configHashString && existingContainers[0].State == "running" {
+		return serviceUnchanged, existingContainers[0].ID, imageID, nil
+	}
+
+	action := serviceCreated
+
+	replacedMounts := make([]types.MountPoint, 0)
+
+	for _, existingContainer := range existingContainers {
+		action = serviceRecreated
+
+		replacedMounts = append(replacedMounts, existingContainer.Mounts...)
+
+		err = cR.removeContainer(ctx, existingContainer.ID, false)
+
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	// Containers docker-compose started before deploys went through the API
+	// have the same name but none of the labels
+	if len(existingContainers) == 0 {
+		unlabelledContainer, err := cR.cli.ContainerInspect(ctx, spec.containerName)
+
+		if err != nil && !client.IsErrContainerNotFound(err) {
+			return "", "", "", err
+		}
+
+		if err == nil {
+			action = serviceRecreated
+
+			replacedMounts = append(replacedMounts, unlabelledContainer.Mounts...)
+
+			err = cR.removeContainer(ctx, unlabelledContainer.ID, false)
+
+			if err != nil {
+				return "", "", "", err
+			}
+		}
+	}
+
+	err = cR.carryAnonymousVolumes(ctx, spec, replacedMounts)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	containerID, err := cR.startContainer(ctx, spec)
+
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return action, containerID, imageID, nil
+}
+
+// ensureImage returns the ID of the image, pulling it first if it isn't on
+// the host. Images the server deploys are pulled before reconciling, this is
+// for images like databases the compose file refers to directly.
+func (cR *composeReconciler) ensureImage(ctx context.Context, image string) (string, error) {
+	imageInspect, _, err := cR.cli.ImageInspectWithRaw(ctx, image)
+
+	if err == nil {
+		return imageInspect.ID, nil
+	}
+
+	if !client.IsErrImageNotFound(err) {
+		return "", err
+	}
+
+	fmt.Printf("pulling missing image %s\n", image)
+
+	pullContext, cancel := context.WithTimeout(ctx, 10*time.Minute)
+
+	defer cancel()
+
+	err = cR.puller.pull(pullContext, image)
+
+	if err != nil {
+		return "", err
+	}
+
+	imageInspect, _, err = cR.cli.ImageInspectWithRaw(ctx, image)
+
+	if err != nil {
+		return "", err
+	}
+
+	return imageInspect.ID, nil
+}
+
+func (cR *composeReconciler) startContainer(ctx context.Context, spec *serviceSpec) (string, error) {
+	var networkingConfig *network.NetworkingConfig
+
+	if spec.primaryNetwork != "" {
+		networkingConfig = &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				spec.primaryNetwork: {
+					Aliases: spec.NetworkAliases[spec.primaryNetwork],
+				},
+			},
+		}
+	}
+
+	createdContainer, err := cR.cli.ContainerCreate(ctx, spec.Config, spec.HostConfig, networkingConfig, spec.containerName)
+
+	if err != nil {
+		return "", fmt.Errorf("error creating container %s: %w", spec.containerName, err)
+	}
+
+	// Containers can only be created on a single network, the rest are
+	// connected before starting
+	for _, networkName := range spec.networkNames {
+		if networkName == spec.primaryNetwork {
+			continue
+		}
+
+		err = cR.cli.NetworkConnect(ctx, networkName, createdContainer.ID, &network.EndpointSettings{
+			Aliases: spec.NetworkAliases[networkName],
+		})
+
+		if err != nil {
+			return createdContainer.ID, fmt.Errorf("error connecting %s to network %s: %w", spec.containerName, networkName, err)
+		}
+	}
+
+	err = cR.cli.ContainerStart(ctx, createdContainer.ID, types.ContainerStartOptions{})
+
+	if err != nil {
+		return createdContainer.ID, fmt.Errorf("error starting container %s: %w", spec.containerName, err)
+	}
+
+	fmt.Printf("started %s for %s at %s\n", spec.containerName, spec.serviceName, spec.commit)
+
+	return createdContainer.ID, nil
+}
+
+// carryAnonymousVolumes mounts the anonymous volumes of the containers a
+// service's new container replaces into it at the same paths, like
+// docker-compose does, so recreating a service keeps the data in them. Only
+// paths the compose file or the image still declare as anonymous volumes are
+// carried over.
+func (cR *composeReconciler) carryAnonymousVolumes(ctx context.Context, spec *serviceSpec, replacedMounts []types.MountPoint) error {
+	if len(replacedMounts) == 0 {
+		return nil
+	}
+
+	imageInspect, _, err := cR.cli.ImageInspectWithRaw(ctx, spec.ImageID)
+
+	if err != nil {
+		return err
+	}
+
+	anonymousPaths := make(map[string]bool)
+
+	for volumePath := range spec.Config.Volumes {
+		anonymousPaths[filepath.Clean(volumePath)] = true
+	}
+
+	if imageInspect.Config != nil {
+		for volumePath := range imageInspect.Config.Volumes {
+			anonymousPaths[filepath.Clean(volumePath)] = true
+		}
+	}
+
+	// Paths the compose file binds something to are never anonymous
+	for _, bind := range spec.HostConfig.Binds {
+		bindParts := strings.Split(bind, ":")
+
+		delete(anonymousPaths, filepath.Clean(bindParts[1]))
+	}
+
+	for _, replacedMount := range replacedMounts {
+		mountPath := filepath.Clean(replacedMount.Destination)
+
+		if replacedMount.Type != mount.TypeVolume || replacedMount.Name == "" || !anonymousPaths[mountPath] {
+			continue
+		}
+
+		spec.HostConfig.Binds = append(spec.HostConfig.Binds, replacedMount.Name+":"+replacedMount.Destination)
+
+		delete(spec.Config.Volumes, replacedMount.Destination)
+
+		delete(anonymousPaths, mountPath)
+	}
+
+	return nil
+}
+
+// removeContainer stops and removes the container, its anonymous volumes are
+// only removed along with it if removeVolumes is set.
+func (cR *composeReconciler) removeContainer(ctx context.Context, containerID string, removeVolumes bool) error {
+	stopTimeout := serviceStopTimeout
+
+	err := cR.cli.ContainerStop(ctx, containerID, &stopTimeout)
+
+	if err != nil && !client.IsErrContainerNotFound(err) {
+		return fmt.Errorf("error stopping container %s: %w", containerID, err)
+	}
+
+	err = cR.cli.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{
+		RemoveVolumes: removeVolumes,
+		Force:         true,
+	})
+
+	if err != nil && !client.IsErrContainerNotFound(err) {
+		return fmt.Errorf("error removing container %s: %w", containerID, err)
+	}
+
+	return nil
+}
+
+// newServiceSpec translates a compose service into the Docker API's container
+// configuration.
+func newServiceSpec(project *composeProject, serviceName, commit, imageID string) (*serviceSpec, error) {
+	service := project.Services[serviceName]
+
+	spec := &serviceSpec{
+		Config: &container.Config{
+			Image:      service.Image,
+			Cmd:        []string(service.Command),
+			Entrypoint: []string(service.Entrypoint),
+			User:       service.User,
+			WorkingDir: service.WorkingDir,
+			Hostname:   service.Hostname,
+			Labels:     composeLabels(service.Labels),
+			Volumes:    make(map[string]struct{}),
+		},
+		HostConfig: &container.HostConfig{
+			NetworkMode: container.NetworkMode(service.NetworkMode),
+			ExtraHosts:  service.ExtraHosts,
+		},
+		NetworkAliases: make(map[string][]string),
+		ImageID:        imageID,
+		containerName:  project.containerName(serviceName),
+		commit:         commit,
+		serviceName:    serviceName,
+		projectName:    project.Name,
+	}
+
+	environment, err := serviceEnvironment(project, service)
+
+	if err != nil {
+		return nil, err
+	}
+
+	spec.Config.Env = environment
+
+	exposedPorts, portBindings, err := nat.ParsePortSpecs(service.Ports)
+
+	if err != nil {
+		return nil, fmt.Errorf("bad ports for %s: %w", serviceName, err)
+	}
+
+	exposeOnly, _, err := nat.ParsePortSpecs(service.Expose)
+
+	if err != nil {
+		return nil, fmt.Errorf("bad expose for %s: %w", serviceName, err)
+	}
+
+	for port := range exposeOnly {
+		exposedPorts[port] = struct{}{}
+	}
+
+	spec.Config.ExposedPorts = exposedPorts
+	spec.HostConfig.PortBindings = portBindings
+
+	spec.HostConfig.RestartPolicy, err = restartPolicy(service.Restart)
+
+	if err != nil {
+		return nil, fmt.Errorf("bad restart policy for %s: %w", serviceName, err)
+	}
+
+	spec.Config.Healthcheck, err = healthConfig(service.Healthcheck)
+
+	if err != nil {
+		return nil, fmt.Errorf("bad healthcheck for %s: %w", serviceName, err)
+	}
+
+	for _, volumeSpec := range service.Volumes {
+		volumeParts := strings.Split(volumeSpec, ":")
+
+		if len(volumeParts) == 1 {
+			spec.Config.Volumes[volumeParts[0]] = struct{}{}
+
+			continue
+		}
+
+		source := volumeParts[0]
+
+		switch {
+		case source == "~", strings.HasPrefix(source, "~/"):
+			homeDir, err := os.UserHomeDir()
+
+			if err != nil {
+				return nil, fmt.Errorf("can't expand %s for %s: %w", source, serviceName, err)
+			}
+
+			source = filepath.Join(homeDir, filepath.FromSlash(strings.TrimPrefix(source, "~")))
+		case strings.HasPrefix(source, "."):
+			source, err = filepath.Abs(filepath.Join(project.Dir, filepath.FromSlash(source)))
+
+			if err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(source, "/"):
+		default:
+			if _, declared := project.Volumes[source]; !declared {
+				return nil, fmt.Errorf("service %s uses undefined volume %s", serviceName, source)
+			}
+
+			source = project.volumeName(source)
+		}
+
+		volumeParts[0] = source
+
+		spec.HostConfig.Binds = append(spec.HostConfig.Binds, strings.Join(volumeParts, ":"))
+	}
+
+	if service.NetworkMode == "" {
+		serviceNetworks := service.Networks
+
+		if len(serviceNetworks) == 0 {
+			serviceNetworks = composeServiceNetworks{"default": nil}
+		}
+
+		for networkName, aliases := range serviceNetworks {
+			dockerNetworkName := project.networkName(networkName)
+
+			spec.networkNames = append(spec.networkNames, dockerNetworkName)
+
+			spec.NetworkAliases[dockerNetworkName] = append([]string{serviceName}, aliases...)
+		}
+
+		sort.Strings(spec.networkNames)
+
+		spec.primaryNetwork = spec.networkNames[0]
+		spec.HostConfig.NetworkMode = container.NetworkMode(spec.primaryNetwork)
+	}
+
+	specBytes, err := json.Marshal(spec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	configHash := sha256.Sum256(specBytes)
+
+	spec.configHashString = hex.EncodeToString(configHash[:])
+
+	spec.settingHashes, err = hashSettings(map[string]interface{}{
+		"image":       spec.ImageID,
+		"command":     spec.Config.Cmd,
+		"entrypoint":  spec.Config.Entrypoint,
+		"environment": spec.Config.Env,
+		"labels":      spec.Config.Labels,
+		"ports":       []interface{}{spec.Config.ExposedPorts, spec.HostConfig.PortBindings},
+		"volumes":     []interface{}{spec.Config.Volumes, spec.HostConfig.Binds},
+		"networks":    []interface{}{spec.HostConfig.NetworkMode, spec.NetworkAliases},
+		"restart":     spec.HostConfig.RestartPolicy,
+		"healthcheck": spec.Config.Healthcheck,
+		"user":        spec.Config.User,
+		"working_dir": spec.Config.WorkingDir,
+		"hostname":    spec.Config.Hostname,
+		"extra_hosts": spec.HostConfig.ExtraHosts,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	settingHashesBytes, err := json.Marshal(spec.settingHashes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// The commit is left out of the hash, a new commit that changes nothing
+	// about a service leaves its container running
+	spec.Config.Labels[projectLabel] = project.Name
+	spec.Config.Labels[serviceLabel] = serviceName
+	spec.Config.Labels[commitLabel] = commit
+	spec.Config.Labels[configHashLabel] = spec.configHashString
+	spec.Config.Labels[settingHashesLabel] = string(settingHashesBytes)
+
+	return spec, nil
+}
+
+// hashSettings hashes every setting on its own, short hashes are plenty to
+// tell whether a setting changed.
+func hashSettings(settings map[string]interface{}) (map[string]string, error) {
+	settingHashes := make(map[string]string, len(settings))
+
+	for settingName, setting := range settings {
+		settingBytes, err := json.Marshal(setting)
+
+		if err != nil {
+			return nil, err
+		}
+
+		settingHash := sha256.Sum256(settingBytes)
+
+		settingHashes[settingName] = hex.EncodeToString(settingHash[:8])
+	}
+
+	return settingHashes, nil
+}
+
+// serviceEnvironment merges the service's env files and environment, the
+// latter taking precedence, into sorted KEY=value pairs.
+func serviceEnvironment(project *composeProject, service *composeService) ([]string, error) {
+	envVars := make(map[string]string)
+
+	for _, envFile := range service.EnvFile {
+		envFileVars, err := readEnvFile(project.readFile, envFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading env file %s: %w", envFile, err)
+		}
+
+		for key, value := range envFileVars {
+			envVars[key] = value
+		}
+	}
+
+	for key, value := range service.Environment {
+		if value == nil {
+			// Like compose, a variable without a value is taken from the
+			// environment the project was loaded with, the app's secrets, or
+			// from the host
+			hostValue, exists := project.Environment[key]
+
+			if !exists {
+				hostValue, exists = os.LookupEnv(key)
+			}
+
+			if !exists {
+				continue
+			}
+
+			value = &hostValue
+		}
+
+		envVars[key] = *value
+	}
+
+	environment := make([]string, 0, len(envVars))
+
+	for key, value := range envVars {
+		environment = append(environment, key+"="+value)
+	}
+
+	sort.Strings(environment)
+
+	return environment, nil
+}
+
+func composeLabels(labels composeMapping) map[string]string {
+	dockerLabels := make(map[string]string, len(labels))
+
+	for key, value := range labels {
+		if value != nil {
+			dockerLabels[key] = *value
+		} else {
+			dockerLabels[key] = ""
+		}
+	}
+
+	return dockerLabels
+}
+
+func healthConfig(healthcheck *composeHealthcheck) (*container.HealthConfig, error) {
+	if healthcheck == nil {
+		return nil, nil
+	}
+
+	if healthcheck.Disable {
+		return &container.HealthConfig{Test: []string{"NONE"}}, nil
+	}
+
+	dockerHealthConfig := &container.HealthConfig{
+		Test:    healthcheck.Test,
+		Retries: healthcheck.Retries,
+	}
+
+	for _, duration := range []struct {
+		value  string
+		target *time.Duration
+	}{
+		{healthcheck.Interval, &dockerHealthConfig.Interval},
+		{healthcheck.Timeout, &dockerHealthConfig.Timeout},
+	} {
+		if duration.value == "" {
+			continue
+		}
+
+		parsedDuration, err := time.ParseDuration(duration.value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		*duration.target = parsedDuration
+	}
+
+	return dockerHealthConfig, nil
+}
+
+func restartPolicy(restart string) (container.RestartPolicy, error) {
+	restartParts := strings.SplitN(restart, ":", 2)
+
+	switch restartParts[0] {
+	case "", "no":
+		return container.RestartPolicy{}, nil
+	case "always", "unless-stopped":
+		return container.RestartPolicy{Name: restartParts[0]}, nil
+	case "on-failure":
+		policy := container.RestartPolicy{Name: "on-failure"}
+
+		if len(restartParts) == 2 {
+			maximumRetryCount, err := strconv.Atoi(restartParts[1])
+
+			if err != nil {
+				return container.RestartPolicy{}, err
+			}
+
+			policy.MaximumRetryCount = maximumRetryCount
+		}
+
+		return policy, nil
+	default:
+		return container.RestartPolicy{}, fmt.Errorf("unknown restart policy %q", restart)
+	}
+}
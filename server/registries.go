@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"gopkg.in/yaml.v2"
+)
+
+// dockerHubRegistry is the host images without one are pulled from, along
+// with the other names docker knows it by.
+const dockerHubRegistry = "docker.io"
+
+var dockerHubAliases = []string{"index.docker.io", "registry-1.docker.io", "registry.hub.docker.com"}
+
+// registryCredentials holds the credentials for pulling images from private
+// registries, by registry host.
+type registryCredentials struct {
+	auths map[string]types.AuthConfig
+}
+
+// loadRegistryCredentials reads credentials from a docker config.json and a
+// secrets file, the secrets file winning for registries found in both.
+// Either file may be missing. Credential helpers in config.json aren't run,
+// their registries need their credentials in the secrets file.
+func loadRegistryCredentials(dockerConfigPath, secretsPath string) (*registryCredentials, error) {
+	rC := &registryCredentials{
+		auths: make(map[string]types.AuthConfig),
+	}
+
+	var dockerConfig struct {
+		Auths       map[string]types.AuthConfig `json:"auths"`
+		CredsStore  string                      `json:"credsStore"`
+		CredHelpers map[string]string           `json:"credHelpers"`
+	}
+
+	err := readJSONFile(dockerConfigPath, &dockerConfig)
+
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", dockerConfigPath, err)
+	}
+
+	if dockerConfig.CredsStore != "" || len(dockerConfig.CredHelpers) != 0 {
+		fmt.Printf("%s uses credential helpers, which aren't supported, only the credentials stored in it are used\n", dockerConfigPath)
+	}
+
+	for registryHost, authConfig := range dockerConfig.Auths {
+		// config.json keeps the username and password base64 encoded together
+		if authConfig.Auth != "" && authConfig.Username == "" {
+			credentialBytes, err := base64.StdEncoding.DecodeString(authConfig.Auth)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s in %s: %w", registryHost, dockerConfigPath, err)
+			}
+
+			credentialParts := strings.SplitN(string(credentialBytes), ":", 2)
+
+			if len(credentialParts) != 2 {
+				return nil, fmt.Errorf("invalid auth for %s in %s", registryHost, dockerConfigPath)
+			}
+
+			authConfig.Username, authConfig.Password = credentialParts[0], credentialParts[1]
+		}
+
+		authConfig.Auth = ""
+
+		rC.add(registryHost, authConfig)
+	}
+
+	secretsBytes, err := ioutil.ReadFile(secretsPath)
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var secrets struct {
+		Registries map[string]struct {
+			Username      string `yaml:"username"`
+			Password      string `yaml:"password"`
+			IdentityToken string `yaml:"identityToken"`
+		} `yaml:"registries"`
+	}
+
+	err = yaml.UnmarshalStrict(secretsBytes, &secrets)
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", secretsPath, err)
+	}
+
+	for registryHost, credentials := range secrets.Registries {
+		rC.add(registryHost, types.AuthConfig{
+			Username:      credentials.Username,
+			Password:      credentials.Password,
+			IdentityToken: credentials.IdentityToken,
+		})
+	}
+
+	return rC, nil
+}
+
+func (rC *registryCredentials) add(registryHost string, authConfig types.AuthConfig) {
+	registryHost = normalizeRegistryHost(registryHost)
+
+	authConfig.ServerAddress = registryHost
+
+	rC.auths[registryHost] = authConfig
+}
+
+// registryAuth is the encoded credentials for pulling image, ready for
+// ImagePullOptions.RegistryAuth. Images from registries without credentials
+// get an empty string and are pulled anonymously.
+func (rC *registryCredentials) registryAuth(image string) (string, error) {
+	authConfig, exists := rC.auths[imageRegistryHost(image)]
+
+	if !exists {
+		return "", nil
+	}
+
+	authConfigBytes, err := json.Marshal(authConfig)
+
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(authConfigBytes), nil
+}
+
+// hosts lists the registries there are credentials for.
+func (rC *registryCredentials) hosts() []string {
+	registryHosts := make([]string, 0, len(rC.auths))
+
+	for registryHost := range rC.auths {
+		registryHosts = append(registryHosts, registryHost)
+	}
+
+	return registryHosts
+}
+
+// normalizeRegistryHost turns the ways a registry is written in config.json,
+// like https://index.docker.io/v1/, into the host images name it by.
+func normalizeRegistryHost(registryHost string) string {
+	registryHost = strings.ToLower(registryHost)
+
+	registryHost = strings.TrimPrefix(registryHost, "https://")
+	registryHost = strings.TrimPrefix(registryHost, "http://")
+
+	if slashIndex := strings.Index(registryHost, "/"); slashIndex != -1 {
+		registryHost = registryHost[:slashIndex]
+	}
+
+	for _, dockerHubAlias := range dockerHubAliases {
+		if registryHost == dockerHubAlias {
+			return dockerHubRegistry
+		}
+	}
+
+	return registryHost
+}
+
+// imageRegistryHost is the registry an image is pulled from, the first part
+// of its name if that looks like a host and Docker Hub otherwise.
+func imageRegistryHost(image string) string {
+	slashIndex := strings.Index(image, "/")
+
+	if slashIndex == -1 {
+		return dockerHubRegistry
+	}
+
+	firstPart := image[:slashIndex]
+
+	if !strings.ContainsAny(firstPart, ".:") && firstPart != "localhost" {
+		return dockerHubRegistry
+	}
+
+	return normalizeRegistryHost(firstPart)
+}
+
+// defaultDockerConfigPath is where the docker CLI keeps its config.json.
+func defaultDockerConfigPath() string {
+	if dockerConfigDir := os.Getenv("DOCKER_CONFIG"); dockerConfigDir != "" {
+		return filepath.Join(dockerConfigDir, "config.json")
+	}
+
+	homeDir, err := os.UserHomeDir()
+
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(homeDir, ".docker", "config.json")
+}
@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestImageRegistryHost(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"nginx", "docker.io"},
+		{"nginx:alpine", "docker.io"},
+		{"rileyj/web:1.2.3", "docker.io"},
+		{"docker.io/rileyj/web", "docker.io"},
+		{"index.docker.io/rileyj/web", "docker.io"},
+		{"registry-1.docker.io/rileyj/web", "docker.io"},
+		{"ghcr.io/rileyj/web:main", "ghcr.io"},
+		{"Registry.Example.com/team/web", "registry.example.com"},
+		{"localhost/web", "localhost"},
+		{"localhost:5000/web:1.2.3", "localhost:5000"},
+		{"10.0.0.5:5000/web", "10.0.0.5:5000"},
+	}
+
+	for _, test := range tests {
+		if got := imageRegistryHost(test.image); got != test.want {
+			t.Errorf("imageRegistryHost(%q) = %q, want %q", test.image, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeRegistryHost(t *testing.T) {
+	tests := []struct {
+		registryHost string
+		want         string
+	}{
+		{"https://index.docker.io/v1/", "docker.io"},
+		{"registry.hub.docker.com", "docker.io"},
+		{"http://localhost:5000", "localhost:5000"},
+		{"GHCR.io", "ghcr.io"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeRegistryHost(test.registryHost); got != test.want {
+			t.Errorf("normalizeRegistryHost(%q) = %q, want %q", test.registryHost, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	releaseDeploying  = "deploying"
+	releaseSucceeded  = "succeeded"
+	releaseFailed     = "failed"
+	releaseRolledBack = "rolled-back"
+	releaseSuperseded = "superseded"
+	// Releases of apps that need approval wait for it before deploying, if
+	// they aren't approved in time they expire
+	releasePendingApproval = "pending-approval"
+	releaseRejected        = "rejected"
+	releaseExpired         = "expired"
+)
+
+// maxReleases is how many releases are kept for every app, the oldest are
+// forgotten first.
+const maxReleases = 100
+
+var (
+	errReleaseNotFound   = errors.New("release not found")
+	errReleaseNotPending = errors.New("release isn't waiting for approval")
+	errApprovalExpired   = errors.New("approval expired")
+)
+
+// releaseApproval is when a release waiting for approval has to be decided
+// on by, and who decided what.
+type releaseApproval struct {
+	Deadline  time.Time `json:"deadline"`
+	DecidedBy string    `json:"decidedBy,omitempty"`
+	DecidedAt time.Time `json:"decidedAt"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// release is one deploy of an app, with the exact images and compose
+// revision it ran so a successful one can be brought back later. Failed
+// deploys that were rolled back name the release they went back to. Until a
+// release is deployed BuiltImages has the images the worker pushed for it,
+// by BuildInfo name.
+type release struct {
+	ID              string                  `json:"id"`
+	App             string                  `json:"app"`
+	Environment     string                  `json:"environment,omitempty"`
+	JobID           string                  `json:"jobId,omitempty"`
+	Trigger         string                  `json:"trigger"`
+	Ref             string                  `json:"ref,omitempty"`
+	Commit          string                  `json:"commit"`
+	ComposeRevision string                  `json:"composeRevision,omitempty"`
+	Images          map[string]string       `json:"images,omitempty"`
+	BuiltImages     map[string]string       `json:"builtImages,omitempty"`
+	Approval        *releaseApproval        `json:"approval,omitempty"`
+	ProjectMetadata uyghurs.ProjectMetadata `json:"projectMetadata"`
+	Services        []serviceResult         `json:"services,omitempty"`
+	Hooks           []hookResult            `json:"hooks,omitempty"`
+	Outcome         string                  `json:"outcome"`
+	Err             string                  `json:"err,omitempty"`
+	RolledBackTo    string                  `json:"rolledBackTo,omitempty"`
+	QueuedAt        time.Time               `json:"queuedAt"`
+	StartedAt       time.Time               `json:"startedAt"`
+	FinishedAt      time.Time               `json:"finishedAt"`
+}
+
+// releaseStore is the on-disk history of every app's releases, newest last.
+// The newest successful release of an app is its known-good release, a
+// deploy that doesn't come up ready is rolled back to it.
+type releaseStore struct {
+	releasesPath string
+	releases     map[string][]*release
+	lock         *sync.Mutex
+}
+
+// newReleaseStore loads the release history, releases that were still
+// deploying when the server stopped are marked failed. Releases waiting for
+// approval keep waiting.
+func newReleaseStore(releasesPath string) (*releaseStore, error) {
+	rS := &releaseStore{
+		releasesPath: releasesPath,
+		releases:     make(map[string][]*release),
+		lock:         &sync.Mutex{},
+	}
+
+	err := readJSONFile(rS.releasesPath, &rS.releases)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, appReleases := range rS.releases {
+		for _, appRelease := range appReleases {
+			if appRelease.Outcome == releaseDeploying {
+				appRelease.Outcome = releaseFailed
+				appRelease.Err = "server stopped while deploying"
+				appRelease.FinishedAt = time.Now()
+			}
+		}
+	}
+
+	return rS, nil
+}
+
+// start records a release that is being deployed, it is given an ID if it
+// has none.
+func (rS *releaseStore) start(newRelease *release) error {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	if newRelease.ID == "" {
+		newRelease.ID = newRandomID()
+	}
+
+	newRelease.Outcome = releaseDeploying
+	newRelease.StartedAt = time.Now()
+
+	return rS.add(newRelease)
+}
+
+func (rS *releaseStore) add(newRelease *release) error {
+	releaseCopy := *newRelease
+
+	appReleases := append(rS.releases[newRelease.App], &releaseCopy)
+
+	if len(appReleases) > maxReleases {
+		appReleases = appReleases[len(appReleases)-maxReleases:]
+	}
+
+	rS.releases[newRelease.App] = appReleases
+
+	return writeJSONFile(rS.releasesPath, rS.releases)
+}
+
+// await records a release that waits for approval until deadline, older
+// releases of the app still waiting are superseded by it and returned.
+func (rS *releaseStore) await(newRelease *release, deadline time.Time) ([]*release, error) {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	if newRelease.ID == "" {
+		newRelease.ID = newRandomID()
+	}
+
+	newRelease.Outcome = releasePendingApproval
+	newRelease.Approval = &releaseApproval{Deadline: deadline}
+
+	supersededReleases := make([]*release, 0)
+
+	for _, appRelease := range rS.releases[newRelease.App] {
+		if appRelease.Outcome != releasePendingApproval {
+			continue
+		}
+
+		appRelease.Outcome = releaseSuperseded
+		appRelease.Err = "superseded by release " + newRelease.ID
+		appRelease.FinishedAt = time.Now()
+
+		releaseCopy := *appRelease
+
+		supersededReleases = append(supersededReleases, &releaseCopy)
+	}
+
+	return supersededReleases, rS.add(newRelease)
+}
+
+// decide approves or rejects a release waiting for approval, an approved
+// release is started. Deciding on a release past its deadline expires it,
+// the expired release is returned along with errApprovalExpired.
+func (rS *releaseStore) decide(appName, releaseID string, approved bool, decidedBy, reason string) (*release, error) {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	for _, appRelease := range rS.releases[appName] {
+		if appRelease.ID != releaseID {
+			continue
+		}
+
+		if appRelease.Outcome != releasePendingApproval {
+			return nil, errReleaseNotPending
+		}
+
+		approval := *appRelease.Approval
+
+		appRelease.Approval = &approval
+
+		if time.Now().After(approval.Deadline) {
+			rS.expire(appRelease)
+
+			err := writeJSONFile(rS.releasesPath, rS.releases)
+
+			if err != nil {
+				return nil, err
+			}
+
+			releaseCopy := *appRelease
+
+			return &releaseCopy, errApprovalExpired
+		}
+
+		approval.DecidedBy = decidedBy
+		approval.DecidedAt = time.Now()
+		approval.Reason = reason
+
+		if approved {
+			appRelease.Outcome = releaseDeploying
+			appRelease.StartedAt = time.Now()
+		} else {
+			appRelease.Outcome = releaseRejected
+			appRelease.Err = "rejected by " + decidedBy
+			appRelease.FinishedAt = time.Now()
+
+			if reason != "" {
+				appRelease.Err += ": " + reason
+			}
+		}
+
+		releaseCopy := *appRelease
+
+		return &releaseCopy, writeJSONFile(rS.releasesPath, rS.releases)
+	}
+
+	return nil, errReleaseNotFound
+}
+
+// expireApprovals expires every release whose approval deadline passed and
+// returns them.
+func (rS *releaseStore) expireApprovals() ([]*release, error) {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	expiredReleases := make([]*release, 0)
+
+	for _, appReleases := range rS.releases {
+		for _, appRelease := range appReleases {
+			if appRelease.Outcome != releasePendingApproval || time.Now().Before(appRelease.Approval.Deadline) {
+				continue
+			}
+
+			rS.expire(appRelease)
+
+			releaseCopy := *appRelease
+
+			expiredReleases = append(expiredReleases, &releaseCopy)
+		}
+	}
+
+	if len(expiredReleases) == 0 {
+		return expiredReleases, nil
+	}
+
+	return expiredReleases, writeJSONFile(rS.releasesPath, rS.releases)
+}
+
+func (rS *releaseStore) expire(appRelease *release) {
+	appRelease.Outcome = releaseExpired
+	appRelease.Err = "not approved by " + appRelease.Approval.Deadline.Format(time.RFC3339)
+	appRelease.FinishedAt = time.Now()
+}
+
+// pendingApproval lists the releases of every app waiting for approval,
+// oldest first.
+func (rS *releaseStore) pendingApproval() []*release {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	pendingReleases := make([]*release, 0)
+
+	for _, appReleases := range rS.releases {
+		for _, appRelease := range appReleases {
+			if appRelease.Outcome == releasePendingApproval {
+				releaseCopy := *appRelease
+
+				pendingReleases = append(pendingReleases, &releaseCopy)
+			}
+		}
+	}
+
+	sort.Slice(pendingReleases, func(i, j int) bool {
+		return pendingReleases[i].QueuedAt.Before(pendingReleases[j].QueuedAt)
+	})
+
+	return pendingReleases
+}
+
+// finish records how a started release ended, failed with errString if it
+// isn't empty and rolled back if it names a release it went back to.
+func (rS *releaseStore) finish(finishedRelease *release, errString string) error {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	finishedRelease.Outcome = releaseSucceeded
+	finishedRelease.Err = errString
+	finishedRelease.FinishedAt = time.Now()
+
+	if errString != "" {
+		finishedRelease.Outcome = releaseFailed
+
+		if finishedRelease.RolledBackTo != "" {
+			finishedRelease.Outcome = releaseRolledBack
+		}
+	}
+
+	return rS.replace(finishedRelease)
+}
+
+// supersede records that a started release was never deployed, a newer
+// deploy of the app replaced it before it got its turn.
+func (rS *releaseStore) supersede(supersededRelease *release, reason string) error {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	supersededRelease.Outcome = releaseSuperseded
+	supersededRelease.Err = reason
+	supersededRelease.FinishedAt = time.Now()
+
+	return rS.replace(supersededRelease)
+}
+
+func (rS *releaseStore) replace(updatedRelease *release) error {
+	for index, appRelease := range rS.releases[updatedRelease.App] {
+		if appRelease.ID == updatedRelease.ID {
+			releaseCopy := *updatedRelease
+
+			rS.releases[updatedRelease.App][index] = &releaseCopy
+
+			return writeJSONFile(rS.releasesPath, rS.releases)
+		}
+	}
+
+	return errReleaseNotFound
+}
+
+// lastKnownGood is the newest successful release of the app.
+func (rS *releaseStore) lastKnownGood(appName string) (*release, bool) {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	appReleases := rS.releases[appName]
+
+	for index := len(appReleases) - 1; index >= 0; index-- {
+		if appReleases[index].Outcome == releaseSucceeded {
+			releaseCopy := *appReleases[index]
+
+			return &releaseCopy, true
+		}
+	}
+
+	return nil, false
+}
+
+func (rS *releaseStore) get(appName, releaseID string) (*release, error) {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	for _, appRelease := range rS.releases[appName] {
+		if appRelease.ID == releaseID {
+			releaseCopy := *appRelease
+
+			return &releaseCopy, nil
+		}
+	}
+
+	return nil, errReleaseNotFound
+}
+
+// list returns the app's releases, newest first.
+func (rS *releaseStore) list(appName string) []*release {
+	rS.lock.Lock()
+
+	defer rS.lock.Unlock()
+
+	appReleases := rS.releases[appName]
+
+	releases := make([]*release, 0, len(appReleases))
+
+	for index := len(appReleases) - 1; index >= 0; index-- {
+		releaseCopy := *appReleases[index]
+
+		releases = append(releases, &releaseCopy)
+	}
+
+	return releases
+}
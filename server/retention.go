@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+const (
+	imageKept        = "kept"
+	imageProtected   = "protected"
+	imageRemoved     = "removed"
+	imageWouldRemove = "would-remove"
+	imageFailed      = "failed"
+)
+
+// imageCleanupEntry is what a cleanup did, or would have done, with one of
+// the images built for an app.
+type imageCleanupEntry struct {
+	App     string   `json:"app"`
+	Build   string   `json:"build"`
+	ImageID string   `json:"imageId"`
+	Tags    []string `json:"tags"`
+	Size    int64    `json:"size"`
+	Action  string   `json:"action"`
+	Reason  string   `json:"reason,omitempty"`
+	Err     string   `json:"err,omitempty"`
+}
+
+type imageCleanupReport struct {
+	DryRun         bool                 `json:"dryRun"`
+	StartedAt      time.Time            `json:"startedAt"`
+	Images         []*imageCleanupEntry `json:"images"`
+	ReclaimedBytes int64                `json:"reclaimedBytes"`
+}
+
+// imageCleaner removes old images built for apps, keeping the newest
+// KeepImages of every BuildInfo name. Images used by a container, running or
+// not, or by one of an app's newest KeepImages successful releases, which
+// failed deploys are rolled back to, are never removed. Older releases can
+// only be rolled back to while their images are still around.
+type imageCleaner struct {
+	cli      *client.Client
+	releases *releaseStore
+	lock     *sync.Mutex
+}
+
+func newImageCleaner(cli *client.Client, releases *releaseStore) *imageCleaner {
+	return &imageCleaner{
+		cli:      cli,
+		releases: releases,
+		lock:     &sync.Mutex{},
+	}
+}
+
+// cleanup cleans up the images of apps, with dryRun nothing is removed and
+// the report says what would have been.
+func (iC *imageCleaner) cleanup(ctx context.Context, apps []*appConfig, dryRun bool) (*imageCleanupReport, error) {
+	iC.lock.Lock()
+
+	defer iC.lock.Unlock()
+
+	report := &imageCleanupReport{
+		DryRun:    dryRun,
+		StartedAt: time.Now(),
+		Images:    make([]*imageCleanupEntry, 0),
+	}
+
+	images, err := iC.cli.ImageList(ctx, types.ImageListOptions{})
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %w", err)
+	}
+
+	containers, err := iC.cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+
+	if err != nil {
+		return nil, fmt.Errorf("error listing containers: %w", err)
+	}
+
+	usedImages := make(map[string]string)
+
+	for _, container := range containers {
+		containerName := container.ID
+
+		if len(container.Names) != 0 {
+			containerName = container.Names[0]
+		}
+
+		usedImages[container.ImageID] = fmt.Sprintf("used by container %s", containerName)
+	}
+
+	seenImages := make(map[string]bool)
+
+	for _, app := range apps {
+		if app.KeepImages < 1 {
+			continue
+		}
+
+		for _, entry := range iC.planApp(app, images, usedImages) {
+			if seenImages[entry.ImageID] {
+				continue
+			}
+
+			seenImages[entry.ImageID] = true
+
+			report.Images = append(report.Images, entry)
+		}
+	}
+
+	for _, entry := range report.Images {
+		if entry.Action != imageWouldRemove {
+			continue
+		}
+
+		if dryRun {
+			report.ReclaimedBytes += entry.Size
+
+			continue
+		}
+
+		_, err := iC.cli.ImageRemove(ctx, entry.ImageID, types.ImageRemoveOptions{PruneChildren: true})
+
+		if err != nil {
+			entry.Action = imageFailed
+			entry.Err = err.Error()
+
+			continue
+		}
+
+		entry.Action = imageRemoved
+
+		report.ReclaimedBytes += entry.Size
+	}
+
+	return report, nil
+}
+
+// planApp decides what happens to each of the app's images, ranking the
+// images of every build by when a release last ran them, or by when they
+// were created for images no release ran.
+func (iC *imageCleaner) planApp(app *appConfig, images []types.ImageSummary, usedImages map[string]string) []*imageCleanupEntry {
+	appReleases := iC.releases.list(app.App)
+
+	buildNames := make(map[string]bool)
+
+	lastReleased := make(map[string]time.Time)
+
+	protectedImages := make(map[string]string)
+
+	rollbackReleases := 0
+
+	for _, appRelease := range appReleases {
+		for _, buildInfo := range appRelease.ProjectMetadata.BuildsInfo {
+			buildNames[buildInfo.Name] = true
+		}
+
+		for _, imageID := range appRelease.Images {
+			if appRelease.StartedAt.After(lastReleased[imageID]) {
+				lastReleased[imageID] = appRelease.StartedAt
+			}
+		}
+
+		if appRelease.Outcome != releaseSucceeded || rollbackReleases >= app.KeepImages {
+			continue
+		}
+
+		rollbackReleases++
+
+		for _, imageID := range appRelease.Images {
+			if _, protected := protectedImages[imageID]; !protected {
+				protectedImages[imageID] = fmt.Sprintf("release %s can be rolled back to", appRelease.ID)
+			}
+		}
+	}
+
+	entries := make([]*imageCleanupEntry, 0)
+
+	for buildName := range buildNames {
+		repository := imageRepository(app.imageName(buildName))
+
+		buildImages := make([]types.ImageSummary, 0)
+
+		for _, image := range images {
+			if imageInRepository(image, repository) {
+				buildImages = append(buildImages, image)
+			}
+		}
+
+		imageRank := func(image types.ImageSummary) time.Time {
+			if releasedAt, released := lastReleased[image.ID]; released {
+				return releasedAt
+			}
+
+			return time.Unix(image.Created, 0)
+		}
+
+		sort.Slice(buildImages, func(i, j int) bool {
+			return imageRank(buildImages[i]).After(imageRank(buildImages[j]))
+		})
+
+		for index, image := range buildImages {
+			entry := &imageCleanupEntry{
+				App:     app.App,
+				Build:   buildName,
+				ImageID: image.ID,
+				Tags:    append(append([]string{}, image.RepoTags...), image.RepoDigests...),
+				Size:    image.Size,
+				Action:  imageWouldRemove,
+			}
+
+			if index < app.KeepImages {
+				entry.Action = imageKept
+				entry.Reason = fmt.Sprintf("one of the newest %d", app.KeepImages)
+			} else if reason, used := usedImages[image.ID]; used {
+				entry.Action = imageProtected
+				entry.Reason = reason
+			} else if reason, protected := protectedImages[image.ID]; protected {
+				entry.Action = imageProtected
+				entry.Reason = reason
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Build < entries[j].Build
+	})
+
+	return entries
+}
+
+// removedImages lists the images of a release that are no longer on the
+// host, a release whose images were cleaned up can't be rolled back to.
+func (iC *imageCleaner) removedImages(ctx context.Context, appRelease *release) ([]string, error) {
+	removed := make([]string, 0)
+
+	for serviceName, imageID := range appRelease.Images {
+		_, _, err := iC.cli.ImageInspectWithRaw(ctx, imageID)
+
+		if client.IsErrImageNotFound(err) {
+			removed = append(removed, fmt.Sprintf("%s of %s", imageID, serviceName))
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Strings(removed)
+
+	return removed, nil
+}
+
+// imageInRepository checks whether any of an image's tags or digests are in
+// repository, a name without a tag.
+func imageInRepository(image types.ImageSummary, repository string) bool {
+	for _, references := range [][]string{image.RepoTags, image.RepoDigests} {
+		for _, reference := range references {
+			if imageRepository(reference) == repository {
+				return true
+			}
+		}
+	}
+
+	return false
+}
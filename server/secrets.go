@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+var (
+	secretNameRegex  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	environmentRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+)
+
+var (
+	errSecretNotFound   = errors.New("secret not found")
+	errSecretsNoKey     = errors.New("secrets are disabled, UYGHURS_KEY is not set")
+	errSecretsWrongKey  = errors.New("secret can't be decrypted, UYGHURS_KEY changed since it was set")
+	errInvalidSecretKey = errors.New("UYGHURS_KEY must be 32 bytes, hex or base64 encoded")
+)
+
+// storedSecret is a secret as kept on disk, Value is base64 of the nonce
+// followed by the sealed value.
+type storedSecret struct {
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// secretInfo describes a secret without giving its value away.
+type secretInfo struct {
+	Name      string    `json:"name"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// secretStore keeps the secrets of every app's environments encrypted at
+// rest with AES-256-GCM, by app, then environment, then name. Values are
+// sealed along with where they belong, so a value moved to another secret in
+// the file won't decrypt.
+type secretStore struct {
+	secretsPath string
+	aead        cipher.AEAD
+	secrets     map[string]map[string]map[string]*storedSecret
+	lock        *sync.Mutex
+}
+
+// newSecretStore loads the secrets at secretsPath, without a key in
+// uyghursSecrets the store can't be read or written but deploys still work
+// as long as no secrets were set.
+func newSecretStore(secretsPath string, uyghursSecrets uyghurs.UyghursSecrets) (*secretStore, error) {
+	sS := &secretStore{
+		secretsPath: secretsPath,
+		secrets:     make(map[string]map[string]map[string]*storedSecret),
+		lock:        &sync.Mutex{},
+	}
+
+	err := readJSONFile(sS.secretsPath, &sS.secrets)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if uyghursSecrets.UyghursKey == "" {
+		return sS, nil
+	}
+
+	key, err := decodeSecretKey(uyghursSecrets.UyghursKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sS.aead, err = cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sS, nil
+}
+
+// decodeSecretKey accepts a 32 byte key as hex, like `openssl rand -hex 32`
+// prints, or as base64.
+func decodeSecretKey(encodedKey string) ([]byte, error) {
+	if key, err := hex.DecodeString(encodedKey); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	if key, err := base64.StdEncoding.DecodeString(encodedKey); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	return nil, errInvalidSecretKey
+}
+
+func validateSecretName(environment, name string) error {
+	if !environmentRegex.MatchString(environment) {
+		return fmt.Errorf("invalid environment %q", environment)
+	}
+
+	if !secretNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid secret name %q, expected a variable name like DB_PASSWORD", name)
+	}
+
+	return nil
+}
+
+func secretAdditionalData(app, environment, name string) []byte {
+	return []byte(app + "/" + environment + "/" + name)
+}
+
+// set encrypts and stores a secret, replacing any it already had.
+func (sS *secretStore) set(app, environment, name, value string) error {
+	err := validateSecretName(environment, name)
+
+	if err != nil {
+		return err
+	}
+
+	if sS.aead == nil {
+		return errSecretsNoKey
+	}
+
+	nonce := make([]byte, sS.aead.NonceSize())
+
+	_, err = rand.Read(nonce)
+
+	if err != nil {
+		return err
+	}
+
+	sealedValue := sS.aead.Seal(nonce, nonce, []byte(value), secretAdditionalData(app, environment, name))
+
+	sS.lock.Lock()
+
+	defer sS.lock.Unlock()
+
+	if sS.secrets[app] == nil {
+		sS.secrets[app] = make(map[string]map[string]*storedSecret)
+	}
+
+	if sS.secrets[app][environment] == nil {
+		sS.secrets[app][environment] = make(map[string]*storedSecret)
+	}
+
+	sS.secrets[app][environment][name] = &storedSecret{
+		Value:     base64.StdEncoding.EncodeToString(sealedValue),
+		UpdatedAt: time.Now(),
+	}
+
+	return writeJSONFile(sS.secretsPath, sS.secrets)
+}
+
+func (sS *secretStore) delete(app, environment, name string) error {
+	sS.lock.Lock()
+
+	defer sS.lock.Unlock()
+
+	if _, exists := sS.secrets[app][environment][name]; !exists {
+		return errSecretNotFound
+	}
+
+	delete(sS.secrets[app][environment], name)
+
+	if len(sS.secrets[app][environment]) == 0 {
+		delete(sS.secrets[app], environment)
+	}
+
+	if len(sS.secrets[app]) == 0 {
+		delete(sS.secrets, app)
+	}
+
+	return writeJSONFile(sS.secretsPath, sS.secrets)
+}
+
+// list names the secrets of an app's environment, sorted by name.
+func (sS *secretStore) list(app, environment string) []secretInfo {
+	sS.lock.Lock()
+
+	defer sS.lock.Unlock()
+
+	secretInfos := make([]secretInfo, 0, len(sS.secrets[app][environment]))
+
+	for name, secret := range sS.secrets[app][environment] {
+		secretInfos = append(secretInfos, secretInfo{Name: name, UpdatedAt: secret.UpdatedAt})
+	}
+
+	sort.Slice(secretInfos, func(i, j int) bool {
+		return secretInfos[i].Name < secretInfos[j].Name
+	})
+
+	return secretInfos
+}
+
+// environment decrypts every secret of an app's environment for a deploy,
+// the values only ever live in memory.
+func (sS *secretStore) environment(app, environment string) (map[string]string, error) {
+	sS.lock.Lock()
+
+	defer sS.lock.Unlock()
+
+	secretValues := make(map[string]string, len(sS.secrets[app][environment]))
+
+	if len(sS.secrets[app][environment]) == 0 {
+		return secretValues, nil
+	}
+
+	if sS.aead == nil {
+		return nil, errSecretsNoKey
+	}
+
+	for name, secret := range sS.secrets[app][environment] {
+		sealedValue, err := base64.StdEncoding.DecodeString(secret.Value)
+
+		if err != nil || len(sealedValue) < sS.aead.NonceSize() {
+			return nil, fmt.Errorf("secret %s of %s in %s is corrupt", name, app, environment)
+		}
+
+		nonceSize := sS.aead.NonceSize()
+
+		value, err := sS.aead.Open(nil, sealedValue[:nonceSize], sealedValue[nonceSize:], secretAdditionalData(app, environment, name))
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s of %s in %s", errSecretsWrongKey, name, app, environment)
+		}
+
+		secretValues[name] = string(value)
+	}
+
+	return secretValues, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	testSecretKey  = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	otherSecretKey = "ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+)
+
+func TestSecretStoreRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	secretsPath := filepath.Join(dir, "secrets.json")
+
+	secrets, err := newSecretStore(secretsPath, uyghurs.UyghursSecrets{UyghursKey: testSecretKey})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{"DB_PASSWORD": "hunter2", "API_TOKEN": "abc"} {
+		err = secrets.set("web", "production", name, value)
+
+		if err != nil {
+			t.Fatalf("set %s: %s", name, err)
+		}
+	}
+
+	err = secrets.set("web", "staging", "DB_PASSWORD", "staging-password")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileBytes, err := ioutil.ReadFile(secretsPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(fileBytes), "hunter2") {
+		t.Errorf("secrets file holds a plaintext value: %s", fileBytes)
+	}
+
+	// A store loaded from the file with the same key reads what was set
+	reloadedSecrets, err := newSecretStore(secretsPath, uyghurs.UyghursSecrets{UyghursKey: testSecretKey})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		app         string
+		environment string
+		want        map[string]string
+	}{
+		{"web", "production", map[string]string{"DB_PASSWORD": "hunter2", "API_TOKEN": "abc"}},
+		{"web", "staging", map[string]string{"DB_PASSWORD": "staging-password"}},
+		{"web", "preview", map[string]string{}},
+		{"api", "production", map[string]string{}},
+	}
+
+	for _, test := range tests {
+		got, err := reloadedSecrets.environment(test.app, test.environment)
+
+		if err != nil {
+			t.Errorf("environment(%s, %s): %s", test.app, test.environment, err)
+
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("environment(%s, %s) = %v, want %v", test.app, test.environment, got, test.want)
+		}
+	}
+}
+
+func TestSecretStoreErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		readKey string
+		// move rewrites where the sealed value is stored before reading
+		move        func(secrets map[string]map[string]map[string]*storedSecret)
+		app         string
+		environment string
+		wantErr     error
+	}{
+		{"same key", testSecretKey, nil, "web", "production", nil},
+		{"other key", otherSecretKey, nil, "web", "production", errSecretsWrongKey},
+		{"no key", "", nil, "web", "production", errSecretsNoKey},
+		{
+			"moved to another name", testSecretKey,
+			func(secrets map[string]map[string]map[string]*storedSecret) {
+				secrets["web"]["production"]["API_TOKEN"] = secrets["web"]["production"]["DB_PASSWORD"]
+			},
+			"web", "production", errSecretsWrongKey,
+		},
+		{
+			"moved to another environment", testSecretKey,
+			func(secrets map[string]map[string]map[string]*storedSecret) {
+				secrets["web"]["staging"] = secrets["web"]["production"]
+			},
+			"web", "staging", errSecretsWrongKey,
+		},
+		{
+			"moved to another app", testSecretKey,
+			func(secrets map[string]map[string]map[string]*storedSecret) {
+				secrets["api"] = secrets["web"]
+			},
+			"api", "production", errSecretsWrongKey,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "secrets")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer os.RemoveAll(dir)
+
+			secretsPath := filepath.Join(dir, "secrets.json")
+
+			secrets, err := newSecretStore(secretsPath, uyghurs.UyghursSecrets{UyghursKey: testSecretKey})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = secrets.set("web", "production", "DB_PASSWORD", "hunter2")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.move != nil {
+				test.move(secrets.secrets)
+
+				err = writeJSONFile(secretsPath, secrets.secrets)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			readSecrets, err := newSecretStore(secretsPath, uyghurs.UyghursSecrets{UyghursKey: test.readKey})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = readSecrets.environment(test.app, test.environment)
+
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("environment(%s, %s) error = %v, want %v", test.app, test.environment, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeSecretKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		encodedKey string
+		wantErr    bool
+	}{
+		{"hex", testSecretKey, false},
+		{"base64", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=", false},
+		{"short hex", "000102", true},
+		{"long base64", "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8gIQ==", true},
+		{"neither", "not a key", true},
+	}
+
+	for _, test := range tests {
+		_, err := decodeSecretKey(test.encodedKey)
+
+		if (err != nil) != test.wantErr {
+			t.Errorf("decodeSecretKey(%s) error = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// newRandomID returns a random hex string suitable for identifying jobs and
+// other persisted records.
+func newRandomID() string {
+	idBytes := make([]byte, 12)
+
+	_, err := rand.Read(idBytes)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(idBytes)
+}
+
+// readJSONFile unmarshals the file at filePath into v, a missing file is not
+// an error and leaves v untouched.
+func readJSONFile(filePath string, v interface{}) error {
+	fileBytes, err := ioutil.ReadFile(filePath)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(fileBytes, v)
+}
+
+// writeJSONFile atomically replaces the file at filePath with v marshalled as
+// JSON, so a crash mid-write never leaves a truncated file behind.
+func writeJSONFile(filePath string, v interface{}) error {
+	fileBytes, err := json.MarshalIndent(v, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0700)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.Write(fileBytes)
+
+	if err == nil {
+		err = tempFile.Sync()
+	}
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tempFile.Name())
+
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), filePath)
+}
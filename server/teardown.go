@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+var errNotTornDown = errors.New("app isn't torn down")
+
+// teardown records taking an app down, what was removed and, if Err is set,
+// what couldn't be. Project is the compose project name the app's containers,
+// networks and volumes are labelled with.
+type teardown struct {
+	App            string    `json:"app"`
+	Project        string    `json:"project"`
+	Environment    string    `json:"environment"`
+	Trigger        string    `json:"trigger"`
+	RemoveVolumes  bool      `json:"removeVolumes"`
+	Routes         int       `json:"routes"`
+	Containers     []string  `json:"containers"`
+	Networks       []string  `json:"networks"`
+	Volumes        []string  `json:"volumes"`
+	NothingRemoved bool      `json:"nothingRemoved"`
+	Err            string    `json:"err,omitempty"`
+	StartedAt      time.Time `json:"startedAt"`
+	FinishedAt     time.Time `json:"finishedAt"`
+}
+
+// teardownStore keeps the last teardown of every app that is torn down, so
+// its routes aren't brought back from its checkout when the server restarts.
+// An app's teardown is forgotten once it is deployed again.
+type teardownStore struct {
+	teardownsPath string
+	teardowns     map[string]*teardown
+	lock          *sync.Mutex
+}
+
+func newTeardownStore(teardownsPath string) (*teardownStore, error) {
+	tS := &teardownStore{
+		teardownsPath: teardownsPath,
+		teardowns:     make(map[string]*teardown),
+		lock:          &sync.Mutex{},
+	}
+
+	err := readJSONFile(tS.teardownsPath, &tS.teardowns)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return tS, nil
+}
+
+func (tS *teardownStore) record(appTeardown *teardown) error {
+	tS.lock.Lock()
+
+	defer tS.lock.Unlock()
+
+	tS.teardowns[appTeardown.App] = appTeardown
+
+	return writeJSONFile(tS.teardownsPath, tS.teardowns)
+}
+
+// clear forgets the app's teardown, it is a no-op for apps that aren't torn
+// down.
+func (tS *teardownStore) clear(app string) error {
+	tS.lock.Lock()
+
+	defer tS.lock.Unlock()
+
+	if _, exists := tS.teardowns[app]; !exists {
+		return nil
+	}
+
+	delete(tS.teardowns, app)
+
+	return writeJSONFile(tS.teardownsPath, tS.teardowns)
+}
+
+func (tS *teardownStore) get(app string) (*teardown, error) {
+	tS.lock.Lock()
+
+	defer tS.lock.Unlock()
+
+	appTeardown, exists := tS.teardowns[app]
+
+	if !exists {
+		return nil, errNotTornDown
+	}
+
+	return appTeardown, nil
+}
+
+// tornDown names every app that is torn down.
+func (tS *teardownStore) tornDown() map[string]bool {
+	tS.lock.Lock()
+
+	defer tS.lock.Unlock()
+
+	apps := make(map[string]bool, len(tS.teardowns))
+
+	for app := range tS.teardowns {
+		apps[app] = true
+	}
+
+	return apps
+}
+
+// teardown is compose down for a project. What to remove is found by label
+// rather than from the compose file, so it works whatever revision is
+// checked out: the project's containers, leftover hook containers included,
+// and its networks, and its named and anonymous volumes only if the teardown
+// removes volumes. External networks and volumes are never labelled, so they stay.
+// Everything is tried, the error sums up what couldn't be removed.
+func (cR *composeReconciler) teardown(ctx context.Context, appTeardown *teardown) error {
+	if appTeardown.Project == "" {
+		return fmt.Errorf("app name %q has no usable characters", appTeardown.App)
+	}
+
+	failures := make([]string, 0)
+
+	for _, label := range []string{projectLabel, hookLabel} {
+		containerFilter := filters.NewArgs()
+
+		containerFilter.Add("label", label+"="+appTeardown.Project)
+
+		containers, err := cR.cli.ContainerList(ctx, types.ContainerListOptions{
+			All:     true,
+			Filters: containerFilter,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, projectContainer := range containers {
+			containerName := projectContainer.ID
+
+			if len(projectContainer.Names) != 0 {
+				containerName = strings.TrimPrefix(projectContainer.Names[0], "/")
+			}
+
+			err = cR.removeContainer(ctx, projectContainer.ID, appTeardown.RemoveVolumes)
+
+			if err != nil {
+				failures = append(failures, err.Error())
+
+				continue
+			}
+
+			appTeardown.Containers = append(appTeardown.Containers, containerName)
+		}
+	}
+
+	projectFilter := filters.NewArgs()
+
+	projectFilter.Add("label", projectLabel+"="+appTeardown.Project)
+
+	networks, err := cR.cli.NetworkList(ctx, types.NetworkListOptions{Filters: projectFilter})
+
+	if err != nil {
+		return err
+	}
+
+	for _, projectNetwork := range networks {
+		err = cR.cli.NetworkRemove(ctx, projectNetwork.ID)
+
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("error removing network %s: %s", projectNetwork.Name, err))
+
+			continue
+		}
+
+		appTeardown.Networks = append(appTeardown.Networks, projectNetwork.Name)
+	}
+
+	if appTeardown.RemoveVolumes {
+		volumes, err := cR.cli.VolumeList(ctx, projectFilter)
+
+		if err != nil {
+			return err
+		}
+
+		for _, projectVolume := range volumes.Volumes {
+			err = cR.cli.VolumeRemove(ctx, projectVolume.Name, false)
+
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("error removing volume %s: %s", projectVolume.Name, err))
+
+				continue
+			}
+
+			appTeardown.Volumes = append(appTeardown.Volumes, projectVolume.Name)
+		}
+	}
+
+	if len(failures) != 0 {
+		return fmt.Errorf("not everything could be removed: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
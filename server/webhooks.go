@@ -0,0 +1,567 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+const (
+	pingEvent      = "ping"
+	pushEvent      = "push"
+	refCreateEvent = "create"
+	refDeleteEvent = "delete"
+	releaseEvent   = "release"
+)
+
+const zeroCommit = "0000000000000000000000000000000000000000"
+
+var errUnsupportedEvent = errors.New("unsupported event")
+
+// webhookProvider verifies and normalizes the webhooks of one git host, so
+// every host's pushes reach the worker dispatch in the same shape.
+type webhookProvider interface {
+	// deliveryID returns the host's unique ID for the delivery, or an empty
+	// string if it didn't send one.
+	deliveryID(header http.Header) string
+	verify(header http.Header, body []byte) error
+	parse(header http.Header, body []byte) ([]*webhookEvent, error)
+}
+
+func newWebhookProvider(providerName, secret string) webhookProvider {
+	switch providerName {
+	case "github":
+		return &githubProvider{secret: secret}
+	case "gitlab":
+		return &gitlabProvider{token: secret}
+	case "gitea":
+		return &giteaProvider{secret: secret}
+	case "bitbucket":
+		return &bitbucketProvider{secret: secret}
+	default:
+		panic(fmt.Sprintf("unknown webhook provider %q", providerName))
+	}
+}
+
+// webhookEvent is a webhook normalized into what the server acts on, Push
+// describes the ref and repository for every kind but ping.
+type webhookEvent struct {
+	Kind string
+	// RefType is "branch" or "tag" for create and delete events.
+	RefType string
+	// Action is the release action for release events, e.g. "published".
+	Action  string
+	Message string
+	// SentAt is when the event happened according to its payload, zero if
+	// the payload doesn't say.
+	SentAt time.Time
+	Push   uyghurs.GithubPush
+}
+
+// webhookTimestamp is a time sent either as unix seconds, as in GitHub push
+// events, or as an RFC 3339 string, as in every other event and in Gitea's.
+type webhookTimestamp int64
+
+func (wT *webhookTimestamp) UnmarshalJSON(timestampBytes []byte) error {
+	if string(timestampBytes) == "null" {
+		return nil
+	}
+
+	if !strings.HasPrefix(string(timestampBytes), `"`) {
+		return json.Unmarshal(timestampBytes, (*int64)(wT))
+	}
+
+	var timestamp time.Time
+
+	err := json.Unmarshal(timestampBytes, &timestamp)
+
+	if err != nil {
+		return err
+	}
+
+	*wT = webhookTimestamp(timestamp.Unix())
+
+	return nil
+}
+
+type githubRepository struct {
+	Name          string           `json:"name"`
+	FullName      string           `json:"full_name"`
+	HTMLURL       string           `json:"html_url"`
+	CloneURL      string           `json:"clone_url"`
+	GitURL        string           `json:"git_url"`
+	SSHURL        string           `json:"ssh_url"`
+	DefaultBranch string           `json:"default_branch"`
+	MasterBranch  string           `json:"master_branch"`
+	PushedAt      webhookTimestamp `json:"pushed_at"`
+	UpdatedAt     webhookTimestamp `json:"updated_at"`
+}
+
+// sentAt is the repository's last push, Gitea payloads don't have pushed_at
+// but bump updated_at on every push instead.
+func (gR githubRepository) sentAt() time.Time {
+	switch {
+	case gR.PushedAt != 0:
+		return time.Unix(int64(gR.PushedAt), 0)
+	case gR.UpdatedAt != 0:
+		return time.Unix(int64(gR.UpdatedAt), 0)
+	default:
+		return time.Time{}
+	}
+}
+
+func (gR githubRepository) repository() uyghurs.Repository {
+	return uyghurs.Repository{
+		Name:          gR.Name,
+		FullName:      gR.FullName,
+		URL:           gR.HTMLURL,
+		CloneURL:      gR.CloneURL,
+		PushedAt:      int64(gR.PushedAt),
+		GitURL:        gR.GitURL,
+		SSHURL:        gR.SSHURL,
+		DefaultBranch: gR.DefaultBranch,
+		MasterBranch:  gR.MasterBranch,
+	}
+}
+
+type githubPushEvent struct {
+	Ref        string           `json:"ref"`
+	After      string           `json:"after"`
+	Deleted    bool             `json:"deleted"`
+	Repository githubRepository `json:"repository"`
+}
+
+type githubPing struct {
+	Zen        string           `json:"zen"`
+	Repository githubRepository `json:"repository"`
+}
+
+type githubRefEvent struct {
+	Ref        string           `json:"ref"`
+	RefType    string           `json:"ref_type"`
+	Repository githubRepository `json:"repository"`
+}
+
+type githubReleaseEvent struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName     string           `json:"tag_name"`
+		Draft       bool             `json:"draft"`
+		Prerelease  bool             `json:"prerelease"`
+		CreatedAt   webhookTimestamp `json:"created_at"`
+		PublishedAt webhookTimestamp `json:"published_at"`
+	} `json:"release"`
+	Repository githubRepository `json:"repository"`
+}
+
+// verifyHMACSignature checks a "<hash>=<hex digest>" signature of body.
+func verifyHMACSignature(signature string, body []byte, secret string) error {
+	signatureParts := strings.SplitN(signature, "=", 2)
+
+	if len(signatureParts) != 2 {
+		return errors.New("error parsing signature")
+	}
+
+	var hashFunc func() hash.Hash
+
+	switch signatureParts[0] {
+	case "sha1":
+		hashFunc = sha1.New
+	case "sha256":
+		hashFunc = sha256.New
+	case "sha512":
+		hashFunc = sha512.New
+	default:
+		return fmt.Errorf("unknown hash type prefix: %q", signatureParts[0])
+	}
+
+	mac := hmac.New(hashFunc, []byte(secret))
+
+	mac.Write(body)
+
+	expectedMAC := mac.Sum(nil)
+
+	signatureBytes, err := hex.DecodeString(signatureParts[1])
+
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(signatureBytes, expectedMAC) {
+		return errors.New("signature doesn't match payload")
+	}
+
+	return nil
+}
+
+type githubProvider struct {
+	secret string
+}
+
+func (gP *githubProvider) deliveryID(header http.Header) string {
+	return header.Get("X-GitHub-Delivery")
+}
+
+// verify checks the X-Hub-Signature-256 header, falling back to the legacy
+// X-Hub-Signature header only if it is missing.
+func (gP *githubProvider) verify(header http.Header, body []byte) error {
+	signature := header.Get("X-Hub-Signature-256")
+
+	if signature == "" {
+		signature = header.Get("X-Hub-Signature")
+	}
+
+	if signature == "" {
+		return errors.New("github request has no signature header")
+	}
+
+	return verifyHMACSignature(signature, body, gP.secret)
+}
+
+func (gP *githubProvider) parse(header http.Header, body []byte) ([]*webhookEvent, error) {
+	event, err := parseGithubEvent(header.Get("X-GitHub-Event"), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []*webhookEvent{event}, nil
+}
+
+// parseGithubEvent normalizes a GitHub webhook of the given X-GitHub-Event
+// type, errUnsupportedEvent is returned for types the server doesn't handle.
+func parseGithubEvent(eventType string, body []byte) (*webhookEvent, error) {
+	switch eventType {
+	case pingEvent:
+		var ping githubPing
+
+		err := json.Unmarshal(body, &ping)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &webhookEvent{
+			Kind:    pingEvent,
+			Message: ping.Zen,
+			Push: uyghurs.GithubPush{
+				Repository: ping.Repository.repository(),
+			},
+		}, nil
+	case pushEvent:
+		var push githubPushEvent
+
+		err := json.Unmarshal(body, &push)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &webhookEvent{
+			Kind:   pushEvent,
+			SentAt: push.Repository.sentAt(),
+			Push: uyghurs.GithubPush{
+				Ref:        push.Ref,
+				After:      push.After,
+				Deleted:    push.Deleted || push.After == zeroCommit,
+				Repository: push.Repository.repository(),
+			},
+		}, nil
+	case refCreateEvent, refDeleteEvent:
+		var refEvent githubRefEvent
+
+		err := json.Unmarshal(body, &refEvent)
+
+		if err != nil {
+			return nil, err
+		}
+
+		refPrefix := branchRefPrefix
+
+		if refEvent.RefType == "tag" {
+			refPrefix = tagRefPrefix
+		} else if refEvent.RefType != "branch" {
+			return nil, fmt.Errorf("unknown ref type %q", refEvent.RefType)
+		}
+
+		return &webhookEvent{
+			Kind:    eventType,
+			RefType: refEvent.RefType,
+			SentAt:  refEvent.Repository.sentAt(),
+			Push: uyghurs.GithubPush{
+				Ref:        refPrefix + refEvent.Ref,
+				Deleted:    eventType == refDeleteEvent,
+				Repository: refEvent.Repository.repository(),
+			},
+		}, nil
+	case releaseEvent:
+		var release githubReleaseEvent
+
+		err := json.Unmarshal(body, &release)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var releasedAt time.Time
+
+		// Drafts aren't published yet
+		if release.Release.PublishedAt != 0 {
+			releasedAt = time.Unix(int64(release.Release.PublishedAt), 0)
+		} else if release.Release.CreatedAt != 0 {
+			releasedAt = time.Unix(int64(release.Release.CreatedAt), 0)
+		}
+
+		return &webhookEvent{
+			Kind:   releaseEvent,
+			Action: release.Action,
+			SentAt: releasedAt,
+			Push: uyghurs.GithubPush{
+				// The commit is resolved from the tag by the worker
+				Ref:        tagRefPrefix + release.Release.TagName,
+				Repository: release.Repository.repository(),
+			},
+		}, nil
+	case "":
+		return nil, errors.New("request has no event type")
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEvent, eventType)
+	}
+}
+
+type gitlabProvider struct {
+	token string
+}
+
+type gitlabPush struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSHA string `json:"checkout_sha"`
+	Project     struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		WebURL            string `json:"web_url"`
+		GitHTTPURL        string `json:"git_http_url"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		DefaultBranch     string `json:"default_branch"`
+	} `json:"project"`
+}
+
+func (gP *gitlabProvider) deliveryID(header http.Header) string {
+	return header.Get("X-Gitlab-Event-UUID")
+}
+
+// verify compares the X-Gitlab-Token header to the configured token, GitLab
+// sends the secret itself rather than a signature.
+func (gP *gitlabProvider) verify(header http.Header, body []byte) error {
+	if subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(gP.token)) != 1 {
+		return errors.New("gitlab request has a missing or wrong token")
+	}
+
+	return nil
+}
+
+func (gP *gitlabProvider) parse(header http.Header, body []byte) ([]*webhookEvent, error) {
+	eventType := header.Get("X-Gitlab-Event")
+
+	if eventType != "Push Hook" && eventType != "Tag Push Hook" {
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEvent, eventType)
+	}
+
+	var push gitlabPush
+
+	err := json.Unmarshal(body, &push)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commit := push.CheckoutSHA
+
+	if commit == "" {
+		commit = push.After
+	}
+
+	return []*webhookEvent{
+		{
+			Kind: pushEvent,
+			Push: uyghurs.GithubPush{
+				Ref:     push.Ref,
+				After:   commit,
+				Deleted: push.After == zeroCommit,
+				Repository: uyghurs.Repository{
+					Name:          path.Base(push.Project.PathWithNamespace),
+					FullName:      push.Project.PathWithNamespace,
+					URL:           push.Project.WebURL,
+					CloneURL:      push.Project.GitHTTPURL,
+					SSHURL:        push.Project.GitSSHURL,
+					DefaultBranch: push.Project.DefaultBranch,
+				},
+			},
+		},
+	}, nil
+}
+
+// giteaProvider handles Gitea webhooks, whose payloads mirror GitHub's.
+type giteaProvider struct {
+	secret string
+}
+
+func (gP *giteaProvider) deliveryID(header http.Header) string {
+	return header.Get("X-Gitea-Delivery")
+}
+
+// verify checks the X-Gitea-Signature header, a bare hex HMAC-SHA256.
+func (gP *giteaProvider) verify(header http.Header, body []byte) error {
+	signature := header.Get("X-Gitea-Signature")
+
+	if signature == "" {
+		return errors.New("gitea request has no signature header")
+	}
+
+	return verifyHMACSignature("sha256="+signature, body, gP.secret)
+}
+
+func (gP *giteaProvider) parse(header http.Header, body []byte) ([]*webhookEvent, error) {
+	event, err := parseGithubEvent(header.Get("X-Gitea-Event"), body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []*webhookEvent{event}, nil
+}
+
+type bitbucketProvider struct {
+	secret string
+}
+
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+type bitbucketPush struct {
+	Push struct {
+		Changes []struct {
+			New *bitbucketRef `json:"new"`
+			Old *bitbucketRef `json:"old"`
+		} `json:"changes"`
+	} `json:"push"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		Links    struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+		MainBranch *struct {
+			Name string `json:"name"`
+		} `json:"mainbranch"`
+	} `json:"repository"`
+}
+
+func (bP *bitbucketProvider) deliveryID(header http.Header) string {
+	return header.Get("X-Request-UUID")
+}
+
+// verify checks the HMAC in the X-Hub-Signature header Bitbucket sends when
+// the webhook has a secret.
+func (bP *bitbucketProvider) verify(header http.Header, body []byte) error {
+	signature := header.Get("X-Hub-Signature")
+
+	if signature == "" {
+		return errors.New("bitbucket request has no signature header")
+	}
+
+	return verifyHMACSignature(signature, body, bP.secret)
+}
+
+// parse turns a repo:push into one push event per changed ref, since a
+// single Bitbucket push can update several branches and tags at once.
+func (bP *bitbucketProvider) parse(header http.Header, body []byte) ([]*webhookEvent, error) {
+	eventType := header.Get("X-Event-Key")
+
+	if eventType == "diagnostics:ping" {
+		return []*webhookEvent{{Kind: pingEvent}}, nil
+	}
+
+	if eventType != "repo:push" {
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEvent, eventType)
+	}
+
+	var push bitbucketPush
+
+	err := json.Unmarshal(body, &push)
+
+	if err != nil {
+		return nil, err
+	}
+
+	repository := uyghurs.Repository{
+		Name:     path.Base(push.Repository.FullName),
+		FullName: push.Repository.FullName,
+		URL:      push.Repository.Links.HTML.Href,
+		CloneURL: push.Repository.Links.HTML.Href + ".git",
+	}
+
+	if push.Repository.MainBranch != nil {
+		repository.DefaultBranch = push.Repository.MainBranch.Name
+	}
+
+	events := make([]*webhookEvent, 0, len(push.Push.Changes))
+
+	for _, change := range push.Push.Changes {
+		changedRef := change.New
+
+		if changedRef == nil {
+			changedRef = change.Old
+		}
+
+		if changedRef == nil {
+			continue
+		}
+
+		refPrefix := branchRefPrefix
+
+		if changedRef.Type == "tag" {
+			refPrefix = tagRefPrefix
+		}
+
+		githubPush := uyghurs.GithubPush{
+			Ref:        refPrefix + changedRef.Name,
+			Deleted:    change.New == nil,
+			Repository: repository,
+		}
+
+		if change.New != nil {
+			githubPush.After = change.New.Target.Hash
+		}
+
+		events = append(events, &webhookEvent{
+			Kind: pushEvent,
+			Push: githubPush,
+		})
+	}
+
+	if len(events) == 0 {
+		return nil, errors.New("bitbucket push has no changes")
+	}
+
+	return events, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+	"gopkg.in/olahol/melody.v1"
+)
+
+var errNoIdleWorker = errors.New("no idle worker available")
+
+type worker struct {
+	// id tells connections apart, names don't have to be unique
+	id            string
+	name          string
+	session       *melody.Session
+	state         uyghurs.WorkerStateType
+	reportedState uyghurs.WorkerStateType
+	connectedAt   time.Time
+	lastSeen      time.Time
+	assignment    string
+	handshaken    bool
+}
+
+type workerStatus struct {
+	Name          string                  `json:"name"`
+	State         uyghurs.WorkerStateType `json:"state"`
+	ReportedState uyghurs.WorkerStateType `json:"reportedState"`
+	ConnectedAt   time.Time               `json:"connectedAt"`
+	LastSeen      time.Time               `json:"lastSeen"`
+	AssignmentID  string                  `json:"assignmentId,omitempty"`
+}
+
+// workerPool tracks every connected worker and the state it is in, all access
+// goes through the lock since melody calls the handlers from many goroutines.
+type workerPool struct {
+	workers     map[*melody.Session]*worker
+	lock        *sync.Mutex
+	workerCount int
+}
+
+func newWorkerPool() *workerPool {
+	return &workerPool{
+		lock:    &sync.Mutex{},
+		workers: make(map[*melody.Session]*worker),
+	}
+}
+
+func (wP *workerPool) addWorker(s *melody.Session) *worker {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	wP.workerCount++
+
+	workerName := s.Request.URL.Query().Get("name")
+
+	if workerName == "" {
+		workerName = fmt.Sprintf("worker-%d", wP.workerCount)
+	}
+
+	newWorker := &worker{
+		id:          newRandomID(),
+		name:        workerName,
+		session:     s,
+		state:       uyghurs.Idle,
+		connectedAt: time.Now(),
+		lastSeen:    time.Now(),
+	}
+
+	wP.workers[s] = newWorker
+
+	return newWorker
+}
+
+func (wP *workerPool) removeWorker(s *melody.Session) *worker {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	removedWorker, exists := wP.workers[s]
+
+	if !exists {
+		return nil
+	}
+
+	delete(wP.workers, s)
+
+	return removedWorker
+}
+
+func (wP *workerPool) getWorker(s *melody.Session) (*worker, bool) {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	existingWorker, exists := wP.workers[s]
+
+	return existingWorker, exists
+}
+
+// completeHandshake makes the worker eligible for work, workerName replaces
+// the name given when connecting if it isn't empty.
+func (wP *workerPool) completeHandshake(s *melody.Session, workerName string) {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	existingWorker, exists := wP.workers[s]
+
+	if !exists {
+		return
+	}
+
+	if workerName != "" {
+		existingWorker.name = workerName
+	}
+
+	existingWorker.handshaken = true
+	existingWorker.lastSeen = time.Now()
+}
+
+func (wP *workerPool) isHandshaken(s *melody.Session) bool {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	existingWorker, exists := wP.workers[s]
+
+	return exists && existingWorker.handshaken
+}
+
+func (wP *workerPool) listWorkers() []workerStatus {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	workerStatuses := make([]workerStatus, 0, len(wP.workers))
+
+	for _, existingWorker := range wP.workers {
+		status := workerStatus{
+			Name:          existingWorker.name,
+			State:         existingWorker.state,
+			ReportedState: existingWorker.reportedState,
+			ConnectedAt:   existingWorker.connectedAt,
+			LastSeen:      existingWorker.lastSeen,
+			AssignmentID:  existingWorker.assignment,
+		}
+
+		workerStatuses = append(workerStatuses, status)
+	}
+
+	return workerStatuses
+}
+
+// finishWork marks the worker as idle if jobID is the job it was assigned,
+// an answer for any other job says nothing about the one it is building.
+func (wP *workerPool) finishWork(s *melody.Session, jobID string) bool {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	existingWorker, exists := wP.workers[s]
+
+	if !exists || existingWorker.assignment == "" || existingWorker.assignment != jobID {
+		return false
+	}
+
+	existingWorker.assignment = ""
+	existingWorker.state = uyghurs.Idle
+	existingWorker.lastSeen = time.Now()
+
+	return true
+}
+
+// dropAssignment takes the worker assigned jobID off it once its lease ran
+// out, from then on the worker's pings decide whether it is idle. A worker
+// that is handed work while still building answers that it is busy.
+func (wP *workerPool) dropAssignment(jobID string) {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	for _, existingWorker := range wP.workers {
+		if existingWorker.assignment != jobID {
+			continue
+		}
+
+		existingWorker.assignment = ""
+		existingWorker.state = existingWorker.reportedState
+	}
+}
+
+// markBusy takes back the worker's assignment, which it was too busy to take,
+// it isn't handed more work until it reports that it is idle again.
+func (wP *workerPool) markBusy(s *melody.Session) *worker {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	existingWorker, exists := wP.workers[s]
+
+	if !exists {
+		return nil
+	}
+
+	existingWorker.assignment = ""
+	existingWorker.state = uyghurs.Building
+	existingWorker.reportedState = uyghurs.Building
+	existingWorker.lastSeen = time.Now()
+
+	return existingWorker
+}
+
+// recordPing notes that the worker is alive, a worker reporting that it is
+// building is never handed more work even if the server thinks it is idle.
+func (wP *workerPool) recordPing(s *melody.Session, reportedState uyghurs.WorkerStateType) {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	existingWorker, exists := wP.workers[s]
+
+	if !exists {
+		return
+	}
+
+	existingWorker.lastSeen = time.Now()
+	existingWorker.reportedState = reportedState
+
+	if existingWorker.assignment == "" {
+		existingWorker.state = reportedState
+	}
+}
+
+// removeDeadWorkers removes and returns every worker that hasn't been heard
+// from within timeout.
+func (wP *workerPool) removeDeadWorkers(timeout time.Duration) []*worker {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	deadWorkers := make([]*worker, 0)
+
+	for s, existingWorker := range wP.workers {
+		if time.Since(existingWorker.lastSeen) > timeout {
+			delete(wP.workers, s)
+
+			deadWorkers = append(deadWorkers, existingWorker)
+		}
+	}
+
+	return deadWorkers
+}
+
+func (wP *workerPool) broadcast(msg []byte) {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	for _, existingWorker := range wP.workers {
+		if !existingWorker.handshaken {
+			continue
+		}
+
+		err := existingWorker.session.Write(msg)
+
+		if err != nil {
+			fmt.Printf("error writing to worker %s: %s\n", existingWorker.name, err)
+		}
+	}
+}
+
+// dispatch writes the message to the longest connected idle worker that has
+// completed the handshake and marks
+// it as building, errNoIdleWorker is returned if every worker is busy. The
+// worker's name and ID are returned.
+func (wP *workerPool) dispatch(jobID string, workerRequestBytes []byte) (string, string, error) {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	var idleWorker *worker
+
+	for _, existingWorker := range wP.workers {
+		if !existingWorker.handshaken || existingWorker.state != uyghurs.Idle {
+			continue
+		}
+
+		if idleWorker == nil || existingWorker.connectedAt.Before(idleWorker.connectedAt) {
+			idleWorker = existingWorker
+		}
+	}
+
+	if idleWorker == nil {
+		return "", "", errNoIdleWorker
+	}
+
+	err := idleWorker.session.Write(workerRequestBytes)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	idleWorker.state = uyghurs.Building
+	idleWorker.assignment = jobID
+
+	return idleWorker.name, idleWorker.id, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/the-rileyj/uyghurs"
+	"gopkg.in/olahol/melody.v1"
+)
+
+func TestWorkerAssignments(t *testing.T) {
+	tests := []struct {
+		name           string
+		answeredJobID  string
+		expired        bool
+		reportedState  uyghurs.WorkerStateType
+		wantFinished   bool
+		wantState      uyghurs.WorkerStateType
+		wantAssignment string
+	}{
+		{"answer for its job", "job", false, uyghurs.Building, true, uyghurs.Idle, ""},
+		{"answer for another job", "old-job", false, uyghurs.Idle, false, uyghurs.Building, "job"},
+		{"expired while building", "", true, uyghurs.Building, false, uyghurs.Building, ""},
+		{"expired after it went idle", "", true, uyghurs.Idle, false, uyghurs.Idle, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &melody.Session{}
+
+			workers := newWorkerPool()
+
+			workers.workers[s] = &worker{
+				handshaken:    true,
+				state:         uyghurs.Building,
+				reportedState: test.reportedState,
+				assignment:    "job",
+			}
+
+			finished := false
+
+			if test.answeredJobID != "" {
+				finished = workers.finishWork(s, test.answeredJobID)
+			}
+
+			if test.expired {
+				workers.dropAssignment("job")
+			}
+
+			if finished != test.wantFinished {
+				t.Errorf("finishWork = %v, want %v", finished, test.wantFinished)
+			}
+
+			if test.expired {
+				workers.recordPing(s, test.reportedState)
+			}
+
+			got := workers.workers[s]
+
+			if got.state != test.wantState || got.assignment != test.wantAssignment {
+				t.Errorf("worker is %v with assignment %q, want %v with %q", got.state, got.assignment, test.wantState, test.wantAssignment)
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package uyghurs
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
 /*
 {
   "ref": "refs/heads/master",
@@ -25,15 +31,20 @@ type HongKongSettings struct {
 	HongKongProjectSettings ProjectMetadata `yaml:"x-hong-kong"`
 }
 
+// GithubPush describes a push to Ref, After is the pushed commit. An empty
+// After means the worker resolves Ref to a commit itself.
 type GithubPush struct {
 	Ref        string     `json:"ref"`
 	After      string     `json:"after"`
+	Deleted    bool       `json:"deleted"`
 	Repository Repository `json:"repository"`
 }
 
 type Repository struct {
 	Name          string `json:"name"`
+	FullName      string `json:"full_name"`
 	URL           string `json:"url"`
+	CloneURL      string `json:"clone_url"`
 	CreatedAt     int64  `json:"created_at"`
 	UpdatedAt     string `json:"updated_at"`
 	PushedAt      int64  `json:"pushed_at"`
@@ -43,9 +54,105 @@ type Repository struct {
 	MasterBranch  string `json:"master_branch"`
 }
 
+// ProtocolVersion is the version of the worker protocol spoken by this
+// package, peers speaking a version older than MinProtocolVersion are rejected.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// ProtocolVersionSupported reports whether a peer speaking version can talk
+// to a peer using this package.
+func ProtocolVersionSupported(version int) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
 type WorkerMessage struct {
-	Type        int                    `json:"type"`
-	MessageData map[string]interface{} `json:"messageData"`
+	Version     int               `json:"version"`
+	Type        WorkerMessageType `json:"type"`
+	MessageData json.RawMessage   `json:"messageData"`
+}
+
+// NewWorkerMessage wraps messageData in a WorkerMessage for the current
+// protocol version, the message type is derived from the type of messageData.
+func NewWorkerMessage(messageData interface{}) (*WorkerMessage, error) {
+	var messageType WorkerMessageType
+
+	switch messageData.(type) {
+	case WorkRequest, *WorkRequest:
+		messageType = WorkRequestType
+	case WorkResponse, *WorkResponse:
+		messageType = WorkResponseType
+	case PingRequest, *PingRequest:
+		messageType = PingRequestType
+	case PingResponse, *PingResponse:
+		messageType = PingResponseType
+	case HandshakeRequest, *HandshakeRequest:
+		messageType = HandshakeRequestType
+	case HandshakeResponse, *HandshakeResponse:
+		messageType = HandshakeResponseType
+	case BuildLog, *BuildLog:
+		messageType = BuildLogType
+	default:
+		return nil, fmt.Errorf("unknown worker message data type: %T", messageData)
+	}
+
+	messageDataBytes, err := json.Marshal(messageData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &WorkerMessage{
+		Version:     ProtocolVersion,
+		Type:        messageType,
+		MessageData: messageDataBytes,
+	}, nil
+}
+
+// MarshalWorkerMessage is shorthand for NewWorkerMessage followed by
+// json.Marshal.
+func MarshalWorkerMessage(messageData interface{}) ([]byte, error) {
+	workerMessage, err := NewWorkerMessage(messageData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(workerMessage)
+}
+
+// DecodeMessageData unmarshals the message data into the type matching the
+// message type and returns a pointer to it, e.g. *WorkResponse.
+func (wM *WorkerMessage) DecodeMessageData() (interface{}, error) {
+	var messageData interface{}
+
+	switch wM.Type {
+	case WorkRequestType:
+		messageData = &WorkRequest{}
+	case WorkResponseType:
+		messageData = &WorkResponse{}
+	case PingRequestType:
+		messageData = &PingRequest{}
+	case PingResponseType:
+		messageData = &PingResponse{}
+	case HandshakeRequestType:
+		messageData = &HandshakeRequest{}
+	case HandshakeResponseType:
+		messageData = &HandshakeResponse{}
+	case BuildLogType:
+		messageData = &BuildLog{}
+	default:
+		return nil, fmt.Errorf("unknown worker message type: %d", wM.Type)
+	}
+
+	err := json.Unmarshal(wM.MessageData, messageData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return messageData, nil
 }
 
 type WorkerMessageType int
@@ -55,6 +162,9 @@ const (
 	WorkResponseType
 	PingRequestType
 	PingResponseType
+	HandshakeRequestType
+	HandshakeResponseType
+	BuildLogType
 )
 
 type WorkerStateType int
@@ -64,24 +174,153 @@ const (
 	Building
 )
 
+// WorkRequest asks a worker to build GithubData. App names the built images,
+// which are pushed to Registry and named after ImageTemplate, and ComposeFile
+// is where the project's x-hong-kong settings are read from. Workers fall
+// back to the repository name, their own registry, DefaultImageTemplate and
+// docker-compose.yml when these are empty.
 type WorkRequest struct {
-	GithubData GithubPush `json:"githubData"`
+	JobID         string     `json:"jobId"`
+	App           string     `json:"app,omitempty"`
+	Registry      string     `json:"registry,omitempty"`
+	ImageTemplate string     `json:"imageTemplate,omitempty"`
+	ComposeFile   string     `json:"composeFile,omitempty"`
+	GithubData    GithubPush `json:"githubData"`
 }
 
+// DefaultImageTemplate names images <registry>/<app>_<build name>.
+const DefaultImageTemplate = "{registry}/{app}_{build}"
+
+// ImageName names the image built for a BuildInfo entry, without a tag, by
+// filling in {registry}, {app} and {build} in template. Image names are
+// always lower case.
+func ImageName(template, registry, app, build string) string {
+	if template == "" {
+		template = DefaultImageTemplate
+	}
+
+	return strings.ToLower(strings.NewReplacer("{registry}", registry, "{app}", app, "{build}", build).Replace(template))
+}
+
+// WorkResponse answers the WorkRequest with the same JobID.
 type WorkResponse struct {
-	Err             string
+	JobID           string          `json:"jobId"`
+	Err             string          `json:"err"`
 	GithubData      GithubPush      `json:"githubData"`
 	ProjectMetadata ProjectMetadata `json:"projectMetaData"`
+	// Images are the pushed images by BuildInfo name, pinned by digest, or by
+	// the commit tag if the registry didn't report a digest.
+	Images map[string]string `json:"images,omitempty"`
+	// Busy is set by a worker that is still building another job and didn't
+	// take this one, the job goes back in the queue. Err is set as well, so
+	// servers that don't know Busy don't take it for a finished build.
+	Busy bool `json:"busy,omitempty"`
+}
+
+// HandshakeRequest is the first message a worker sends after connecting.
+type HandshakeRequest struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	WorkerName      string `json:"workerName"`
+}
+
+// HandshakeResponse answers a HandshakeRequest, a worker that isn't accepted
+// is disconnected right after receiving it.
+type HandshakeResponse struct {
+	ProtocolVersion int    `json:"protocolVersion"`
+	Accepted        bool   `json:"accepted"`
+	Err             string `json:"err"`
+}
+
+// MaxBuildLogChunkSize is the most build output a worker puts in a single
+// BuildLog, it keeps the base64 encoded message well under the server's
+// websocket message size limit.
+const MaxBuildLogChunkSize = 4096
+
+// BuildLog carries a chunk of build output for the build of Commit in
+// Repository, Sequence starts at zero and the last chunk has Final set.
+type BuildLog struct {
+	Repository string `json:"repository"`
+	Commit     string `json:"commit"`
+	Sequence   int    `json:"sequence"`
+	Data       []byte `json:"data"`
+	Final      bool   `json:"final"`
+}
+
+type PingRequest struct {
+	SentAt int64 `json:"sentAt"`
 }
 
 type PingResponse struct {
-	State WorkerMessageType `json:"state"`
+	SentAt int64           `json:"sentAt"`
+	State  WorkerStateType `json:"state"`
 }
 
 type ProjectMetadata struct {
 	ProjectName   string       `json:"projectName" yaml:"projectName"`
 	BuildsInfo    []*BuildInfo `json:"buildInfo" yaml:"buildInfo"`
 	ProjectRoutes []*RouteInfo `json:"projectRoutes" yaml:"projectRoutes"`
+	DeployRules   *DeployRules `json:"deployRules,omitempty" yaml:"deployRules"`
+	Readiness     *Readiness   `json:"readiness,omitempty" yaml:"readiness"`
+	Hooks         *DeployHooks `json:"hooks,omitempty" yaml:"hooks"`
+	// Removed is only set in what the server sends the router, for a project
+	// that was torn down and whose routes have to go. It comes without
+	// ProjectRoutes, so routers that don't know Removed drop them as well.
+	Removed bool `json:"removed,omitempty" yaml:"-"`
+}
+
+// DeployRules decide which pushed refs are deployed, a push deploys if it
+// matches any of the rules. Without rules only the default branch deploys.
+type DeployRules struct {
+	// Branches are exact branch names or glob patterns, e.g. "release/*".
+	Branches []string `json:"branches" yaml:"branches"`
+	// Tags are exact tag names or glob patterns, e.g. "v*".
+	Tags []string `json:"tags" yaml:"tags"`
+	// SemverTags are semver constraints tags must satisfy, e.g. ">=1.2.0 <2",
+	// "^1.4.0", "~1.4.0" or "1.x".
+	SemverTags []string `json:"semverTags" yaml:"semverTags"`
+	// Releases deploys the tag of every published, non-draft release.
+	Releases bool `json:"releases" yaml:"releases"`
+}
+
+// Readiness decides when a deploy counts as done. Every deployed container
+// has to be running and pass its health check, if it has one, and every
+// probe has to succeed within Timeout or the deploy is rolled back.
+type Readiness struct {
+	// Timeout is a duration like "90s", two minutes if empty.
+	Timeout string            `json:"timeout,omitempty" yaml:"timeout"`
+	Probes  []*ReadinessProbe `json:"probes,omitempty" yaml:"probes"`
+}
+
+// ReadinessProbe is an HTTP GET against Path on Port of the container of
+// Service, it succeeds on any of Statuses or on any 2xx or 3xx if empty.
+type ReadinessProbe struct {
+	Service  string `json:"service" yaml:"service"`
+	Port     int    `json:"port" yaml:"port"`
+	Path     string `json:"path,omitempty" yaml:"path"`
+	Statuses []int  `json:"statuses,omitempty" yaml:"statuses"`
+}
+
+// DeployHooks are one-off containers run around a deploy. PreDeploy hooks,
+// like migrations, run one after another once the new images are pulled and
+// before any running container is touched, the first one that fails aborts
+// the deploy. PostDeploy hooks, like cache warmups, run once the deploy is
+// ready, a failing one is recorded but doesn't undo the deploy.
+type DeployHooks struct {
+	PreDeploy  []*DeployHook `json:"preDeploy,omitempty" yaml:"preDeploy"`
+	PostDeploy []*DeployHook `json:"postDeploy,omitempty" yaml:"postDeploy"`
+}
+
+// DeployHook runs Command in a container of the image built for the
+// BuildInfo named Build, it fails if it exits non-zero or runs longer than
+// Timeout. The container gets the environment, volumes and networks of
+// Service, by default the first service running the built image.
+type DeployHook struct {
+	Name    string   `json:"name" yaml:"name"`
+	Build   string   `json:"build" yaml:"build"`
+	Service string   `json:"service,omitempty" yaml:"service"`
+	Command []string `json:"command" yaml:"command"`
+	// Timeout is a duration like "5m", five minutes if empty.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout"`
 }
 
 type BuildInfo struct {